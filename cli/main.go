@@ -1,23 +1,84 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/alecthomas/kong"
 	"github.com/markgemmill/courier"
 	"github.com/markgemmill/courier/params"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
 )
 
 type SendCmd struct {
 	// courier options
-	Host     string `name:"host" short:"H" required:""`
-	Port     int    `name:"port" short:"P" required:""`
-	User     string `name:"user-name" short:"u" optional:""`
-	Password string `name:"user-pwd" short:"p" optional:""`
+	Transport    string   `name:"transport" default:"smtp"`
+	FileDir      string   `name:"file-dir" type:"path" optional:""`
+	Maildir      string   `name:"maildir" type:"path" optional:""`
+	MaildirOwner string   `name:"maildir-owner" optional:""`
+	SendmailPath string   `name:"sendmail-path" optional:""`
+	SendmailArgs []string `name:"sendmail-args" optional:""`
+	LMTPAddress  string   `name:"lmtp-address" optional:"" help:"LMTP server as host:port, or unix:/path/to/socket."`
+	MXHelo       string   `name:"mx-helo" optional:""`
+	MXPort       int      `name:"mx-port" optional:""`
+	// http api options
+	APIProvider       string   `name:"api-provider" group:"http api" enum:"sendgrid,postmark,resend,generic" default:"generic"`
+	APIEndpoint       string   `name:"api-endpoint" group:"http api" optional:""`
+	APIKey            string   `name:"api-key" group:"http api" optional:""`
+	APIPayloadFile    string   `name:"api-payload" group:"http api" type:"existingfile" optional:""`
+	APIHeaders        []string `name:"api-header" group:"http api" optional:""`
+	APIMessageIDField string   `name:"api-message-id-field" group:"http api" optional:""`
+	Host              string   `name:"host" short:"H" optional:""`
+	Port              int      `name:"port" short:"P" optional:""`
+	User              string   `name:"user-name" short:"u" optional:""`
+	Password          string   `name:"user-pwd" short:"p" optional:""`
+	Relays            []string `name:"relay" optional:""`
+	PoolSize          int      `name:"pool-size" optional:""`
+	Auth              string   `name:"auth" enum:"auto,plain,login,cram-md5,xoauth2" default:"auto"`
+	AuthToken         string   `name:"auth-token" optional:""`
+	// delivery options
+	RetryAttempts   int           `name:"retry-attempts" default:"0"`
+	Timeout         time.Duration `name:"timeout" optional:""`
+	RecipientPolicy string        `name:"recipient-policy" enum:"all,any" default:"all"`
+	Verbose         bool          `name:"verbose" short:"v"`
+	// limit options
+	RatePerSecond   float64  `name:"rate-per-second" group:"limits" optional:""`
+	RateBurst       int      `name:"rate-burst" group:"limits" optional:""`
+	HourlyQuota     int      `name:"hourly-quota" group:"limits" optional:""`
+	DailyQuota      int      `name:"daily-quota" group:"limits" optional:""`
+	DomainLimits    []string `name:"domain-limit" group:"limits" optional:""`
+	RateLimitNoWait bool     `name:"rate-limit-no-wait" group:"limits"`
+	// tls options
+	Encryption    string `name:"encryption" short:"E" group:"tls" enum:"none,tls,starttls,starttls-required" default:"none"`
+	TLSCAFile     string `name:"tls-ca-file" group:"tls" type:"existingfile" optional:""`
+	TLSServerName string `name:"tls-server-name" group:"tls" optional:""`
+	TLSMinVersion string `name:"tls-min-version" group:"tls" optional:""`
+	// dkim options
+	DKIMDomain           string   `name:"dkim-domain" group:"dkim" optional:""`
+	DKIMSelector         string   `name:"dkim-selector" group:"dkim" optional:""`
+	DKIMKeyFile          string   `name:"dkim-key" group:"dkim" type:"existingfile" optional:""`
+	DKIMHeaders          []string `name:"dkim-headers" group:"dkim" optional:""`
+	DKIMCanonicalization string   `name:"dkim-canonicalization" group:"dkim" default:"relaxed/relaxed"`
 	// envelop options
-	SendFrom string   `name:"send-from" short:"F" required:""`
-	ReplyTo  string   `name:"reply-to" optional:""`
-	SendTo   []string `name:"send-to" short:"T"`
-	SendCc   []string `name:"send-cc" short:"C"`
+	SendFrom   string   `name:"send-from" short:"F" required:""`
+	ReplyTo    string   `name:"reply-to" optional:""`
+	Sender     string   `name:"sender" optional:""`
+	ReturnPath string   `name:"return-path" optional:""`
+	VERP       bool     `name:"verp"`
+	SendTo     []string `name:"send-to" short:"T"`
+	SendCc     []string `name:"send-cc" short:"C"`
+	SendBcc    []string `name:"send-bcc" short:"B"`
+	// validation options
+	NoNormalize        bool `name:"no-normalize" group:"validation"`
+	RejectDisposable   bool `name:"reject-disposable" group:"validation"`
+	RejectRoleAccounts bool `name:"reject-role-accounts" group:"validation"`
+	CheckMX            bool `name:"check-mx" group:"validation"`
+	CheckSMTP          bool `name:"check-smtp" group:"validation"`
+	// safeguard options
+	RedirectTo      string   `name:"redirect-to" group:"safeguard" optional:""`
+	AllowRecipients []string `name:"allow-recipient" group:"safeguard" optional:""`
 	// message options
 	HighPriority bool              `name:"high-priority"`
 	Subject      string            `name:"subject" short:"S"`
@@ -29,6 +90,22 @@ type SendCmd struct {
 }
 
 func (cmd *SendCmd) AfterApply() error {
+	// relays can stand in for the host, but a host needs its port
+	if cmd.Transport == "smtp" && ((cmd.Host == "" && len(cmd.Relays) == 0) || (cmd.Host != "" && cmd.Port == 0)) {
+		return fmt.Errorf("The smtp transport requires --host and --port, or --relay.")
+	}
+	if cmd.Transport == "file" && cmd.FileDir == "" {
+		return fmt.Errorf("The file transport requires --file-dir.")
+	}
+	if cmd.Transport == "maildir" && cmd.Maildir == "" {
+		return fmt.Errorf("The maildir transport requires --maildir.")
+	}
+	if cmd.Transport == "lmtp" && cmd.LMTPAddress == "" {
+		return fmt.Errorf("The lmtp transport requires --lmtp-address.")
+	}
+	if cmd.Transport == "http" && cmd.APIProvider == "generic" && (cmd.APIEndpoint == "" || cmd.APIPayloadFile == "") {
+		return fmt.Errorf("The generic http api requires --api-endpoint and --api-payload.")
+	}
 	if cmd.Template != "none" && len(cmd.Params) == 0 {
 		return fmt.Errorf("Template option '%s' requires at least one parameter value.", cmd.Template)
 	}
@@ -42,16 +119,70 @@ type CLI struct {
 func (cmd *SendCmd) Run(ctx *kong.Context) error {
 	message := params.Parameters{
 		CourierParams: params.CourierParams{
-			Host:     cmd.Host,
-			Port:     cmd.Port,
-			User:     cmd.User,
-			Password: cmd.Password,
+			Transport:    cmd.Transport,
+			FileDir:      cmd.FileDir,
+			Maildir:      cmd.Maildir,
+			MaildirOwner: cmd.MaildirOwner,
+			SendmailPath: cmd.SendmailPath,
+			SendmailArgs: cmd.SendmailArgs,
+			LMTPAddress:  cmd.LMTPAddress,
+			MXHelo:       cmd.MXHelo,
+			MXPort:       cmd.MXPort,
+
+			APIProvider:       cmd.APIProvider,
+			APIEndpoint:       cmd.APIEndpoint,
+			APIKey:            cmd.APIKey,
+			APIPayloadFile:    cmd.APIPayloadFile,
+			APIHeaders:        cmd.APIHeaders,
+			APIMessageIDField: cmd.APIMessageIDField,
+			Host:              cmd.Host,
+			Port:              cmd.Port,
+			User:              cmd.User,
+			Password:          cmd.Password,
+			Relays:            cmd.Relays,
+			PoolSize:          cmd.PoolSize,
+
+			AuthMechanism: cmd.Auth,
+			AuthToken:     cmd.AuthToken,
+
+			Encryption:      cmd.Encryption,
+			TLSCAFile:       cmd.TLSCAFile,
+			TLSServerName:   cmd.TLSServerName,
+			TLSMinVersion:   cmd.TLSMinVersion,
+			RetryAttempts:   cmd.RetryAttempts,
+			RecipientPolicy: cmd.RecipientPolicy,
+
+			RatePerSecond:   cmd.RatePerSecond,
+			RateBurst:       cmd.RateBurst,
+			HourlyQuota:     cmd.HourlyQuota,
+			DailyQuota:      cmd.DailyQuota,
+			DomainLimits:    cmd.DomainLimits,
+			RateLimitNoWait: cmd.RateLimitNoWait,
+
+			DKIMDomain:           cmd.DKIMDomain,
+			DKIMSelector:         cmd.DKIMSelector,
+			DKIMKeyFile:          cmd.DKIMKeyFile,
+			DKIMHeaders:          cmd.DKIMHeaders,
+			DKIMCanonicalization: cmd.DKIMCanonicalization,
 		},
 		EnvelopParams: params.EnvelopParams{
-			SendFrom: cmd.SendFrom,
-			ReplyTo:  cmd.ReplyTo,
-			SendTo:   cmd.SendTo,
-			SendCc:   cmd.SendCc,
+			SendFrom:   cmd.SendFrom,
+			ReplyTo:    cmd.ReplyTo,
+			Sender:     cmd.Sender,
+			ReturnPath: cmd.ReturnPath,
+			VERP:       cmd.VERP,
+			SendTo:     cmd.SendTo,
+			SendCc:     cmd.SendCc,
+			SendBcc:    cmd.SendBcc,
+
+			NoNormalize:        cmd.NoNormalize,
+			RejectDisposable:   cmd.RejectDisposable,
+			RejectRoleAccounts: cmd.RejectRoleAccounts,
+			CheckMX:            cmd.CheckMX,
+			CheckSMTP:          cmd.CheckSMTP,
+
+			RedirectTo:      cmd.RedirectTo,
+			AllowRecipients: cmd.AllowRecipients,
 		},
 		MessageParams: params.MessageParams{
 			HighPriority: cmd.HighPriority,
@@ -60,11 +191,45 @@ func (cmd *SendCmd) Run(ctx *kong.Context) error {
 		},
 	}
 
+	// warnings, such as refused recipients or what a safeguard changed,
+	// are reported even without --verbose
+	level := slog.LevelWarn
+	if cmd.Verbose {
+		level = slog.LevelDebug
+	}
+	message.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			// the conversation is easier to follow without timestamps
+			if attr.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}))
+
 	message.TemplateType = cmd.Template
 	params.SetMessage(&message, cmd.Message, cmd.Html)
 	params.SetTemplateData(&message, cmd.Params)
 
-	return courier.Deliver(message)
+	// stop cleanly on ctrl-c rather than leaving the server hanging
+	deliveryCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if cmd.Timeout > 0 {
+		var cancel context.CancelFunc
+		deliveryCtx, cancel = context.WithTimeout(deliveryCtx, cmd.Timeout)
+		defer cancel()
+	}
+
+	result, err := courier.DeliverContext(deliveryCtx, message)
+	if err != nil {
+		return err
+	}
+	if result != nil {
+		message.Logger.Info("message delivered", slog.String("host", result.Host))
+	}
+	return nil
 }
 
 func main() {
@@ -0,0 +1,112 @@
+package couriertest
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"net/textproto"
+	"strings"
+)
+
+func (srv *Server) mechanisms() []string {
+	if len(srv.AuthMechanisms) == 0 {
+		return []string{"PLAIN"}
+	}
+	return srv.AuthMechanisms
+}
+
+func (srv *Server) offers(mechanism string) bool {
+	for _, offered := range srv.mechanisms() {
+		if strings.EqualFold(offered, mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSecret reports whether secret is the password or token of user.
+func (srv *Server) checkSecret(user, secret string) bool {
+	if srv.Users == nil {
+		return true
+	}
+	expected, ok := srv.Users[user]
+	return ok && expected == secret
+}
+
+// authenticate runs an AUTH exchange, returning the user name and
+// whether the credentials were accepted.
+func (srv *Server) authenticate(text *textproto.Conn, mechanism, initial string) (string, bool) {
+	// challenge sends a 334 continuation and returns the decoded answer
+	challenge := func(message string) (string, bool) {
+		_ = text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(message)))
+		line, err := text.ReadLine()
+		if err != nil || line == "*" {
+			return "", false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		return string(decoded), err == nil
+	}
+	// response decodes the initial response, asking for it if the client did not send one
+	response := func() (string, bool) {
+		if initial == "" || initial == "=" {
+			return challenge("")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(initial)
+		return string(decoded), err == nil
+	}
+
+	switch mechanism {
+	case "PLAIN":
+		resp, ok := response()
+		parts := strings.Split(resp, "\x00")
+		if !ok || len(parts) != 3 {
+			return "", false
+		}
+		return parts[1], srv.checkSecret(parts[1], parts[2])
+	case "LOGIN":
+		user, ok := challenge("Username:")
+		if !ok {
+			return "", false
+		}
+		password, ok := challenge("Password:")
+		if !ok {
+			return "", false
+		}
+		return user, srv.checkSecret(user, password)
+	case "CRAM-MD5":
+		nonce := "<courier.test@localhost>"
+		resp, ok := challenge(nonce)
+		user, digest, found := strings.Cut(resp, " ")
+		if !ok || !found {
+			return "", false
+		}
+		if srv.Users == nil {
+			return user, true
+		}
+		mac := hmac.New(md5.New, []byte(srv.Users[user]))
+		mac.Write([]byte(nonce))
+		return user, hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(digest))
+	case "XOAUTH2":
+		resp, ok := response()
+		if !ok {
+			return "", false
+		}
+		var user, token string
+		for _, field := range strings.Split(resp, "\x01") {
+			if value, found := strings.CutPrefix(field, "user="); found {
+				user = value
+			}
+			if value, found := strings.CutPrefix(field, "auth=Bearer "); found {
+				token = value
+			}
+		}
+		if srv.checkSecret(user, token) {
+			return user, true
+		}
+		// explain the failure, then wait for the client's empty answer
+		_, _ = challenge(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`)
+		return user, false
+	}
+	return "", false
+}
@@ -0,0 +1,219 @@
+package couriertest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Attachment is a file attached to a captured message.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Inline      bool
+	Data        []byte
+}
+
+// Content is a captured message taken apart.
+type Content struct {
+	Header  mail.Header
+	Subject string
+	// Text and HTML are the decoded bodies of the text/plain and
+	// text/html parts that are not attachments.
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+var headerDecoder = &mime.WordDecoder{}
+
+// Parse takes the raw message data apart.
+func (m Message) Parse() (*Content, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(m.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	content := &Content{Header: msg.Header}
+	content.Subject, err = headerDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode subject: %w", err)
+	}
+
+	err = content.walk(msg.Header.Get, msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// walk collects the bodies and attachments of a part and its children.
+func (c *Content) walk(header func(string) string, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = c.walk(part.Header.Get, part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(header("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	switch {
+	case disposition == "attachment" || filename != "":
+		filename, _ = headerDecoder.DecodeHeader(filename)
+		c.Attachments = append(c.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Inline:      disposition == "inline",
+			Data:        data,
+		})
+	case mediaType == "text/html":
+		c.HTML += string(data)
+	case mediaType == "text/plain":
+		c.Text += string(data)
+	}
+	return nil
+}
+
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// Attachment returns the attachment with the given file name.
+func (c *Content) Attachment(filename string) (Attachment, bool) {
+	for _, attachment := range c.Attachments {
+		if attachment.Filename == filename {
+			return attachment, true
+		}
+	}
+	return Attachment{}, false
+}
+
+// MustParse is Parse, failing the test when the message cannot be read.
+func (m Message) MustParse(t testing.TB) *Content {
+	t.Helper()
+	content, err := m.Parse()
+	if err != nil {
+		t.Fatalf("unable to parse captured message: %v", err)
+	}
+	return content
+}
+
+// AssertSubject checks the decoded Subject header.
+func (m Message) AssertSubject(t testing.TB, subject string) {
+	t.Helper()
+	if got := m.MustParse(t).Subject; got != subject {
+		t.Errorf("expected subject %q, got %q", subject, got)
+	}
+}
+
+// AssertHeader checks the raw value of a header field.
+func (m Message) AssertHeader(t testing.TB, name, value string) {
+	t.Helper()
+	if got := m.MustParse(t).Header.Get(name); got != value {
+		t.Errorf("expected %s header %q, got %q", name, value, got)
+	}
+}
+
+// AssertNoHeader checks that a header field is absent.
+func (m Message) AssertNoHeader(t testing.TB, name string) {
+	t.Helper()
+	if _, ok := m.MustParse(t).Header[textproto.CanonicalMIMEHeaderKey(name)]; ok {
+		t.Errorf("expected no %s header", name)
+	}
+}
+
+// AssertFrom checks the envelope sender (MAIL FROM).
+func (m Message) AssertFrom(t testing.TB, from string) {
+	t.Helper()
+	if m.From != from {
+		t.Errorf("expected envelope sender %q, got %q", from, m.From)
+	}
+}
+
+// AssertRecipients checks the envelope recipients (RCPT TO), in any order.
+func (m Message) AssertRecipients(t testing.TB, recipients ...string) {
+	t.Helper()
+	want := append([]string(nil), recipients...)
+	got := append([]string(nil), m.To...)
+	sort.Strings(want)
+	sort.Strings(got)
+	if strings.Join(want, ",") != strings.Join(got, ",") {
+		t.Errorf("expected recipients %v, got %v", want, got)
+	}
+}
+
+// AssertTextContains checks the text/plain body.
+func (m Message) AssertTextContains(t testing.TB, text string) {
+	t.Helper()
+	if got := m.MustParse(t).Text; !strings.Contains(got, text) {
+		t.Errorf("expected text body to contain %q, got %q", text, got)
+	}
+}
+
+// AssertHTMLContains checks the text/html body.
+func (m Message) AssertHTMLContains(t testing.TB, html string) {
+	t.Helper()
+	if got := m.MustParse(t).HTML; !strings.Contains(got, html) {
+		t.Errorf("expected html body to contain %q, got %q", html, got)
+	}
+}
+
+// AssertAttachment checks that a file is attached and, when data is
+// not nil, that it has that content. It returns the attachment.
+func (m Message) AssertAttachment(t testing.TB, filename string, data []byte) Attachment {
+	t.Helper()
+	content := m.MustParse(t)
+	attachment, ok := content.Attachment(filename)
+	if !ok {
+		names := make([]string, len(content.Attachments))
+		for i, a := range content.Attachments {
+			names[i] = a.Filename
+		}
+		t.Errorf("expected attachment %q, found %v", filename, names)
+		return attachment
+	}
+	if data != nil && !bytes.Equal(attachment.Data, data) {
+		t.Errorf("attachment %q does not have the expected content", filename)
+	}
+	return attachment
+}
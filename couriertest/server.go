@@ -0,0 +1,629 @@
+// Package couriertest provides an in-process smtp server for testing
+// code that sends mail.
+//
+// The server listens on a random localhost port, records every mail
+// transaction it receives and can be told to misbehave at any stage of
+// the conversation:
+//
+//	srv := couriertest.NewServer(t, func(srv *couriertest.Server) {
+//		srv.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Recipient: "bob@email.com", Reply: "550 5.1.1 User unknown"})
+//	})
+//	courier := guild.NewCourier(srv.Host(), srv.Port(), "", "")
+//	...
+//	msg := srv.WaitForMessages(t, 1)[0]
+//	msg.AssertSubject(t, "Hello")
+//
+// With the LMTP option set it speaks LMTP instead, optionally on a
+// Unix socket.
+package couriertest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Stage is a point in the smtp conversation at which a Fault can fire.
+type Stage int
+
+const (
+	// StageGreeting is the 220 banner sent when a client connects.
+	StageGreeting Stage = iota
+	StageHello
+	StageStartTLS
+	StageAuth
+	StageMail
+	StageRcpt
+	// StageData is the reply to the DATA command itself.
+	StageData
+	// StageMessage is the reply once the message content has been sent.
+	StageMessage
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageGreeting:
+		return "greeting"
+	case StageHello:
+		return "hello"
+	case StageStartTLS:
+		return "starttls"
+	case StageAuth:
+		return "auth"
+	case StageMail:
+		return "mail"
+	case StageRcpt:
+		return "rcpt"
+	case StageData:
+		return "data"
+	case StageMessage:
+		return "message"
+	}
+	return "unknown"
+}
+
+// Fault changes how the server answers at a given stage.
+type Fault struct {
+	Stage Stage
+	// Recipient limits a StageRcpt fault, or a StageMessage fault on an
+	// LMTP server, to a single address.
+	Recipient string
+	// Reply replaces the normal reply, e.g. "451 4.3.0 Try again later".
+	// When empty the normal reply is sent, after any Delay.
+	Reply string
+	// Delay holds back the reply.
+	Delay time.Duration
+	// Drop hangs up instead of replying.
+	Drop bool
+	// Times limits how often the fault fires. Zero means every time.
+	Times int
+
+	fired int
+}
+
+// Message is a single mail transaction received by the Server.
+type Message struct {
+	From string
+	// To lists the envelope recipients; for LMTP, only those the
+	// message was delivered to.
+	To []string
+	// Data is the raw message content, with CRLF line endings.
+	Data string
+	// TLS reports whether the transaction happened over an encrypted connection.
+	TLS bool
+	// SMTPUTF8 reports whether MAIL FROM asked for SMTPUTF8.
+	SMTPUTF8 bool
+	// User is the name the client authenticated as, if it did, and
+	// AuthMechanism the mechanism it used.
+	User          string
+	AuthMechanism string
+}
+
+// Server is an smtp server that captures everything sent to it.
+// The exported options must be set before the server starts, which
+// is what the configure function given to NewServer is for.
+type Server struct {
+	// OfferStartTLS advertises and accepts STARTTLS.
+	OfferStartTLS bool
+	// ImplicitTLS makes the listener speak TLS from the first byte.
+	ImplicitTLS bool
+	// OfferAuth advertises AUTH with the AuthMechanisms.
+	OfferAuth bool
+	// OfferSMTPUTF8 advertises SMTPUTF8, for internationalized addresses.
+	OfferSMTPUTF8 bool
+	// AuthMechanisms lists the mechanisms offered, out of PLAIN, LOGIN,
+	// CRAM-MD5 and XOAUTH2. It defaults to PLAIN.
+	AuthMechanisms []string
+	// Users maps user names to passwords, or to access tokens for
+	// XOAUTH2. When nil any credentials are accepted.
+	Users map[string]string
+
+	// ClientTLS trusts the server's self signed certificate.
+	ClientTLS *tls.Config
+
+	// LMTP speaks LMTP: LHLO replaces EHLO and the message data is
+	// answered once for each recipient.
+	LMTP bool
+	// UnixSocket listens on a Unix socket instead of a TCP port; Addr
+	// returns its path.
+	UnixSocket bool
+
+	listener  net.Listener
+	serverTLS *tls.Config
+	certDER   []byte
+
+	mu          sync.Mutex
+	faults      []*Fault
+	messages    []Message
+	conns       map[net.Conn]struct{}
+	connections int
+	closed      bool
+	arrived     chan struct{}
+	// handlers counts the accept loop and every connection handler
+	handlers sync.WaitGroup
+}
+
+// NewServer starts a Server on a random localhost port and closes it
+// when the test ends. The configure function, when given, can set the
+// server options before it starts accepting connections.
+func NewServer(t testing.TB, configure func(*Server)) *Server {
+	t.Helper()
+
+	srv := &Server{
+		conns:   map[net.Conn]struct{}{},
+		arrived: make(chan struct{}, 1),
+	}
+	if configure != nil {
+		configure(srv)
+	}
+
+	cert, pool, err := newCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.certDER = cert.Certificate[0]
+	srv.serverTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.ClientTLS = &tls.Config{RootCAs: pool}
+
+	if srv.UnixSocket {
+		// t.TempDir can be too long a path for a socket
+		var dir string
+		dir, err = os.MkdirTemp("", "couriertest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = os.RemoveAll(dir) })
+		srv.listener, err = net.Listen("unix", filepath.Join(dir, "lmtp.sock"))
+	} else if srv.ImplicitTLS {
+		srv.listener, err = tls.Listen("tcp", "127.0.0.1:0", srv.serverTLS)
+	} else {
+		srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	srv.handlers.Add(1)
+	go srv.serve()
+
+	return srv
+}
+
+// newCertificate creates a self signed certificate for localhost.
+func newCertificate() (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "courier test"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool, nil
+}
+
+// Host returns the address the server listens on.
+func (srv *Server) Host() string {
+	host, _, _ := net.SplitHostPort(srv.listener.Addr().String())
+	return host
+}
+
+// Port returns the port the server listens on.
+func (srv *Server) Port() int {
+	_, port, _ := net.SplitHostPort(srv.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// CertificatePEM returns the server's self signed certificate, for use
+// as a CA file by clients that cannot be given ClientTLS.
+func (srv *Server) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.certDER})
+}
+
+// Addr returns the host:port the server listens on, or the path of
+// its Unix socket.
+func (srv *Server) Addr() string {
+	return srv.listener.Addr().String()
+}
+
+// AddFault makes the server misbehave. Faults may be added while the
+// server is running; the first matching fault with firings left wins.
+func (srv *Server) AddFault(fault Fault) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.faults = append(srv.faults, &fault)
+}
+
+// ClearFaults makes the server behave again.
+func (srv *Server) ClearFaults() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.faults = nil
+}
+
+// fault returns the fault to apply at stage, if any.
+func (srv *Server) fault(stage Stage, recipient string) *Fault {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, f := range srv.faults {
+		if f.Stage != stage || (f.Times > 0 && f.fired >= f.Times) {
+			continue
+		}
+		if f.Recipient != "" && !strings.EqualFold(f.Recipient, recipient) {
+			continue
+		}
+		f.fired++
+		found := *f
+		return &found
+	}
+	return nil
+}
+
+// Messages returns the messages received so far.
+func (srv *Server) Messages() []Message {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]Message(nil), srv.messages...)
+}
+
+// Reset forgets the messages received so far.
+func (srv *Server) Reset() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.messages = nil
+}
+
+// WaitForMessages waits up to five seconds for at least n messages to
+// arrive, failing the test if they do not, and returns them.
+func (srv *Server) WaitForMessages(t testing.TB, n int) []Message {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		messages := srv.Messages()
+		if len(messages) >= n {
+			return messages
+		}
+		select {
+		case <-srv.arrived:
+		case <-timeout:
+			t.Fatalf("expected %d message(s), received %d", n, len(messages))
+			return nil
+		}
+	}
+}
+
+// Connections returns the number of connections accepted so far.
+func (srv *Server) Connections() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.connections
+}
+
+// DropConnections hangs up on every connected client.
+func (srv *Server) DropConnections() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+}
+
+// Close stops the server from accepting connections, hangs up on every
+// client and waits for their handlers to finish, sleeping out any fault
+// Delay. Nothing is listening on its port afterwards.
+func (srv *Server) Close() {
+	_ = srv.listener.Close()
+	srv.mu.Lock()
+	srv.closed = true
+	srv.mu.Unlock()
+	srv.DropConnections()
+	srv.handlers.Wait()
+}
+
+func (srv *Server) serve() {
+	defer srv.handlers.Done()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.handlers.Add(1)
+		go func() {
+			defer srv.handlers.Done()
+			srv.handle(conn)
+		}()
+	}
+}
+
+func (srv *Server) receive(msg Message) {
+	srv.mu.Lock()
+	srv.messages = append(srv.messages, msg)
+	srv.mu.Unlock()
+
+	select {
+	case srv.arrived <- struct{}{}:
+	default:
+	}
+}
+
+// apply sleeps out and reports the fault at stage, if there is one. It
+// returns the reply to send in place of the normal one, which may be
+// empty, and whether the connection should be dropped instead.
+func (srv *Server) apply(stage Stage, recipient string) (string, bool) {
+	fault := srv.fault(stage, recipient)
+	if fault == nil {
+		return "", false
+	}
+	time.Sleep(fault.Delay)
+	return fault.Reply, fault.Drop
+}
+
+// positive reports whether a reply line lets the conversation continue.
+func positive(reply string) bool {
+	return strings.HasPrefix(reply, "2") || strings.HasPrefix(reply, "3")
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	raw := conn
+
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	srv.conns[raw] = struct{}{}
+	srv.connections++
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, raw)
+		srv.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	_, isTLS := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	respond := func(lines ...string) {
+		for _, line := range lines {
+			_ = text.PrintfLine("%s", line)
+		}
+	}
+
+	if override, drop := srv.apply(StageGreeting, ""); drop {
+		return
+	} else if override != "" {
+		respond(override)
+		if !positive(override) {
+			return
+		}
+	} else {
+		respond("220 localhost ESMTP courier test")
+	}
+
+	var current Message
+	var user, authMechanism string
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO", "LHLO":
+			if (strings.ToUpper(verb) == "LHLO") != srv.LMTP {
+				respond("500 5.5.1 Command unrecognized")
+				continue
+			}
+			override, drop := srv.apply(StageHello, "")
+			if drop {
+				return
+			}
+			if override != "" {
+				respond(override)
+				continue
+			}
+			lines := []string{"250-localhost"}
+			if srv.OfferStartTLS && !isTLS {
+				lines = append(lines, "250-STARTTLS")
+			}
+			if srv.OfferAuth {
+				lines = append(lines, "250-AUTH "+strings.Join(srv.mechanisms(), " "))
+			}
+			if srv.OfferSMTPUTF8 {
+				lines = append(lines, "250-SMTPUTF8")
+			}
+			respond(append(lines, "250 OK")...)
+		case "STARTTLS":
+			if !srv.OfferStartTLS || isTLS {
+				respond("502 STARTTLS not available")
+				continue
+			}
+			override, drop := srv.apply(StageStartTLS, "")
+			if drop {
+				return
+			}
+			if override != "" && !positive(override) {
+				respond(override)
+				continue
+			}
+			respond("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, srv.serverTLS)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			isTLS = true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			override, drop := srv.apply(StageAuth, "")
+			if drop {
+				return
+			}
+			if override != "" && !positive(override) {
+				respond(override)
+				continue
+			}
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			mechanism = strings.ToUpper(mechanism)
+			if !srv.OfferAuth || !srv.offers(mechanism) {
+				respond("504 5.5.4 Unrecognized authentication type")
+				continue
+			}
+			name, ok := srv.authenticate(text, mechanism, initial)
+			if !ok {
+				respond("535 5.7.8 Authentication credentials invalid")
+				continue
+			}
+			user, authMechanism = name, mechanism
+			respond("235 2.7.0 Authentication successful")
+		case "MAIL":
+			override, drop := srv.apply(StageMail, "")
+			if drop {
+				return
+			}
+			if override != "" && !positive(override) {
+				respond(override)
+				continue
+			}
+			current = Message{From: addressArg(arg), TLS: isTLS, User: user, AuthMechanism: authMechanism}
+			current.SMTPUTF8 = strings.Contains(strings.ToUpper(arg), " SMTPUTF8")
+			respond("250 OK")
+		case "RCPT":
+			recipient := addressArg(arg)
+			override, drop := srv.apply(StageRcpt, recipient)
+			if drop {
+				return
+			}
+			if override != "" && !positive(override) {
+				respond(override)
+				continue
+			}
+			current.To = append(current.To, recipient)
+			respond("250 OK")
+		case "DATA":
+			if len(current.To) == 0 {
+				respond("503 5.5.1 No valid recipients")
+				continue
+			}
+			override, drop := srv.apply(StageData, "")
+			if drop {
+				return
+			}
+			if override != "" && !positive(override) {
+				respond(override)
+				continue
+			}
+			respond("354 Go ahead")
+			lines, err := text.ReadDotLines()
+			if err != nil {
+				return
+			}
+			data := strings.Join(lines, "\r\n") + "\r\n"
+			if srv.LMTP {
+				if !srv.deliver(current, data, respond) {
+					return
+				}
+				current = Message{}
+				continue
+			}
+			override, drop = srv.apply(StageMessage, "")
+			if drop {
+				return
+			}
+			if override != "" && !positive(override) {
+				respond(override)
+				current = Message{}
+				continue
+			}
+			current.Data = data
+			srv.receive(current)
+			current = Message{}
+			respond("250 OK queued")
+		case "RSET":
+			current = Message{}
+			respond("250 OK")
+		case "NOOP":
+			respond("250 OK")
+		case "QUIT":
+			respond("221 Bye")
+			return
+		default:
+			respond("502 Command not implemented")
+		}
+	}
+}
+
+// deliver answers LMTP message data with a reply for each recipient,
+// keeping the message for those it was delivered to. It returns false
+// when the connection should be dropped.
+func (srv *Server) deliver(msg Message, data string, respond func(...string)) bool {
+	var delivered []string
+	for _, recipient := range msg.To {
+		override, drop := srv.apply(StageMessage, recipient)
+		if drop {
+			return false
+		}
+		if override != "" && !positive(override) {
+			respond(override)
+			continue
+		}
+		delivered = append(delivered, recipient)
+		respond("250 2.1.5 <" + recipient + "> delivered")
+	}
+	if len(delivered) > 0 {
+		msg.To = delivered
+		msg.Data = data
+		srv.receive(msg)
+	}
+	return true
+}
+
+// addressArg extracts the address from a "FROM:<addr> ..." or "TO:<addr>" argument.
+func addressArg(arg string) string {
+	start := strings.Index(arg, "<")
+	end := strings.Index(arg, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return arg[start+1 : end]
+}
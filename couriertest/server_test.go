@@ -0,0 +1,153 @@
+package couriertest_test
+
+import (
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/markgemmill/courier/guild"
+	"github.com/stretchr/testify/assert"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func CreateTestMessage(t *testing.T) *smail.Email {
+	attachment := filepath.Join(t.TempDir(), "report.txt")
+	err := os.WriteFile(attachment, []byte("quarterly numbers"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope := guild.NewEnvelope()
+	envelope.SetFromAddress("sender@email.com")
+	envelope.AddToAddress("receiver@email.com")
+	envelope.AddBccAddress("hidden@email.com")
+
+	msg := guild.NewMessage()
+	msg.SetSubject("Capture Test ✓")
+	msg.SetHtmlBody("<p>This is the html body.</p>")
+	msg.SetTextBody("This is the text body.")
+	msg.AddAttachment(attachment, "report.txt")
+	msg.Seal(envelope)
+	return msg.Message()
+}
+
+func CreateTestCourier(srv *couriertest.Server) *guild.Courier {
+	return guild.NewCourier(srv.Host(), srv.Port(), "", "")
+}
+
+func TestServer_Capture(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	_, err := CreateTestCourier(srv).Deliver(CreateTestMessage(t))
+	tst.Nil(err)
+
+	messages := srv.WaitForMessages(t, 1)
+	tst.Len(messages, 1)
+
+	msg := messages[0]
+	msg.AssertFrom(t, "sender@email.com")
+	msg.AssertRecipients(t, "hidden@email.com", "receiver@email.com")
+	msg.AssertSubject(t, "Capture Test ✓")
+	msg.AssertHeader(t, "To", "<receiver@email.com>")
+	msg.AssertNoHeader(t, "Bcc")
+	msg.AssertTextContains(t, "This is the text body.")
+	msg.AssertHTMLContains(t, "<p>This is the html body.</p>")
+	attachment := msg.AssertAttachment(t, "report.txt", []byte("quarterly numbers"))
+	tst.Equal("text/plain", attachment.ContentType)
+	tst.False(msg.TLS)
+
+	srv.Reset()
+	tst.Len(srv.Messages(), 0)
+}
+
+func TestServer_RejectAtStage(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageMessage, Reply: "554 5.6.0 Message rejected", Times: 1})
+	})
+	courier := CreateTestCourier(srv)
+
+	_, err := courier.Deliver(CreateTestMessage(t))
+	var smtpErr *guild.SMTPError
+	tst.ErrorAs(err, &smtpErr)
+	tst.Equal(554, smtpErr.Code)
+	tst.Len(srv.Messages(), 0)
+
+	// the fault only fires once
+	_, err = courier.Deliver(CreateTestMessage(t))
+	tst.Nil(err)
+	tst.Len(srv.Messages(), 1)
+}
+
+func TestServer_DropAndDelay(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageGreeting, Drop: true, Times: 1})
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Delay: 200 * time.Millisecond})
+	})
+	courier := CreateTestCourier(srv)
+
+	_, err := courier.Deliver(CreateTestMessage(t))
+	tst.NotNil(err)
+	tst.True(guild.IsTransient(err))
+
+	started := time.Now()
+	_, err = courier.Deliver(CreateTestMessage(t))
+	tst.Nil(err)
+	tst.GreaterOrEqual(time.Since(started), 200*time.Millisecond)
+	tst.Equal(2, srv.Connections())
+
+	srv.ClearFaults()
+	srv.Close()
+	_, err = courier.Deliver(CreateTestMessage(t))
+	tst.NotNil(err)
+}
+
+func TestServer_DataWithoutRecipients(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	conn, err := textproto.Dial("tcp", srv.Addr())
+	tst.Nil(err)
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	_, _, err = conn.ReadResponse(220)
+	tst.Nil(err)
+	for _, cmd := range []string{"HELO localhost", "MAIL FROM:<sender@email.com>"} {
+		tst.Nil(conn.PrintfLine("%s", cmd))
+		_, _, err = conn.ReadResponse(250)
+		tst.Nil(err)
+	}
+	tst.Nil(conn.PrintfLine("DATA"))
+	code, message, err := conn.ReadResponse(354)
+	tst.NotNil(err)
+	tst.Equal(503, code)
+	tst.Equal("5.5.1 No valid recipients", message)
+}
+
+func TestServer_CloseWaitsForHandlers(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageGreeting, Delay: 200 * time.Millisecond})
+	})
+	conn, err := net.Dial("tcp", srv.Addr())
+	tst.Nil(err)
+	defer func() {
+		_ = conn.Close()
+	}()
+	// let the handler start sleeping out the delay
+	time.Sleep(50 * time.Millisecond)
+
+	started := time.Now()
+	srv.Close()
+	tst.GreaterOrEqual(time.Since(started), 100*time.Millisecond)
+}
@@ -1,26 +1,29 @@
 module github.com/markgemmill/courier
 
-go 1.20
+go 1.21
+
+require (
+	github.com/AfterShip/email-verifier v1.3.3
+	github.com/alecthomas/kong v0.7.1
+	github.com/deckarep/golang-set/v2 v2.3.0
+	github.com/dimuska139/go-email-normalizer v1.2.0
+	github.com/flosch/pongo2/v6 v6.0.0
+	github.com/stretchr/testify v1.8.2
+	github.com/toorop/go-dkim v0.0.0-20201103131630-e1cd1a0a5208
+	github.com/vanng822/go-premailer v1.20.2
+	github.com/xhit/go-simple-mail/v2 v2.13.0
+	golang.org/x/net v0.7.0
+)
 
 require (
-	github.com/AfterShip/email-verifier v1.3.3 // indirect
 	github.com/PuerkitoBio/goquery v1.5.1 // indirect
-	github.com/alecthomas/kong v0.7.1 // indirect
 	github.com/andybalholm/cascadia v1.1.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/deckarep/golang-set/v2 v2.3.0 // indirect
-	github.com/dimuska139/go-email-normalizer v1.2.0 // indirect
-	github.com/flosch/pongo2/v6 v6.0.0 // indirect
 	github.com/gorilla/css v1.0.0 // indirect
 	github.com/hbollon/go-edlib v1.6.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.2 // indirect
-	github.com/toorop/go-dkim v0.0.0-20201103131630-e1cd1a0a5208 // indirect
 	github.com/vanng822/css v1.0.1 // indirect
-	github.com/vanng822/go-premailer v1.20.2 // indirect
-	github.com/xhit/go-simple-mail/v2 v2.13.0 // indirect
-	golang.org/x/net v0.7.0 // indirect
 	golang.org/x/text v0.7.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
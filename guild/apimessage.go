@@ -0,0 +1,225 @@
+package guild
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// APIAttachment is a file attached to an APIMessage.
+type APIAttachment struct {
+	Filename    string
+	ContentType string
+	// Inline attachments are referred to from the HTML body by ContentID.
+	Inline    bool
+	ContentID string
+	Content   []byte
+}
+
+// APIMessage is a rendered message taken apart into the fields that
+// HTTP email APIs ask for, as they want the pieces rather than MIME.
+type APIMessage struct {
+	// EnvelopeFrom and Recipients are the smtp envelope of the parcel.
+	EnvelopeFrom string
+	Recipients   []string
+
+	// To and Cc are the addresses of those headers that are also
+	// envelope recipients, so that a parcel for only some of the
+	// recipients, as VERP sends, is not posted to all of them.
+	From *mail.Address
+	To   []*mail.Address
+	Cc   []*mail.Address
+	// Bcc holds the envelope recipients that are not in To or Cc.
+	Bcc     []*mail.Address
+	ReplyTo []*mail.Address
+	Subject string
+	Text    string
+	HTML    string
+	// Headers holds any other headers worth passing on, such as
+	// X-Priority or List-Unsubscribe.
+	Headers     map[string]string
+	Attachments []APIAttachment
+	// Raw is the complete message, for APIs that accept MIME as is.
+	Raw string
+}
+
+// apiManagedHeaders are the headers an APIMessage has fields for, or
+// that providers set themselves.
+var apiManagedHeaders = map[string]bool{
+	"From":                      true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	"Dkim-Signature":            true,
+}
+
+var apiHeaderDecoder = &mime.WordDecoder{}
+
+// NewAPIMessage takes the parcel's message apart.
+func NewAPIMessage(parcel *Parcel) (*APIMessage, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(parcel.Data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read message: %w", err)
+	}
+
+	am := &APIMessage{
+		EnvelopeFrom: parcel.From,
+		Recipients:   parcel.Recipients,
+		Headers:      map[string]string{},
+		Raw:          parcel.Data,
+	}
+
+	from, err := apiAddresses(msg.Header, "From")
+	if err != nil {
+		return nil, err
+	}
+	if len(from) > 0 {
+		am.From = from[0]
+	} else {
+		am.From = &mail.Address{Address: parcel.From}
+	}
+	for name, target := range map[string]*[]*mail.Address{"To": &am.To, "Cc": &am.Cc, "Reply-To": &am.ReplyTo} {
+		*target, err = apiAddresses(msg.Header, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	envelope := map[string]bool{}
+	for _, recipient := range parcel.Recipients {
+		envelope[recipientKey(recipient)] = true
+	}
+	am.To = envelopeAddresses(am.To, envelope)
+	am.Cc = envelopeAddresses(am.Cc, envelope)
+
+	visible := map[string]bool{}
+	for _, address := range append(append([]*mail.Address(nil), am.To...), am.Cc...) {
+		visible[recipientKey(address.Address)] = true
+	}
+	for _, recipient := range parcel.Recipients {
+		if !visible[recipientKey(recipient)] {
+			am.Bcc = append(am.Bcc, &mail.Address{Address: recipient})
+		}
+	}
+
+	am.Subject, err = apiHeaderDecoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode subject: %w", err)
+	}
+
+	for name, values := range msg.Header {
+		if !apiManagedHeaders[textproto.CanonicalMIMEHeaderKey(name)] && len(values) > 0 {
+			am.Headers[name], _ = apiHeaderDecoder.DecodeHeader(values[0])
+		}
+	}
+
+	err = am.walk(msg.Header.Get, msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read message body: %w", err)
+	}
+	return am, nil
+}
+
+// recipientKey compares addresses whatever their case, and whether the
+// domain is given in Unicode or in punycode.
+func recipientKey(address string) string {
+	if ascii, err := asciiAddress(address); err == nil {
+		address = ascii
+	}
+	return strings.ToLower(address)
+}
+
+// envelopeAddresses keeps the addresses that are envelope recipients.
+func envelopeAddresses(addresses []*mail.Address, envelope map[string]bool) []*mail.Address {
+	var kept []*mail.Address
+	for _, address := range addresses {
+		if envelope[recipientKey(address.Address)] {
+			kept = append(kept, address)
+		}
+	}
+	return kept
+}
+
+func apiAddresses(header mail.Header, name string) ([]*mail.Address, error) {
+	if header.Get(name) == "" {
+		return nil, nil
+	}
+	addresses, err := header.AddressList(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s header: %w", name, err)
+	}
+	return addresses, nil
+}
+
+// walk collects the bodies and attachments of a part and its children.
+func (am *APIMessage) walk(header func(string) string, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = am.walk(part.Header.Get, part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var decoded io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(header("Content-Transfer-Encoding"))) {
+	case "base64":
+		decoded = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		decoded = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(decoded)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	switch {
+	case disposition == "attachment" || filename != "":
+		filename, _ = apiHeaderDecoder.DecodeHeader(filename)
+		am.Attachments = append(am.Attachments, APIAttachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Inline:      disposition == "inline",
+			ContentID:   strings.Trim(header("Content-Id"), "<>"),
+			Content:     data,
+		})
+	case mediaType == "text/html":
+		am.HTML += string(data)
+	case mediaType == "text/plain":
+		am.Text += string(data)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrAuthNotSupported is returned when the server does not advertise
+// the AuthMechanism the Courier was told to use.
+var ErrAuthNotSupported = errors.New("server does not support the authentication mechanism")
+
+// AuthMechanism selects how the Courier authenticates.
+type AuthMechanism int
+
+const (
+	// AuthAuto authenticates with PLAIN when the server asks for
+	// authentication and credentials have been given.
+	AuthAuto AuthMechanism = iota
+	AuthPlain
+	AuthLogin
+	AuthCRAMMD5
+	// AuthXOAUTH2 authenticates with an OAuth 2.0 bearer token taken
+	// from the Courier's TokenSource.
+	AuthXOAUTH2
+)
+
+var authMechanismNames = map[AuthMechanism]string{
+	AuthAuto:    "auto",
+	AuthPlain:   "plain",
+	AuthLogin:   "login",
+	AuthCRAMMD5: "cram-md5",
+	AuthXOAUTH2: "xoauth2",
+}
+
+func (m AuthMechanism) String() string {
+	if name, ok := authMechanismNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("AuthMechanism(%d)", int(m))
+}
+
+// ParseAuthMechanism converts one of "auto", "plain", "login",
+// "cram-md5" or "xoauth2" into an AuthMechanism. An empty string
+// is treated as "auto".
+func ParseAuthMechanism(name string) (AuthMechanism, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return AuthAuto, nil
+	}
+	for mechanism, mechanismName := range authMechanismNames {
+		if mechanismName == name {
+			return mechanism, nil
+		}
+	}
+	return AuthAuto, fmt.Errorf("'%s' is not a valid authentication mechanism", name)
+}
+
+// Token is an OAuth 2.0 access token.
+type Token struct {
+	AccessToken string
+	// Expiry is when the token stops working. Zero means it does not expire.
+	Expiry time.Time
+}
+
+// TokenSource supplies the access token used for XOAUTH2. It is asked
+// for a token every time a connection is authenticated.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+type staticTokenSource struct {
+	token *Token
+}
+
+func (ts *staticTokenSource) Token(ctx context.Context) (*Token, error) {
+	return ts.token, nil
+}
+
+// StaticTokenSource always returns the same access token.
+func StaticTokenSource(accessToken string) TokenSource {
+	return &staticTokenSource{token: &Token{AccessToken: accessToken}}
+}
+
+// TokenFetcher obtains a fresh token, typically by redeeming a refresh token.
+type TokenFetcher func(ctx context.Context) (*Token, error)
+
+// RefreshingTokenSource caches the token returned by a TokenFetcher and
+// fetches a new one shortly before it expires.
+type RefreshingTokenSource struct {
+	fetch TokenFetcher
+	// early is how long before expiry a token is replaced.
+	early time.Duration
+	now   func() time.Time
+
+	mu    sync.Mutex
+	token *Token
+}
+
+func NewRefreshingTokenSource(fetch TokenFetcher) *RefreshingTokenSource {
+	return &RefreshingTokenSource{
+		fetch: fetch,
+		early: time.Minute,
+		now:   time.Now,
+	}
+}
+
+// Token returns the cached token, refreshing it when needed.
+func (ts *RefreshingTokenSource) Token(ctx context.Context) (*Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != nil && (ts.token.Expiry.IsZero() || ts.now().Add(ts.early).Before(ts.token.Expiry)) {
+		return ts.token, nil
+	}
+
+	token, err := ts.fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to refresh access token: %w", err)
+	}
+	ts.token = token
+	return token, nil
+}
+
+// Invalidate drops the cached token so that the next call to Token
+// fetches a new one, e.g. after the server refused it.
+func (ts *RefreshingTokenSource) Invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.token = nil
+}
+
+// plainAuth implements the PLAIN authentication mechanism. Unlike
+// smtp.PlainAuth it does not refuse to authenticate over an unencrypted
+// connection; it is up to the caller to choose an Encryption that
+// protects the credentials.
+type plainAuth struct {
+	identity string
+	username string
+	password string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
+	return "PLAIN", resp, nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, fmt.Errorf("unexpected server challenge during PLAIN authentication")
+	}
+	return nil, nil
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which sends
+// the user name and password in answer to two server challenges.
+type loginAuth struct {
+	username string
+	password string
+	step     int
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	a.step = 0
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	a.step++
+	switch a.step {
+	case 1:
+		return []byte(a.username), nil
+	case 2:
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge during LOGIN authentication: %s", fromServer)
+}
+
+// xoauth2Auth implements the XOAUTH2 mechanism used by Google and Microsoft.
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", resp, nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server explains a failure in a challenge that must be
+		// answered with an empty line before it sends the final reply
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// authMechanismNameOnWire is how each mechanism appears in the AUTH extension.
+var authMechanismNameOnWire = map[AuthMechanism]string{
+	AuthPlain:   "PLAIN",
+	AuthLogin:   "LOGIN",
+	AuthCRAMMD5: "CRAM-MD5",
+	AuthXOAUTH2: "XOAUTH2",
+}
+
+// offersMechanism reports whether the AUTH extension parameters
+// advertise the named mechanism.
+func offersMechanism(offered, name string) bool {
+	for _, mechanism := range strings.Fields(offered) {
+		if strings.EqualFold(mechanism, name) {
+			return true
+		}
+	}
+	return false
+}
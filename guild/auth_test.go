@@ -0,0 +1,159 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func startAuthServer(t *testing.T, mechanisms ...string) *couriertest.Server {
+	return couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.OfferAuth = true
+		srv.AuthMechanisms = mechanisms
+		srv.Users = map[string]string{"courier": "seekrit", "me@email.com": "fresh-token"}
+	})
+}
+
+func TestCourier_AuthMechanisms(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := startAuthServer(t, "PLAIN", "LOGIN", "CRAM-MD5")
+
+	for _, mechanism := range []AuthMechanism{AuthPlain, AuthLogin, AuthCRAMMD5} {
+		srv.Reset()
+
+		courier := NewCourier(srv.Host(), srv.Port(), "courier", "seekrit")
+		courier.SetAuthMechanism(mechanism)
+
+		_, err := courier.Deliver(CreateTestMessage())
+		tst.Nil(err, mechanism)
+
+		messages := srv.Messages()
+		tst.Len(messages, 1)
+		tst.Equal("courier", messages[0].User)
+		tst.Equal(authMechanismNameOnWire[mechanism], messages[0].AuthMechanism)
+	}
+}
+
+func TestCourier_AuthWrongPassword(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := startAuthServer(t, "LOGIN")
+	courier := NewCourier(srv.Host(), srv.Port(), "courier", "guess")
+	courier.SetAuthMechanism(AuthLogin)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "LOGIN authentication failed")
+
+	var smtpErr *SMTPError
+	tst.True(errors.As(err, &smtpErr))
+	tst.Equal(535, smtpErr.Code)
+	tst.Len(srv.Messages(), 0)
+}
+
+func TestCourier_AuthMechanismNotAdvertised(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := startAuthServer(t, "PLAIN", "LOGIN")
+	courier := NewCourier(srv.Host(), srv.Port(), "courier", "seekrit")
+	courier.SetAuthMechanism(AuthCRAMMD5)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.ErrorIs(err, ErrAuthNotSupported)
+	tst.ErrorContains(err, "CRAM-MD5 (offered: PLAIN LOGIN)")
+
+	// a server that does not offer AUTH at all
+	plain := couriertest.NewServer(t, nil)
+	courier = NewCourier(plain.Host(), plain.Port(), "courier", "seekrit")
+	courier.SetAuthMechanism(AuthPlain)
+
+	_, err = courier.Deliver(CreateTestMessage())
+	tst.ErrorIs(err, ErrAuthNotSupported)
+	tst.ErrorContains(err, "PLAIN (offered: none)")
+}
+
+func TestCourier_AuthXOAUTH2(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := startAuthServer(t, "XOAUTH2")
+
+	tokens := []string{"revoked-token", "fresh-token"}
+	fetches := 0
+	source := NewRefreshingTokenSource(func(ctx context.Context) (*Token, error) {
+		token := &Token{AccessToken: tokens[fetches], Expiry: time.Now().Add(time.Hour)}
+		fetches++
+		return token, nil
+	})
+
+	courier := NewCourier(srv.Host(), srv.Port(), "me@email.com", "")
+	courier.SetAuthMechanism(AuthXOAUTH2)
+	courier.SetTokenSource(source)
+
+	// the refused token is dropped so the next attempt fetches a new one
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "XOAUTH2 authentication failed")
+
+	_, err = courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	_, err = courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.Equal(2, fetches)
+
+	messages := srv.Messages()
+	tst.Len(messages, 2)
+	tst.Equal("me@email.com", messages[0].User)
+	tst.Equal("XOAUTH2", messages[0].AuthMechanism)
+
+	courier.SetTokenSource(nil)
+	_, err = courier.Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "XOAUTH2 authentication requires a token source")
+}
+
+func TestRefreshingTokenSource_RefreshesBeforeExpiry(t *testing.T) {
+	tst := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	fetches := 0
+	source := NewRefreshingTokenSource(func(ctx context.Context) (*Token, error) {
+		fetches++
+		return &Token{AccessToken: "token", Expiry: now.Add(10 * time.Minute)}, nil
+	})
+	source.now = func() time.Time { return now }
+
+	_, err := source.Token(context.Background())
+	tst.Nil(err)
+	_, err = source.Token(context.Background())
+	tst.Nil(err)
+	tst.Equal(1, fetches)
+
+	// within a minute of expiry the token is replaced
+	now = now.Add(9*time.Minute + 30*time.Second)
+	_, err = source.Token(context.Background())
+	tst.Nil(err)
+	tst.Equal(2, fetches)
+
+	failing := NewRefreshingTokenSource(func(ctx context.Context) (*Token, error) {
+		return nil, errors.New("invalid_grant")
+	})
+	_, err = failing.Token(context.Background())
+	tst.ErrorContains(err, "unable to refresh access token: invalid_grant")
+}
+
+func TestParseAuthMechanism(t *testing.T) {
+	tst := assert.New(t)
+
+	mechanism, err := ParseAuthMechanism("")
+	tst.Nil(err)
+	tst.Equal(AuthAuto, mechanism)
+
+	mechanism, err = ParseAuthMechanism("CRAM-MD5")
+	tst.Nil(err)
+	tst.Equal(AuthCRAMMD5, mechanism)
+	tst.Equal("cram-md5", mechanism.String())
+
+	_, err = ParseAuthMechanism("ntlm")
+	tst.ErrorContains(err, "'ntlm' is not a valid authentication mechanism")
+}
@@ -1,50 +1,502 @@
 package guild
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	smail "github.com/xhit/go-simple-mail/v2"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
 	"time"
 )
 
+// ErrStartTLSNotSupported is returned when EncryptionStartTLSRequired is
+// used against a server that does not advertise STARTTLS.
+var ErrStartTLSNotSupported = errors.New("server does not support STARTTLS")
+
+// ErrStartTLSFailed is returned when the server offered STARTTLS but
+// refused it or the TLS handshake did not succeed.
+var ErrStartTLSFailed = errors.New("STARTTLS failed")
+
 // Courier defines an smtp server/client responsible for
 // "delivering" messages.
 type Courier struct {
-	server *smail.SMTPServer
+	host            string
+	port            int
+	user            string
+	password        string
+	helo            string
+	encryption      Encryption
+	tlsConfig       *tls.Config
+	connectTimeout  time.Duration
+	dkim            *DKIMSigner
+	recipientPolicy RecipientPolicy
+	authMechanism   AuthMechanism
+	tokenSource     TokenSource
+	logger          *slog.Logger
 }
 
 func NewCourier(host string, port int, user, password string) *Courier {
-	_courier := Courier{}
+	return &Courier{
+		host:           host,
+		port:           port,
+		user:           user,
+		password:       password,
+		helo:           "localhost",
+		encryption:     EncryptionNone,
+		connectTimeout: 10 * time.Second,
+	}
+}
+
+// SetEncryption sets how the connection to the server is secured.
+func (cr *Courier) SetEncryption(encryption Encryption) {
+	cr.encryption = encryption
+}
+
+// SetTLSConfig sets the tls.Config used for implicit TLS and STARTTLS.
+// When the config has no ServerName, the Courier host is used.
+func (cr *Courier) SetTLSConfig(config *tls.Config) {
+	cr.tlsConfig = config
+}
+
+func (cr *Courier) address() string {
+	return net.JoinHostPort(cr.host, strconv.Itoa(cr.port))
+}
+
+func (cr *Courier) clientTLSConfig() *tls.Config {
+	var config *tls.Config
+	if cr.tlsConfig != nil {
+		config = cr.tlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = cr.host
+	}
+	return config
+}
+
+// SetAuthMechanism chooses how to authenticate. Any mechanism other
+// than AuthAuto must be advertised by the server, or connecting fails
+// with ErrAuthNotSupported.
+func (cr *Courier) SetAuthMechanism(mechanism AuthMechanism) {
+	cr.authMechanism = mechanism
+}
+
+// SetTokenSource sets where XOAUTH2 access tokens come from. The
+// Courier user name is sent along with each token.
+func (cr *Courier) SetTokenSource(source TokenSource) {
+	cr.tokenSource = source
+}
+
+// SetLogger has every smtp conversation logged at debug level, line by
+// line as it happens, with AUTH credentials redacted and only the start
+// of the message data. A nil logger turns logging off.
+func (cr *Courier) SetLogger(logger *slog.Logger) {
+	cr.logger = logger
+}
+
+// SetDKIMSigner has every message DKIM signed just before it is sent.
+// A nil signer turns signing off.
+func (cr *Courier) SetDKIMSigner(signer *DKIMSigner) {
+	cr.dkim = signer
+}
+
+// seal applies any final processing to the parcel before it goes out.
+func (cr *Courier) seal(parcel *Parcel) (*Parcel, error) {
+	if cr.dkim == nil {
+		return parcel, nil
+	}
+	return cr.dkim.SignParcel(parcel)
+}
+
+// SetRecipientPolicy sets whether a message is still sent when some,
+// but not all, of its recipients are refused.
+func (cr *Courier) SetRecipientPolicy(policy RecipientPolicy) {
+	cr.recipientPolicy = policy
+}
+
+// SetConnectTimeout sets how long connecting, securing and
+// authenticating may take. Zero means no limit beyond that of
+// the context passed to DeliverContext.
+func (cr *Courier) SetConnectTimeout(timeout time.Duration) {
+	cr.connectTimeout = timeout
+}
+
+// session is an established smtp conversation.
+type session struct {
+	client     *smtp.Client
+	conn       net.Conn
+	transcript *transcript
+}
+
+// aLongTimeAgo is a deadline that makes any blocked read or write
+// on a connection return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch applies the earlier of the context deadline and the timeout
+// to the connection, and aborts any blocked read or write if the
+// context is cancelled. The returned function must be called once
+// the guarded work is done; it clears the deadline again.
+func (s *session) watch(ctx context.Context, timeout time.Duration) func() {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	_ = s.conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = s.conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+		_ = s.conn.SetDeadline(time.Time{})
+	}
+}
+
+// contextError prefers the context's own error when it has been
+// cancelled, as that is the real reason the conversation failed. The
+// connection deadline copied from ctx can fire just before ctx itself
+// is marked done, so a passed deadline counts too.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// dial opens the network connection, negotiating implicit TLS
+// when it has been requested.
+func (cr *Courier) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: cr.connectTimeout}
+
+	if cr.encryption == EncryptionTLS {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: cr.clientTLSConfig()}
+		conn, err := tlsDialer.DialContext(ctx, "tcp", cr.address())
+		if err != nil {
+			return nil, fmt.Errorf("tls connection to %s failed: %w", cr.address(), err)
+		}
+		return conn, nil
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", cr.address())
+	if err != nil {
+		return nil, fmt.Errorf("connection to %s failed: %w", cr.address(), err)
+	}
+	return conn, nil
+}
+
+// connect returns an smtp session that has been greeted, secured
+// and authenticated according to the Courier settings.
+func (cr *Courier) connect(ctx context.Context) (*session, error) {
+	conn, err := cr.dial(ctx)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	s := &session{conn: conn}
+	if cr.logger != nil {
+		s.transcript = newTranscript(cr.logger, cr.address())
+		conn = s.transcript.tapConn(conn)
+	}
+
+	// the connect timeout covers the whole handshake, not just the dial
+	stop := s.watch(ctx, cr.connectTimeout)
+	defer stop()
+
+	s.client, err = smtp.NewClient(conn, cr.host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, contextError(ctx, replyError(err))
+	}
+
+	err = cr.handshake(ctx, s)
+	if err != nil {
+		_ = s.client.Close()
+		return nil, contextError(ctx, err)
+	}
+
+	return s, nil
+}
+
+func (cr *Courier) handshake(ctx context.Context, s *session) error {
+	client := s.client
+	err := client.Hello(cr.helo)
+	if err != nil {
+		return replyError(err)
+	}
 
-	server := smail.NewSMTPClient()
-	server.Host = host
-	server.Port = port
-	server.Username = user
-	server.Password = password
-	// TODO: handle different encryptions
-	server.Encryption = smail.EncryptionNone
+	if cr.encryption == EncryptionStartTLS || cr.encryption == EncryptionStartTLSRequired {
+		ok, _ := client.Extension("STARTTLS")
+		if ok {
+			err = client.StartTLS(cr.clientTLSConfig())
+			if err != nil {
+				return fmt.Errorf("%s: %w: %w", cr.address(), ErrStartTLSFailed, replyError(err))
+			}
+			if s.transcript != nil {
+				s.transcript.tapText(client.Text)
+			}
+		} else if cr.encryption == EncryptionStartTLSRequired {
+			return fmt.Errorf("%s: %w", cr.address(), ErrStartTLSNotSupported)
+		}
+	}
+
+	return cr.authenticate(ctx, client)
+}
 
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-	_courier.server = server
+// authenticate logs in with the configured AuthMechanism.
+func (cr *Courier) authenticate(ctx context.Context, client *smtp.Client) error {
+	advertised, offered := client.Extension("AUTH")
+
+	if cr.authMechanism == AuthAuto {
+		// only authenticate when the server asks for it
+		if (cr.user == "" && cr.password == "") || !advertised {
+			return nil
+		}
+		err := client.Auth(&plainAuth{username: cr.user, password: cr.password})
+		if err != nil {
+			return fmt.Errorf("authentication failed: %w", replyError(err))
+		}
+		return nil
+	}
+
+	name := authMechanismNameOnWire[cr.authMechanism]
+	if !offersMechanism(offered, name) {
+		if offered == "" {
+			offered = "none"
+		}
+		return fmt.Errorf("%s: %w %s (offered: %s)", cr.address(), ErrAuthNotSupported, name, offered)
+	}
+
+	var auth smtp.Auth
+	switch cr.authMechanism {
+	case AuthPlain:
+		auth = &plainAuth{username: cr.user, password: cr.password}
+	case AuthLogin:
+		auth = &loginAuth{username: cr.user, password: cr.password}
+	case AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(cr.user, cr.password)
+	case AuthXOAUTH2:
+		if cr.tokenSource == nil {
+			return fmt.Errorf("XOAUTH2 authentication requires a token source")
+		}
+		token, err := cr.tokenSource.Token(ctx)
+		if err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+		auth = &xoauth2Auth{username: cr.user, token: token.AccessToken}
+	}
 
-	return &_courier
+	err := client.Auth(auth)
+	if err != nil {
+		// a refused token may just have been revoked early
+		if invalidator, ok := cr.tokenSource.(interface{ Invalidate() }); ok && cr.authMechanism == AuthXOAUTH2 {
+			invalidator.Invalidate()
+		}
+		return fmt.Errorf("%s authentication failed: %w", name, replyError(err))
+	}
+	return nil
 }
 
-// Deliver provides a one-off connection and deliver of an email.
-func (cr *Courier) Deliver(msg *smail.Email) error {
+// sendMail runs a single mail transaction on an established client.
+// Negative server replies are returned as an *SMTPError, or as a
+// *RecipientError when the message was held back by refused recipients.
+func sendMail(client *smtp.Client, policy RecipientPolicy, from string, recipients []string, body string) (*DeliveryResult, error) {
+	result, err := transact(client, policy, from, recipients, body)
+	return result, replyError(err)
+}
 
-	client, err := cr.server.Connect()
+// envelopeFor returns the sender and recipients as MAIL FROM and RCPT
+// TO give them: as they are to a server that offers SMTPUTF8, and in
+// ASCII to one that does not.
+func envelopeFor(smtpUTF8 bool, from string, recipients []string) (string, []string, error) {
+	if smtpUTF8 {
+		return from, recipients, nil
+	}
+	from, err := asciiAddress(from)
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	rcptTo := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		rcptTo[i], err = asciiAddress(recipient)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return from, rcptTo, nil
+}
+
+func transact(client *smtp.Client, policy RecipientPolicy, from string, recipients []string, body string) (*DeliveryResult, error) {
+	result := &DeliveryResult{}
+
+	// net/smtp asks for SMTPUTF8 itself when the server offers it
+	smtpUTF8, _ := client.Extension("SMTPUTF8")
+	from, rcptTo, err := envelopeFor(smtpUTF8, from, recipients)
+	if err != nil {
+		return result, err
+	}
+
+	err = client.Mail(from)
+	if err != nil {
+		return result, err
+	}
+
+	accepted := 0
+	for i, recipient := range recipients {
+		err = client.Rcpt(rcptTo[i])
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			result.add(recipient, newSMTPError(protoErr))
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.add(recipient, nil)
+		accepted++
+	}
+
+	if accepted == 0 || (accepted < len(recipients) && policy == RequireAllRecipients) {
+		return result, &RecipientError{Result: result}
+	}
+
+	result.dataStarted = true
+	w, err := client.Data()
+	if err != nil {
+		return result, err
+	}
+
+	_, err = w.Write([]byte(body))
+	if err != nil {
+		_ = w.Close()
+		return result, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return result, err
+	}
+
+	result.Sent = true
+	return result, nil
+}
+
+// Deliver provides a one-off connection and deliver of an email. The
+// result lists the server's answer for each recipient and is returned
+// whenever the transaction got as far as RCPT TO, even on error.
+func (cr *Courier) Deliver(msg *smail.Email) (*DeliveryResult, error) {
+	return cr.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext is Deliver, abandoning the connection when
+// ctx is cancelled or its deadline passes.
+func (cr *Courier) DeliverContext(ctx context.Context, msg *smail.Email) (*DeliveryResult, error) {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return nil, err
+	}
+	return cr.deliverParcel(ctx, parcel)
+}
+
+// SendParcel implements Transport, delivering an already rendered
+// message over a one-off connection.
+func (cr *Courier) SendParcel(parcel *Parcel) error {
+	return cr.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (cr *Courier) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := cr.deliverParcel(ctx, parcel)
+	return err
+}
+
+// DeliverParcelContext implements ResultTransport.
+func (cr *Courier) DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	return cr.deliverParcel(ctx, parcel)
+}
+
+func (cr *Courier) deliverParcel(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	parcel, err := cr.seal(parcel)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := cr.connect(ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	defer func() {
-		_ = client.Close()
+		_ = s.client.Close()
 	}()
 
-	err = msg.Send(client)
+	stop := s.watch(ctx, 0)
+	defer stop()
+
+	result, err := sendMail(s.client, cr.recipientPolicy, parcel.From, parcel.Recipients, parcel.Data)
+	result.Host = cr.address()
 	if err != nil {
-		return err
+		return result, contextError(ctx, err)
 	}
-	return nil
 
+	_ = s.client.Quit()
+
+	logRefused(cr.logger, result)
+	return result, nil
+
+}
+
+// logRefused warns about the recipients a server refused when the
+// message was sent to the others anyway, as the RequireAnyRecipient
+// policy allows, since no error reports them.
+func logRefused(logger *slog.Logger, result *DeliveryResult) {
+	if logger == nil || !result.Sent {
+		return
+	}
+	for _, refused := range result.Recipients {
+		if refused.Status == RecipientAccepted {
+			continue
+		}
+		logger.Warn("recipient refused",
+			slog.String("host", result.Host),
+			slog.String("recipient", refused.Recipient),
+			slog.String("status", refused.Status.String()),
+			slog.String("reply", refused.Reply.Error()),
+		)
+	}
+}
+
+// Send implements Transport.
+func (cr *Courier) Send(msg *smail.Email) error {
+	_, err := cr.Deliver(msg)
+	return err
+}
+
+// Close implements Transport. Deliver does not hold on to its
+// connection, so there is nothing to release.
+func (cr *Courier) Close() error {
+	return nil
 }
@@ -0,0 +1,190 @@
+package guild
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func CreateTestMessage() *smail.Email {
+	scribe := NewSimpleTextScribe()
+	scribe.SetSubjectTemplate("Courier Test")
+	scribe.SetTextBodyTemplate("This is the courier test body.")
+	_, _ = scribe.Open()
+	scribe.Compose().Seal(CreateEnvelope())
+	return scribe.Message()
+}
+
+func CreateTestCourier(srv *couriertest.Server, encryption Encryption) *Courier {
+	courier := NewCourier(srv.Host(), srv.Port(), "", "")
+	courier.SetEncryption(encryption)
+	courier.SetTLSConfig(srv.ClientTLS)
+	return courier
+}
+
+func TestCourier_DeliverPlain(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+
+	messages := srv.Messages()
+	tst.Len(messages, 1)
+	tst.Equal("sender@email.com", messages[0].From)
+	tst.Equal([]string{"receiver@email.com"}, messages[0].To)
+	tst.Contains(messages[0].Data, "Subject: Courier Test")
+	tst.False(messages[0].TLS)
+}
+
+func TestCourier_DeliverImplicitTLS(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.ImplicitTLS = true
+	})
+	courier := CreateTestCourier(srv, EncryptionTLS)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+
+	messages := srv.Messages()
+	tst.Len(messages, 1)
+	tst.True(messages[0].TLS)
+}
+
+func TestCourier_DeliverImplicitTLSWithUntrustedCertificate(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.ImplicitTLS = true
+	})
+	courier := CreateTestCourier(srv, EncryptionTLS)
+	courier.SetTLSConfig(&tls.Config{})
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.NotNil(err)
+	tst.Len(srv.Messages(), 0)
+}
+
+func TestCourier_DeliverStartTLS(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferStartTLS = true
+	})
+
+	for _, encryption := range []Encryption{EncryptionStartTLS, EncryptionStartTLSRequired} {
+		courier := CreateTestCourier(srv, encryption)
+		_, err := courier.Deliver(CreateTestMessage())
+		tst.Nil(err, encryption.String())
+	}
+
+	messages := srv.Messages()
+	tst.Len(messages, 2)
+	tst.True(messages[0].TLS)
+	tst.True(messages[1].TLS)
+}
+
+func TestCourier_OpportunisticStartTLSWithoutServerSupport(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionStartTLS)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+
+	messages := srv.Messages()
+	tst.Len(messages, 1)
+	tst.False(messages[0].TLS)
+}
+
+func TestCourier_RequiredStartTLSWithoutServerSupport(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionStartTLSRequired)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.True(errors.Is(err, ErrStartTLSNotSupported))
+	tst.Len(srv.Messages(), 0)
+}
+
+func TestParseEncryption(t *testing.T) {
+	tst := assert.New(t)
+
+	for _, name := range []string{"none", "tls", "starttls", "starttls-required"} {
+		encryption, err := ParseEncryption(name)
+		tst.Nil(err)
+		tst.Equal(name, encryption.String())
+	}
+
+	encryption, err := ParseEncryption("")
+	tst.Nil(err)
+	tst.Equal(EncryptionNone, encryption)
+
+	_, err = ParseEncryption("ssl")
+	tst.NotNil(err)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caFile, srv.CertificatePEM(), 0600)
+	tst.Nil(err)
+
+	config, err := NewTLSConfig(caFile, "mail.example.com", "1.2")
+	tst.Nil(err)
+	tst.NotNil(config.RootCAs)
+	tst.Equal("mail.example.com", config.ServerName)
+	tst.Equal(uint16(tls.VersionTLS12), config.MinVersion)
+
+	_, err = NewTLSConfig("", "", "1.9")
+	tst.NotNil(err)
+
+	_, err = NewTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), "", "")
+	tst.NotNil(err)
+}
+
+func TestCourier_DeliverContextDeadline(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMessage, Delay: 2 * time.Second})
+	})
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := courier.DeliverContext(ctx, CreateTestMessage())
+	tst.ErrorIs(err, context.DeadlineExceeded)
+	tst.Less(time.Since(start), time.Second)
+}
+
+func TestCourier_DeliverContextCancelled(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := courier.DeliverContext(ctx, CreateTestMessage())
+	tst.ErrorIs(err, context.Canceled)
+	tst.Equal(0, srv.Connections())
+}
@@ -0,0 +1,395 @@
+package guild
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders are the header fields signed when DKIMOptions.Headers
+// is empty. Only the fields present in the message are signed.
+var DefaultDKIMHeaders = []string{
+	"From", "Sender", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+const (
+	DKIMCanonicalizationSimple  = "simple"
+	DKIMCanonicalizationRelaxed = "relaxed"
+)
+
+// DKIMOptions configures the signing of outgoing messages.
+type DKIMOptions struct {
+	// Domain is the signing domain (d=).
+	Domain string
+	// Selector locates the public key at <selector>._domainkey.<domain> (s=).
+	Selector string
+	// Key is an *rsa.PrivateKey or an ed25519.PrivateKey, see LoadDKIMKey.
+	Key crypto.Signer
+	// Headers lists the header fields to sign. From is always signed.
+	Headers []string
+	// HeaderCanonicalization and BodyCanonicalization are "simple" or
+	// "relaxed", defaulting to "relaxed".
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+}
+
+// DKIMSigner adds a DKIM-Signature header to raw messages.
+type DKIMSigner struct {
+	options   DKIMOptions
+	algorithm string
+	now       func() time.Time
+}
+
+func NewDKIMSigner(options DKIMOptions) (*DKIMSigner, error) {
+	if emptyString(options.Domain) {
+		return nil, fmt.Errorf("dkim signing requires a domain")
+	}
+	if emptyString(options.Selector) {
+		return nil, fmt.Errorf("dkim signing requires a selector")
+	}
+
+	signer := &DKIMSigner{options: options, now: time.Now}
+
+	switch options.Key.(type) {
+	case *rsa.PrivateKey:
+		signer.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		signer.algorithm = "ed25519-sha256"
+	case nil:
+		return nil, fmt.Errorf("dkim signing requires a private key")
+	default:
+		return nil, fmt.Errorf("dkim signing key must be RSA or Ed25519, not %T", options.Key)
+	}
+
+	for _, c := range []*string{&signer.options.HeaderCanonicalization, &signer.options.BodyCanonicalization} {
+		*c = strings.ToLower(strings.TrimSpace(*c))
+		if *c == "" {
+			*c = DKIMCanonicalizationRelaxed
+		}
+		if *c != DKIMCanonicalizationSimple && *c != DKIMCanonicalizationRelaxed {
+			return nil, fmt.Errorf("'%s' is not a valid dkim canonicalization", *c)
+		}
+	}
+
+	if len(signer.options.Headers) == 0 {
+		signer.options.Headers = DefaultDKIMHeaders
+	}
+	hasFrom := false
+	for _, name := range signer.options.Headers {
+		hasFrom = hasFrom || strings.EqualFold(name, "From")
+	}
+	if !hasFrom {
+		signer.options.Headers = append([]string{"From"}, signer.options.Headers...)
+	}
+
+	return signer, nil
+}
+
+// LoadDKIMKey parses a PEM encoded RSA (PKCS #1 or PKCS #8) or
+// Ed25519 (PKCS #8) private key.
+func LoadDKIMKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in dkim key")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("dkim key must be RSA or Ed25519, not %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block '%s' in dkim key", block.Type)
+}
+
+// LoadDKIMKeyFile reads and parses a PEM encoded private key file.
+func LoadDKIMKeyFile(path string) (crypto.Signer, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read dkim key: %w", err)
+	}
+	return LoadDKIMKey(pemData)
+}
+
+var dkimWhiteSpace = regexp.MustCompile(`[ \t]+`)
+
+// dkimHeader is a single, possibly folded, header field.
+type dkimHeader struct {
+	name string
+	raw  string // including the trailing CRLF
+}
+
+// dkimSplitMessage separates the header fields from the body.
+func dkimSplitMessage(message string) ([]dkimHeader, string, error) {
+	head, body, found := strings.Cut(message, "\r\n\r\n")
+	if !found {
+		return nil, "", fmt.Errorf("message has no header/body separator")
+	}
+
+	var headers []dkimHeader
+	for _, line := range strings.SplitAfter(head+"\r\n", "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				return nil, "", fmt.Errorf("message starts with a continuation line")
+			}
+			headers[len(headers)-1].raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		headers = append(headers, dkimHeader{name: strings.TrimSpace(name), raw: line})
+	}
+	return headers, body, nil
+}
+
+func dkimCanonicalizeHeader(raw, canonicalization string) string {
+	if canonicalization == DKIMCanonicalizationSimple {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(dkimWhiteSpace.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+func dkimCanonicalizeBody(body, canonicalization string) string {
+	if canonicalization == DKIMCanonicalizationRelaxed {
+		lines := strings.Split(body, "\r\n")
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(dkimWhiteSpace.ReplaceAllString(line, " "), " ")
+		}
+		body = strings.Join(lines, "\r\n")
+	}
+
+	body = strings.TrimRight(body, "\r\n")
+	if body == "" && canonicalization == DKIMCanonicalizationRelaxed {
+		return ""
+	}
+	return body + "\r\n"
+}
+
+// Sign returns the message with a DKIM-Signature header added. Bare line
+// feeds are converted to CRLF first, so the signature covers exactly what
+// is sent over smtp.
+func (ds *DKIMSigner) Sign(message string) (string, error) {
+	message = strings.ReplaceAll(strings.ReplaceAll(message, "\r\n", "\n"), "\n", "\r\n")
+
+	headers, body, err := dkimSplitMessage(message)
+	if err != nil {
+		return "", err
+	}
+
+	bodyHash := sha256.Sum256([]byte(dkimCanonicalizeBody(body, ds.options.BodyCanonicalization)))
+
+	// pick the headers to sign, taking repeated fields from the bottom up
+	used := make(map[int]bool)
+	var signedNames []string
+	var signedHeaders strings.Builder
+	hasFrom := false
+	for _, name := range ds.options.Headers {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headers[i].name, name) {
+				continue
+			}
+			used[i] = true
+			hasFrom = hasFrom || strings.EqualFold(name, "From")
+			signedNames = append(signedNames, strings.ToLower(name))
+			signedHeaders.WriteString(dkimCanonicalizeHeader(headers[i].raw, ds.options.HeaderCanonicalization))
+			break
+		}
+	}
+	if !hasFrom {
+		return "", fmt.Errorf("dkim signing requires a From header")
+	}
+
+	// the header is folded as it is built, since simple canonicalization
+	// signs it exactly as it is sent
+	signature := &dkimFolder{}
+	signature.write("DKIM-Signature:", false)
+	for _, tag := range []string{
+		"v=1",
+		"a=" + ds.algorithm,
+		"c=" + ds.options.HeaderCanonicalization + "/" + ds.options.BodyCanonicalization,
+		"d=" + ds.options.Domain,
+		"s=" + ds.options.Selector,
+		fmt.Sprintf("t=%d", ds.now().Unix()),
+	} {
+		signature.write(tag+";", true)
+	}
+	for i, name := range signedNames {
+		switch {
+		case i == 0 && len(signedNames) == 1:
+			signature.write("h="+name+";", true)
+		case i == 0:
+			signature.write("h="+name+":", true)
+		case i == len(signedNames)-1:
+			signature.write(name+";", false)
+		default:
+			signature.write(name+":", false)
+		}
+	}
+	signature.write("bh="+base64.StdEncoding.EncodeToString(bodyHash[:])+";", true)
+	signature.write("b=", true)
+
+	// the signature header itself is signed with an empty b= and no CRLF
+	signedHeaders.WriteString(strings.TrimSuffix(dkimCanonicalizeHeader(signature.String()+"\r\n", ds.options.HeaderCanonicalization), "\r\n"))
+	digest := sha256.Sum256([]byte(signedHeaders.String()))
+
+	var sig []byte
+	switch key := ds.options.Key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case ed25519.PrivateKey:
+		// RFC 8463 signs the sha256 digest with PureEdDSA
+		sig = ed25519.Sign(key, digest[:])
+	}
+	if err != nil {
+		return "", fmt.Errorf("dkim signing failed: %w", err)
+	}
+
+	signature.writeValue(base64.StdEncoding.EncodeToString(sig))
+
+	var signed bytes.Buffer
+	signed.WriteString(signature.String())
+	signed.WriteString("\r\n")
+	signed.WriteString(message)
+	return signed.String(), nil
+}
+
+// dkimLineLength is where the DKIM-Signature header is folded, well
+// inside the 998 octets RFC 5322 allows on a line.
+const dkimLineLength = 78
+
+// dkimFolder builds a header folded at the points it is told it may
+// break, keeping each line within dkimLineLength where it can.
+type dkimFolder struct {
+	header strings.Builder
+	column int
+}
+
+// write adds text, preceded by a space when spaced, starting a new
+// line first when the text would not fit on the current one.
+func (f *dkimFolder) write(text string, spaced bool) {
+	width := len(text)
+	if spaced {
+		width++
+	}
+	if f.column > 0 && f.column+width > dkimLineLength {
+		f.fold()
+		spaced = false
+	}
+	if spaced {
+		f.header.WriteString(" ")
+		f.column++
+	}
+	f.header.WriteString(text)
+	f.column += len(text)
+}
+
+// writeValue adds a base64 value, which may be folded anywhere.
+func (f *dkimFolder) writeValue(value string) {
+	for len(value) > 0 {
+		room := dkimLineLength - f.column
+		if room < 1 {
+			f.fold()
+			continue
+		}
+		n := min(room, len(value))
+		f.header.WriteString(value[:n])
+		f.column += n
+		value = value[n:]
+	}
+}
+
+func (f *dkimFolder) fold() {
+	f.header.WriteString("\r\n\t")
+	f.column = 1
+}
+
+func (f *dkimFolder) String() string {
+	return f.header.String()
+}
+
+// SignParcel returns a copy of the parcel with its data signed.
+func (ds *DKIMSigner) SignParcel(parcel *Parcel) (*Parcel, error) {
+	data, err := ds.Sign(parcel.Data)
+	if err != nil {
+		return nil, err
+	}
+	signed := *parcel
+	signed.Data = data
+	return &signed, nil
+}
+
+// DKIMTransport signs every message before handing it to the wrapped
+// transport, so that transports which pass messages on as they are,
+// such as a file, maildir or sendmail, send them signed as well.
+type DKIMTransport struct {
+	transport Transport
+	signer    *DKIMSigner
+}
+
+func NewDKIMTransport(transport Transport, signer *DKIMSigner) *DKIMTransport {
+	return &DKIMTransport{
+		transport: transport,
+		signer:    signer,
+	}
+}
+
+func (dt *DKIMTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return dt.SendParcel(parcel)
+}
+
+func (dt *DKIMTransport) SendParcel(parcel *Parcel) error {
+	return dt.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (dt *DKIMTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := dt.DeliverParcelContext(ctx, parcel)
+	return err
+}
+
+// DeliverParcelContext implements ResultTransport, passing on the
+// result of the wrapped transport when it reports one.
+func (dt *DKIMTransport) DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	signed, err := dt.signer.SignParcel(parcel)
+	if err != nil {
+		return nil, err
+	}
+	return DeliverParcelContext(ctx, dt.transport, signed)
+}
+
+func (dt *DKIMTransport) Close() error {
+	return dt.transport.Close()
+}
@@ -0,0 +1,210 @@
+package guild
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/toorop/go-dkim"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func CreateTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// verifyWithGoDKIM checks an rsa signature with an independent implementation.
+func verifyWithGoDKIM(t *testing.T, message string, key *rsa.PrivateKey) error {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	lookup := dkim.DNSOptLookupTXT(func(name string) ([]string, error) {
+		return []string{record}, nil
+	})
+	raw := []byte(message)
+	_, err = dkim.Verify(&raw, lookup)
+	return err
+}
+
+func TestDKIMSigner_RSA(t *testing.T) {
+	tst := assert.New(t)
+
+	key := CreateTestRSAKey(t)
+
+	for _, canonicalization := range [][2]string{{"relaxed", "relaxed"}, {"simple", "simple"}, {"relaxed", "simple"}} {
+		signer, err := NewDKIMSigner(DKIMOptions{
+			Domain:                 "email.com",
+			Selector:               "courier",
+			Key:                    key,
+			HeaderCanonicalization: canonicalization[0],
+			BodyCanonicalization:   canonicalization[1],
+		})
+		tst.Nil(err)
+
+		signed, err := signer.Sign(rawMessage(CreateTestMessage()))
+		tst.Nil(err)
+		tst.True(strings.HasPrefix(signed, "DKIM-Signature: v=1; a=rsa-sha256; c="+canonicalization[0]+"/"+canonicalization[1]+"; d=email.com; s=courier;"))
+		tst.Nil(verifyWithGoDKIM(t, signed, key), canonicalization)
+		assertDKIMFolded(t, signed)
+
+		// any change to a signed header breaks the signature
+		tampered := strings.Replace(signed, "Subject: Courier Test", "Subject: Courier Text", 1)
+		tst.NotNil(verifyWithGoDKIM(t, tampered, key))
+	}
+}
+
+// assertDKIMFolded checks that no line of the DKIM-Signature header
+// runs past dkimLineLength.
+func assertDKIMFolded(t *testing.T, signed string) {
+	fields, _, err := dkimSplitMessage(signed)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(fields[0].raw, "\r\n"), "\r\n")
+	assert.Greater(t, len(lines), 1)
+	for _, line := range lines {
+		assert.LessOrEqual(t, len(line), dkimLineLength, line)
+	}
+}
+
+func TestDKIMSigner_FoldsLongHeaderLists(t *testing.T) {
+	tst := assert.New(t)
+
+	key := CreateTestRSAKey(t)
+	for _, canonicalization := range []string{"relaxed", "simple"} {
+		signer, err := NewDKIMSigner(DKIMOptions{
+			Domain:                 "email.com",
+			Selector:               "courier",
+			Key:                    key,
+			Headers:                append(DefaultDKIMHeaders, "List-Unsubscribe", "List-Unsubscribe-Post", "In-Reply-To", "References"),
+			HeaderCanonicalization: canonicalization,
+		})
+		tst.Nil(err)
+
+		signed, err := signer.Sign(rawMessage(CreateTestMessage()))
+		tst.Nil(err)
+		tst.Nil(verifyWithGoDKIM(t, signed, key), canonicalization)
+		assertDKIMFolded(t, signed)
+	}
+}
+
+func TestDKIMSigner_Ed25519(t *testing.T) {
+	tst := assert.New(t)
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	tst.Nil(err)
+
+	signer, err := NewDKIMSigner(DKIMOptions{
+		Domain:   "email.com",
+		Selector: "courier",
+		Key:      private,
+		Headers:  []string{"Subject", "To"},
+	})
+	tst.Nil(err)
+
+	signed, err := signer.Sign(rawMessage(CreateTestMessage()))
+	tst.Nil(err)
+
+	fields, body, err := dkimSplitMessage(signed)
+	tst.Nil(err)
+	header := strings.TrimSuffix(fields[0].raw, "\r\n")
+	tst.Contains(header, "a=ed25519-sha256;")
+	tst.Contains(header, "h=from:subject:to;")
+
+	// rebuild the signed data as a verifier would
+	fields = fields[1:]
+
+	bodyHash := sha256.Sum256([]byte(dkimCanonicalizeBody(body, "relaxed")))
+	tst.Contains(header, "bh="+base64.StdEncoding.EncodeToString(bodyHash[:])+";")
+
+	var data strings.Builder
+	for _, name := range []string{"From", "Subject", "To"} {
+		for _, field := range fields {
+			if field.name == name {
+				data.WriteString(dkimCanonicalizeHeader(field.raw, "relaxed"))
+			}
+		}
+	}
+	signature := regexp.MustCompile(`b=([A-Za-z0-9+/=\r\n\t]+)$`).FindStringSubmatch(header)
+	tst.NotNil(signature)
+	unsigned := strings.TrimSuffix(header, signature[1])
+	data.WriteString(strings.TrimSuffix(dkimCanonicalizeHeader(unsigned+"\r\n", "relaxed"), "\r\n"))
+
+	sig, err := base64.StdEncoding.DecodeString(strings.NewReplacer("\r\n", "", "\t", "").Replace(signature[1]))
+	tst.Nil(err)
+	digest := sha256.Sum256([]byte(data.String()))
+	tst.True(ed25519.Verify(public, digest[:], sig))
+}
+
+func TestDKIMSigner_Options(t *testing.T) {
+	tst := assert.New(t)
+
+	key := CreateTestRSAKey(t)
+
+	_, err := NewDKIMSigner(DKIMOptions{Selector: "courier", Key: key})
+	tst.ErrorContains(err, "domain")
+
+	_, err = NewDKIMSigner(DKIMOptions{Domain: "email.com", Selector: "courier"})
+	tst.ErrorContains(err, "private key")
+
+	_, err = NewDKIMSigner(DKIMOptions{Domain: "email.com", Selector: "courier", Key: key, BodyCanonicalization: "loose"})
+	tst.ErrorContains(err, "'loose' is not a valid dkim canonicalization")
+}
+
+func TestLoadDKIMKey(t *testing.T) {
+	tst := assert.New(t)
+
+	rsaKey := CreateTestRSAKey(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	tst.Nil(err)
+
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	key, err := LoadDKIMKey(pkcs1)
+	tst.Nil(err)
+	tst.IsType(&rsa.PrivateKey{}, key)
+
+	for _, k := range []crypto.Signer{rsaKey, edKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		tst.Nil(err)
+		key, err = LoadDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		tst.Nil(err)
+		tst.Equal(k.Public(), key.Public())
+	}
+
+	_, err = LoadDKIMKey([]byte("not a key"))
+	tst.NotNil(err)
+}
+
+func TestCourier_DeliverWithDKIM(t *testing.T) {
+	tst := assert.New(t)
+
+	key := CreateTestRSAKey(t)
+	signer, err := NewDKIMSigner(DKIMOptions{Domain: "email.com", Selector: "courier", Key: key})
+	tst.Nil(err)
+
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionNone)
+	courier.SetDKIMSigner(signer)
+
+	_, err = courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+
+	messages := srv.Messages()
+	tst.Len(messages, 1)
+	tst.True(strings.HasPrefix(messages[0].Data, "DKIM-Signature: v=1; a=rsa-sha256;"))
+
+	received := messages[0].Data
+	tst.Nil(verifyWithGoDKIM(t, received, key))
+}
@@ -7,6 +7,7 @@ import (
 	enormalizer "github.com/dimuska139/go-email-normalizer"
 	smail "github.com/xhit/go-simple-mail/v2"
 	"net/mail"
+	"sort"
 	"strings"
 )
 
@@ -18,30 +19,73 @@ const (
 	ToAddress
 	CcAddress
 	BccAddress
+	SenderAddress
+	ReturnPathAddress
 )
 
+func (at AddressType) String() string {
+	switch at {
+	case FromAddress:
+		return "from"
+	case ReplyToAddress:
+		return "reply-to"
+	case ToAddress:
+		return "to"
+	case CcAddress:
+		return "cc"
+	case BccAddress:
+		return "bcc"
+	case SenderAddress:
+		return "sender"
+	case ReturnPathAddress:
+		return "return-path"
+	}
+	return fmt.Sprintf("AddressType(%d)", int(at))
+}
+
 var EmptyAddress = mail.Address{}
 
 type Envelope struct {
 	verifier       *emailverifier.Verifier
 	normalizer     *enormalizer.Normalizer
+	policy         ValidationPolicy
 	FromAddress    mail.Address
 	ReplyToAddress mail.Address
-	toAddresses    mapset.Set[mail.Address]
-	ccAddresses    mapset.Set[mail.Address]
-	bccAddresses   mapset.Set[mail.Address]
-	errors         []error
+	// SenderAddress is who actually sent the message on behalf of the
+	// From address, given in the Sender header.
+	SenderAddress mail.Address
+	// ReturnPathAddress is the envelope sender given in MAIL FROM, where
+	// bounces go. The From address is used when it is not set.
+	ReturnPathAddress mail.Address
+	toAddresses       mapset.Set[mail.Address]
+	ccAddresses       mapset.Set[mail.Address]
+	bccAddresses      mapset.Set[mail.Address]
+	// redirected holds the to and cc recipients a Safeguard sent
+	// elsewhere; redirected bcc recipients are only reported, as they
+	// never appear in the headers.
+	redirected []mail.Address
+	errors     []error
 }
 
-func NewEnvelope() *Envelope {
+// NewEnvelope returns an empty envelope that checks addresses by the
+// given policy, or by DefaultValidationPolicy when none is given.
+func NewEnvelope(policy ...ValidationPolicy) *Envelope {
 	mgr := Envelope{
 		verifier:     emailverifier.NewVerifier(),
 		normalizer:   enormalizer.NewNormalizer(),
+		policy:       DefaultValidationPolicy(),
 		toAddresses:  mapset.NewSet[mail.Address](),
 		ccAddresses:  mapset.NewSet[mail.Address](),
 		bccAddresses: mapset.NewSet[mail.Address](),
 	}
 
+	if len(policy) > 0 {
+		mgr.policy = policy[0]
+	}
+	if mgr.policy.CheckSMTP {
+		mgr.verifier.EnableSMTPCheck()
+	}
+
 	return &mgr
 }
 
@@ -53,13 +97,14 @@ func (em *Envelope) HasErrors() bool {
 	return len(em.errors) > 0
 }
 
+// GetErrors sums up the errors so far in one error, or returns nil
+// when there are none. Each error is an *AddressError, which errors.As
+// can pick out.
 func (em *Envelope) GetErrors() error {
-	errCount := len(em.errors)
-	var errDetails []string
-	for _, err := range em.errors {
-		errDetails = append(errDetails, err.Error())
+	if !em.HasErrors() {
+		return nil
 	}
-	return fmt.Errorf("%d envelope error(s): %s", errCount, strings.Join(errDetails, ", "))
+	return &errorList{format: "%d envelope error(s): %s", errs: em.errors}
 }
 
 // AcceptAddressString parses, validates and stores the given addresses. The idea here is
@@ -67,32 +112,42 @@ func (em *Envelope) GetErrors() error {
 func (em *Envelope) acceptAddressString(addressString string, addressType AddressType) {
 	addressString = strings.TrimSpace(addressString)
 	if addressString == "" {
-		em.addError(fmt.Errorf("empty string was provided to ParseEmailAddresses"))
+		em.addError(newAddressError(addressString, addressType, ErrEmptyAddress, "empty string was provided to ParseEmailAddresses"))
 	}
 
 	addresses, err := mail.ParseAddressList(addressString)
 	if err != nil {
-		em.addError(err)
+		em.addError(newAddressError(addressString, addressType, fmt.Errorf("%w: %w", ErrInvalidAddress, err), "%s", err))
 	}
 
 	if addressType == FromAddress && len(addresses) > 1 {
-		em.addError(fmt.Errorf("there can only be one from email address"))
+		em.addError(newAddressError(addressString, addressType, ErrTooManyAddresses, "there can only be one from email address"))
 	}
 
 	if addressType == ReplyToAddress && len(addresses) > 1 {
-		em.addError(fmt.Errorf("there can only be one reply to email address"))
+		em.addError(newAddressError(addressString, addressType, ErrTooManyAddresses, "there can only be one reply to email address"))
+	}
+
+	if addressType == SenderAddress && len(addresses) > 1 {
+		em.addError(newAddressError(addressString, addressType, ErrTooManyAddresses, "there can only be one sender email address"))
+	}
+
+	if addressType == ReturnPathAddress && len(addresses) > 1 {
+		em.addError(newAddressError(addressString, addressType, ErrTooManyAddresses, "there can only be one return path email address"))
 	}
 
 	// re-verify email address is valid
 	for _, address := range addresses {
 
-		result := em.verifier.ParseAddress(address.Address)
-		if !result.Valid {
-			em.addError(fmt.Errorf("'%s' is an invalid email address", address.Address))
+		err := em.validate(address, addressType)
+		if err != nil {
+			em.addError(err)
 		}
 
 		// normalize the address string
-		address.Address = em.normalizer.Normalize(address.Address)
+		if em.policy.Normalize {
+			address.Address = em.normalizer.Normalize(address.Address)
+		}
 
 		switch addressType {
 		case ToAddress:
@@ -105,6 +160,10 @@ func (em *Envelope) acceptAddressString(addressString string, addressType Addres
 			em.FromAddress = *address
 		case ReplyToAddress:
 			em.ReplyToAddress = *address
+		case SenderAddress:
+			em.SenderAddress = *address
+		case ReturnPathAddress:
+			em.ReturnPathAddress = *address
 		}
 	}
 
@@ -129,6 +188,25 @@ func (em *Envelope) SetReplyToAddress(address string) {
 	em.acceptAddressString(address, ReplyToAddress)
 }
 
+// SetSenderAddress sets the Sender header, for a message sent by
+// someone other than its author. An empty string is ignored.
+func (em *Envelope) SetSenderAddress(address string) {
+	if strings.TrimSpace(address) == "" {
+		return
+	}
+	em.acceptAddressString(address, SenderAddress)
+}
+
+// SetReturnPathAddress sets the envelope sender, so that bounces go to
+// a mailbox of their own rather than to the From address. An empty
+// string is ignored.
+func (em *Envelope) SetReturnPathAddress(address string) {
+	if strings.TrimSpace(address) == "" {
+		return
+	}
+	em.acceptAddressString(address, ReturnPathAddress)
+}
+
 func (em *Envelope) AddToAddress(address string) {
 	em.acceptAddressString(address, ToAddress)
 }
@@ -165,22 +243,89 @@ func (em *Envelope) GetBccAddresses() []mail.Address {
 	return em.bccAddresses.ToSlice()
 }
 
+// ApplySafeguard redirects or drops the recipients the safeguard does
+// not allow, and reports what it changed. Redirected to and cc
+// recipients are listed in an X-Original-To header when the message
+// is stamped; bcc recipients are not, so they stay hidden.
+func (em *Envelope) ApplySafeguard(sg *Safeguard) *SafeguardReport {
+	report := &SafeguardReport{}
+	redirect := sg.redirectTo != EmptyAddress
+	if redirect {
+		report.RedirectedTo = sg.redirectTo.Address
+	}
+
+	for _, group := range []struct {
+		addresses mapset.Set[mail.Address]
+		hidden    bool
+	}{
+		{em.toAddresses, false},
+		{em.ccAddresses, false},
+		{em.bccAddresses, true},
+	} {
+		addresses, hidden := group.addresses, group.hidden
+		for _, address := range addresses.ToSlice() {
+			if sg.Allowed(address.Address) || (redirect && address.Address == sg.redirectTo.Address) {
+				continue
+			}
+			addresses.Remove(address)
+			if redirect {
+				if !hidden {
+					em.redirected = append(em.redirected, address)
+				}
+				report.Redirected = append(report.Redirected, address.Address)
+			} else {
+				report.Dropped = append(report.Dropped, address.Address)
+			}
+		}
+	}
+
+	if len(report.Redirected) > 0 {
+		em.toAddresses.Add(sg.redirectTo)
+	}
+
+	sort.Strings(report.Redirected)
+	sort.Strings(report.Dropped)
+	return report
+}
+
+// Stamp addresses the message. Bcc recipients are only added to the
+// smtp recipient list; they never appear in the message headers.
+// MAIL FROM is the return path when one is set, then the sender,
+// then the From address. Internationalized domains are written in
+// punycode wherever the local part allows it (see headerAddress).
 func (em *Envelope) Stamp(msg *smail.Email) {
-	msg.SetFrom(em.FromAddress.String())
+	msg.SetFrom(headerAddress(em.FromAddress))
+
+	// a Sender header that repeats From says nothing
+	if em.SenderAddress != EmptyAddress && em.SenderAddress.Address != em.FromAddress.Address {
+		msg.SetSender(headerAddress(em.SenderAddress))
+	}
+
+	if em.ReturnPathAddress != EmptyAddress {
+		msg.SetReturnPath(em.ReturnPathAddress.Address)
+	}
 
 	if em.ReplyToAddress != EmptyAddress {
-		msg.SetReplyTo(em.ReplyToAddress.String())
+		msg.SetReplyTo(headerAddress(em.ReplyToAddress))
 	}
 
 	for _, addr := range em.GetToAddresses() {
-		msg.AddTo(addr.String())
+		msg.AddTo(headerAddress(addr))
 	}
 
 	for _, addr := range em.GetCcAddresses() {
-		msg.AddCc(addr.String())
+		msg.AddCc(headerAddress(addr))
 	}
 
 	for _, addr := range em.GetBccAddresses() {
-		msg.AddBcc(addr.String())
+		msg.AddBcc(headerAddress(addr))
+	}
+
+	if len(em.redirected) > 0 {
+		originals := make([]string, len(em.redirected))
+		for i, addr := range em.redirected {
+			originals[i] = headerAddress(addr)
+		}
+		msg.AddHeader("X-Original-To", strings.Join(originals, ", "))
 	}
 }
@@ -2,6 +2,8 @@ package guild
 
 import (
 	"github.com/stretchr/testify/assert"
+	"net/mail"
+	"strings"
 	"testing"
 )
 
@@ -47,3 +49,87 @@ func TestMailer_ParseEmailAddresses(t *testing.T) {
 		tst.Equal(d.FirstAddress, em.GetToAddresses()[0].Address)
 	}
 }
+
+func TestEnvelope_StampKeepsBccOutOfHeaders(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope()
+	em.SetFromAddress("sender@email.com")
+	em.AddToAddress("receiver@email.com")
+	em.AddCcAddress("copied@email.com")
+	em.AddBccAddresses([]string{"hidden@email.com", "secret@email.com"})
+	tst.False(em.HasErrors())
+
+	msg := NewMessage()
+	msg.SetSubject("Bcc Test")
+	msg.SetTextBody("This is the bcc test body.")
+	msg.Seal(em)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.String()))
+	tst.Nil(err)
+
+	tst.Empty(parsed.Header.Get("Bcc"))
+	for name, values := range parsed.Header {
+		for _, value := range values {
+			tst.NotContains(value, "hidden@email.com", name)
+			tst.NotContains(value, "secret@email.com", name)
+		}
+	}
+	tst.Equal("<receiver@email.com>", parsed.Header.Get("To"))
+	tst.Equal("<copied@email.com>", parsed.Header.Get("Cc"))
+
+	tst.ElementsMatch(
+		[]string{"receiver@email.com", "copied@email.com", "hidden@email.com", "secret@email.com"},
+		msg.email.GetRecipients(),
+	)
+}
+
+func TestEnvelope_ReturnPathAndSender(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope()
+	em.SetFromAddress("Author <author@email.com>")
+	em.SetSenderAddress("Assistant <assistant@email.com>")
+	em.SetReturnPathAddress("bounces@email.com")
+	em.AddToAddress("receiver@email.com")
+	tst.False(em.HasErrors())
+
+	msg := NewMessage()
+	msg.SetSubject("Return Path Test")
+	msg.SetTextBody("This is the return path test body.")
+	msg.Seal(em)
+
+	parcel, err := NewParcel(msg.Message())
+	tst.Nil(err)
+	tst.Equal("bounces@email.com", parcel.From)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(parcel.Data))
+	tst.Nil(err)
+	tst.Equal(`"Author" <author@email.com>`, parsed.Header.Get("From"))
+	tst.Equal(`"Assistant" <assistant@email.com>`, parsed.Header.Get("Sender"))
+	// the receiving server adds Return-Path, not the sender
+	tst.Empty(parsed.Header.Get("Return-Path"))
+
+	em.SetReturnPathAddress("one@email.com, two@email.com")
+	tst.ErrorContains(em.GetErrors(), "there can only be one return path email address")
+}
+
+func TestEnvelope_SenderSameAsFrom(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope()
+	em.SetFromAddress("sender@email.com")
+	em.SetSenderAddress("Sender <sender@email.com>")
+	em.SetReturnPathAddress("")
+	em.AddToAddress("receiver@email.com")
+
+	msg := NewMessage()
+	msg.SetSubject("Sender Test")
+	msg.SetTextBody("This is the sender test body.")
+	msg.Seal(em)
+
+	parcel, err := NewParcel(msg.Message())
+	tst.Nil(err)
+	tst.Equal("sender@email.com", parcel.From)
+	tst.NotContains(parcel.Data, "Sender:")
+}
@@ -0,0 +1,104 @@
+package guild
+
+import (
+	"errors"
+	"fmt"
+	pongo "github.com/flosch/pongo2/v6"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The reasons an Envelope refuses an address, for use with errors.Is.
+var (
+	ErrEmptyAddress      = errors.New("empty address")
+	ErrInvalidAddress    = errors.New("invalid email address")
+	ErrTooManyAddresses  = errors.New("only one address is allowed")
+	ErrDisposableAddress = errors.New("disposable email address")
+	ErrRoleAccount       = errors.New("role account")
+	ErrUndeliverable     = errors.New("undeliverable email address")
+)
+
+// AddressError reports an address the Envelope refused. Err is one
+// of the Err*Address reasons above, wrapping the underlying error
+// when there is one.
+type AddressError struct {
+	// Address is the address as it was given.
+	Address string
+	Type    AddressType
+	Reason  string
+	Err     error
+}
+
+func newAddressError(address string, addressType AddressType, err error, format string, args ...any) *AddressError {
+	return &AddressError{
+		Address: address,
+		Type:    addressType,
+		Reason:  fmt.Sprintf(format, args...),
+		Err:     err,
+	}
+}
+
+func (e *AddressError) Error() string {
+	return e.Reason
+}
+
+func (e *AddressError) Unwrap() error {
+	return e.Err
+}
+
+// TemplateError reports a template that could not be parsed or
+// rendered. Part is "subject", "text" or "html"; Line is 0 when the
+// template engine did not say where the problem is.
+type TemplateError struct {
+	Part string
+	Line int
+	Err  error
+}
+
+// textTemplateLine finds the line in a text/template error message,
+// such as "template: subject:2:5: executing ...".
+var textTemplateLine = regexp.MustCompile(`^template: [^:]*:(\d+):`)
+
+func newTemplateError(part string, err error) *TemplateError {
+	templateErr := &TemplateError{Part: part, Err: err}
+
+	var pongoErr *pongo.Error
+	if errors.As(err, &pongoErr) {
+		templateErr.Line = pongoErr.Line
+	} else if match := textTemplateLine.FindStringSubmatch(err.Error()); match != nil {
+		templateErr.Line, _ = strconv.Atoi(match[1])
+	}
+
+	return templateErr
+}
+
+func (e *TemplateError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s template, line %d: %s", e.Part, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s template: %s", e.Part, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// errorList sums up the errors collected by an Envelope or Scribe in a
+// single message, while errors.Is and errors.As still see each one.
+type errorList struct {
+	format string
+	errs   []error
+}
+
+func (e *errorList) Error() string {
+	details := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		details[i] = err.Error()
+	}
+	return fmt.Sprintf(e.format, len(e.errs), strings.Join(details, ", "))
+}
+
+func (e *errorList) Unwrap() []error {
+	return e.errs
+}
@@ -0,0 +1,96 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEnvelope_AddressErrors(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope(ValidationPolicy{RejectRoleAccounts: true})
+	em.SetFromAddress("one@email.com, two@email.com")
+	em.AddToAddress("receiver@email.com")
+	em.AddCcAddress("postmaster@email.com")
+	em.AddBccAddress("bad@@email.com")
+
+	err := em.GetErrors()
+	tst.ErrorContains(err, "3 envelope error(s): there can only be one from email address")
+	tst.ErrorIs(err, ErrTooManyAddresses)
+	tst.ErrorIs(err, ErrRoleAccount)
+	tst.ErrorIs(err, ErrInvalidAddress)
+	tst.NotErrorIs(err, ErrDisposableAddress)
+
+	var addrErr *AddressError
+	tst.True(errors.As(err, &addrErr))
+	tst.Equal("one@email.com, two@email.com", addrErr.Address)
+	tst.Equal(FromAddress, addrErr.Type)
+
+	var roleErr *AddressError
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		if errors.Is(err, ErrRoleAccount) {
+			tst.True(errors.As(err, &roleErr))
+		}
+	}
+	tst.Equal("postmaster@email.com", roleErr.Address)
+	tst.Equal(CcAddress, roleErr.Type)
+	tst.Equal("cc", roleErr.Type.String())
+
+	// the errors can be joined with others and still be told apart
+	joined := errors.Join(errors.New("something else"), err)
+	tst.ErrorIs(joined, ErrRoleAccount)
+
+	tst.Nil(NewEnvelope().GetErrors())
+}
+
+func TestEnvelope_UndeliverableWrapsCause(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope(ValidationPolicy{CheckMX: true, Resolver: stubResolver{"null.test": {{Host: ".", Pref: 0}}}})
+	em.AddToAddress("a@null.test")
+
+	err := em.GetErrors()
+	tst.ErrorIs(err, ErrUndeliverable)
+	tst.ErrorIs(err, ErrNullMX)
+}
+
+func TestScribe_TemplateErrors(t *testing.T) {
+	tst := assert.New(t)
+
+	pongoScribe := NewPongoScribe()
+	pongoScribe.SetSubjectTemplate("Hello {{ name }}")
+	pongoScribe.SetTextBodyTemplate("First line\n{{ name|nosuchfilter }}")
+
+	var templateErr *TemplateError
+	tst.True(errors.As(pongoScribe.GetErrors(), &templateErr))
+	tst.Equal("text", templateErr.Part)
+	tst.Equal(2, templateErr.Line)
+	tst.ErrorContains(pongoScribe.GetErrors(), "Scribe encountered 1 error(s): text template, line 2:")
+
+	goScribe := NewTemplateScribe()
+	_, _ = goScribe.Open()
+	goScribe.SetSubjectTemplate("Hello {{ .Name }}")
+	goScribe.SetHtmlBodyTemplate("<p>\n\n{{ .Missing.Field }}</p>")
+	goScribe.Compose(map[string]any{"Name": "Courier", "Missing": nil})
+
+	tst.True(errors.As(goScribe.GetErrors(), &templateErr))
+	tst.Equal("html", templateErr.Part)
+	tst.Equal(3, templateErr.Line)
+
+	goScribe = NewTemplateScribe()
+	goScribe.SetSubjectTemplate("Hello {{ .Name ")
+	tst.True(errors.As(goScribe.GetErrors(), &templateErr))
+	tst.Equal("subject", templateErr.Part)
+	tst.Equal(1, templateErr.Line)
+
+	// cancellation is not a template problem, but can still be found
+	goScribe = NewTemplateScribe()
+	_, _ = goScribe.Open()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	goScribe.ComposeContext(ctx, map[string]any{})
+	tst.ErrorIs(goScribe.GetErrors(), context.Canceled)
+	tst.False(errors.As(goScribe.GetErrors(), &templateErr))
+}
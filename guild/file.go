@@ -0,0 +1,117 @@
+package guild
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileEnvelope is the JSON sidecar written next to each .eml file.
+type FileEnvelope struct {
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Created    time.Time `json:"created"`
+	Message    string    `json:"message"`
+}
+
+// FileTransport writes each message to a directory instead of sending
+// it: the message itself as <name>.eml and its smtp envelope, which
+// the .eml cannot show (Bcc recipients in particular), as <name>.json.
+// Names sort in the order the messages were written.
+type FileTransport struct {
+	dir string
+	now func() time.Time
+}
+
+// NewFileTransport writes messages to dir, creating it if needed.
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create mail directory: %w", err)
+	}
+	return &FileTransport{dir: dir, now: time.Now}, nil
+}
+
+func (ft *FileTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return ft.SendParcel(parcel)
+}
+
+func (ft *FileTransport) SendParcel(parcel *Parcel) error {
+	return ft.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (ft *FileTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := ft.WriteParcel(ctx, parcel)
+	return err
+}
+
+// WriteParcel writes the message and its sidecar, returning the path
+// of the .eml file.
+func (ft *FileTransport) WriteParcel(ctx context.Context, parcel *Parcel) (string, error) {
+	err := ctx.Err()
+	if err != nil {
+		return "", err
+	}
+
+	now := ft.now()
+	random := make([]byte, 4)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s", now.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(random))
+
+	emlPath := filepath.Join(ft.dir, name+".eml")
+	err = writeFileExclusive(emlPath, []byte(parcel.Data))
+	if err != nil {
+		return "", err
+	}
+
+	sidecar, err := json.MarshalIndent(FileEnvelope{
+		From:       parcel.From,
+		Recipients: parcel.Recipients,
+		Created:    now,
+		Message:    name + ".eml",
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = writeFileExclusive(filepath.Join(ft.dir, name+".json"), sidecar)
+	if err != nil {
+		_ = os.Remove(emlPath)
+		return "", err
+	}
+
+	return emlPath, nil
+}
+
+// writeFileExclusive writes a new file, never replacing an existing one.
+func writeFileExclusive(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+func (ft *FileTransport) Close() error {
+	return nil
+}
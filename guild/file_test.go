@@ -0,0 +1,71 @@
+package guild
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileTransport_WritesEmlAndSidecar(t *testing.T) {
+	tst := assert.New(t)
+
+	dir := filepath.Join(t.TempDir(), "outgoing")
+	transport, err := NewFileTransport(dir)
+	tst.Nil(err)
+
+	// every message gets its own files, even within the same instant
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	transport.now = func() time.Time { return now }
+
+	msg := CreateTestMessage()
+	msg.AddBcc("hidden@email.com")
+	for i := 0; i < 3; i++ {
+		tst.Nil(transport.Send(msg))
+	}
+
+	entries, err := os.ReadDir(dir)
+	tst.Nil(err)
+	tst.Len(entries, 6)
+
+	var emls []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".eml") {
+			emls = append(emls, entry.Name())
+		}
+	}
+	sort.Strings(emls)
+	tst.Len(emls, 3)
+	tst.True(strings.HasPrefix(emls[0], "20230601T120000.000000000Z-"))
+
+	content, err := os.ReadFile(filepath.Join(dir, emls[0]))
+	tst.Nil(err)
+	parsed, err := mail.ReadMessage(strings.NewReader(string(content)))
+	tst.Nil(err)
+	tst.Equal("Courier Test", parsed.Header.Get("Subject"))
+	tst.NotContains(string(content), "hidden@email.com")
+
+	sidecar, err := os.ReadFile(filepath.Join(dir, strings.TrimSuffix(emls[0], ".eml")+".json"))
+	tst.Nil(err)
+	var envelope FileEnvelope
+	tst.Nil(json.Unmarshal(sidecar, &envelope))
+	tst.Equal("sender@email.com", envelope.From)
+	tst.ElementsMatch([]string{"receiver@email.com", "hidden@email.com"}, envelope.Recipients)
+	tst.Equal(emls[0], envelope.Message)
+	tst.True(now.Equal(envelope.Created))
+}
+
+func TestFileTransport_UnwritableDirectory(t *testing.T) {
+	tst := assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "not-a-dir")
+	tst.Nil(os.WriteFile(file, nil, 0o600))
+
+	_, err := NewFileTransport(filepath.Join(file, "outgoing"))
+	tst.ErrorContains(err, "unable to create mail directory")
+}
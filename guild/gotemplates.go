@@ -1,6 +1,7 @@
 package guild
 
 import (
+	"context"
 	"fmt"
 	"github.com/vanng822/go-premailer/premailer"
 	smail "github.com/xhit/go-simple-mail/v2"
@@ -22,7 +23,7 @@ type TemplateScribe struct {
 func (ps *TemplateScribe) createTemplate(name, tmplStr string) *template.Template {
 	tmpl, err := template.New(name).Parse(tmplStr)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError(name, err))
 	}
 	return tmpl
 }
@@ -83,13 +84,14 @@ func (ps *TemplateScribe) HasErrors() bool {
 	return len(ps.errors) > 0
 }
 
+// GetErrors sums up the errors so far in one error, or returns nil
+// when there are none. Template problems are *TemplateErrors, which
+// errors.As can pick out.
 func (ps *TemplateScribe) GetErrors() error {
-	errCount := len(ps.errors)
-	var errDetails []string
-	for _, err := range ps.errors {
-		errDetails = append(errDetails, err.Error())
+	if !ps.HasErrors() {
+		return nil
 	}
-	return fmt.Errorf("Scribe encountered %d error(s): %s", errCount, strings.Join(errDetails, ", "))
+	return &errorList{format: "Scribe encountered %d error(s): %s", errs: ps.errors}
 }
 
 func (ps *TemplateScribe) renderSubject(ctx any) string {
@@ -99,7 +101,7 @@ func (ps *TemplateScribe) renderSubject(ctx any) string {
 	subject := strings.Builder{}
 	err := ps.subjectTemplate.Execute(&subject, ctx)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("subject", err))
 		return ""
 	}
 	return subject.String()
@@ -112,7 +114,7 @@ func (ps *TemplateScribe) renderText(ctx any) string {
 	text := strings.Builder{}
 	err := ps.textTemplate.Execute(&text, ctx)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("text", err))
 		return ""
 	}
 	return text.String()
@@ -125,25 +127,36 @@ func (ps *TemplateScribe) renderHtml(ctx any) string {
 	html := strings.Builder{}
 	err := ps.htmlTemplate.Execute(&html, ctx)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("html", err))
 		return ""
 	}
 
 	premHtml, err := premailer.NewPremailerFromString(html.String(), premailer.NewOptions())
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("html", err))
 		return ""
 	}
 
 	renderedHtml, err := premHtml.Transform()
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("html", err))
 		return ""
 	}
 	return flattenHtml(renderedHtml)
 }
 
 func (ps *TemplateScribe) Compose(ctx ...any) Scribe {
+	return ps.ComposeContext(context.Background(), ctx...)
+}
+
+// ComposeContext is Compose, checking cctx between rendering the
+// subject and each body so that a cancelled request stops early.
+// Cancellation is reported through HasErrors/GetErrors.
+func (ps *TemplateScribe) ComposeContext(cctx context.Context, ctx ...any) Scribe {
+	if ps.cancelled(cctx) {
+		return ps
+	}
+
 	if len(ctx) == 0 {
 		ps.addError(fmt.Errorf("TemplateScribe.Compose must receive a single Context argument."))
 		return ps
@@ -159,8 +172,17 @@ func (ps *TemplateScribe) Compose(ctx ...any) Scribe {
 	}
 
 	subject := ps.renderSubject(pctx)
+	if ps.cancelled(cctx) {
+		return ps
+	}
 	html := ps.renderHtml(pctx)
+	if ps.cancelled(cctx) {
+		return ps
+	}
 	text := ps.renderText(pctx)
+	if ps.cancelled(cctx) {
+		return ps
+	}
 
 	ps.message.SetPriority(ps.highPriority)
 	ps.message.SetSubject(subject)
@@ -174,6 +196,15 @@ func (ps *TemplateScribe) Compose(ctx ...any) Scribe {
 	return ps
 }
 
+func (ps *TemplateScribe) cancelled(cctx context.Context) bool {
+	err := cctx.Err()
+	if err != nil {
+		ps.addError(err)
+		return true
+	}
+	return false
+}
+
 func (ps *TemplateScribe) Seal(envelope *Envelope) Scribe {
 	ps.message.Seal(envelope)
 	return ps
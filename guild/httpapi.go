@@ -0,0 +1,247 @@
+package guild
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxAPIResponse caps how much of a response body is read.
+const maxAPIResponse = 1 << 20
+
+// APIProvider adapts messages to the request shape of an HTTP email API.
+type APIProvider interface {
+	// Endpoint is the URL messages are posted to.
+	Endpoint() string
+	// Encode builds the JSON request body for msg.
+	Encode(msg *APIMessage) ([]byte, error)
+	// Authorize adds the provider's credentials to the request headers.
+	Authorize(header http.Header)
+	// MessageID finds the provider's id for an accepted message in its
+	// response, returning "" when there is none.
+	MessageID(header http.Header, body []byte) string
+}
+
+// HTTPError is a response from an HTTP email API that is not a success.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	// Body is the start of the response body, which usually explains
+	// what was wrong with the request.
+	Body string
+	// RetryAfter is the wait the server asked for, if it did.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("http api returned %s: %s", e.Status, e.Body)
+	}
+	return fmt.Sprintf("http api returned %s", e.Status)
+}
+
+// Temporary reports whether the request may succeed later: when the
+// server is rate limiting (429) or failing (5xx).
+func (e *HTTPError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// retryAfter reads a Retry-After header, given in seconds or as a date.
+func retryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// APIResult is the outcome of a message sent through an HTTP email API.
+type APIResult struct {
+	// MessageID is the provider's id for the message.
+	MessageID  string
+	StatusCode int
+}
+
+// HTTPTransport sends messages through an HTTP email API, for hosts
+// that may only make outbound HTTPS requests. The APIProvider decides
+// what the requests look like. Each message is posted once; wrap the
+// transport in a RetryTransport to retry network errors, 429 and 5xx,
+// which then waits at least as long as any Retry-After header asks.
+type HTTPTransport struct {
+	provider APIProvider
+	endpoint string
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewHTTPTransport(provider APIProvider) *HTTPTransport {
+	return &HTTPTransport{
+		provider: provider,
+		endpoint: provider.Endpoint(),
+		client:   &http.Client{Timeout: 30 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// SetEndpoint replaces the provider's endpoint, e.g. for a regional
+// API host or a test server.
+func (ht *HTTPTransport) SetEndpoint(endpoint string) {
+	ht.endpoint = endpoint
+}
+
+// SetHTTPClient sets the client requests are made with.
+func (ht *HTTPTransport) SetHTTPClient(client *http.Client) {
+	ht.client = client
+}
+
+// Deliver sends the email, returning the provider's id for it.
+func (ht *HTTPTransport) Deliver(msg *smail.Email) (*APIResult, error) {
+	return ht.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext is Deliver, giving up when ctx is cancelled.
+func (ht *HTTPTransport) DeliverContext(ctx context.Context, msg *smail.Email) (*APIResult, error) {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return nil, err
+	}
+	return ht.deliverParcel(ctx, parcel)
+}
+
+func (ht *HTTPTransport) deliverParcel(ctx context.Context, parcel *Parcel) (*APIResult, error) {
+	msg, err := NewAPIMessage(parcel)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.To) > 0 {
+		return ht.deliverMessage(ctx, msg)
+	}
+	return ht.deliverEach(ctx, msg)
+}
+
+// deliverEach posts a message without To recipients, which the APIs
+// refuse, to each of its Cc and Bcc recipients on its own, with their
+// address as To so that none of them sees another. The result is that
+// of the last request. Should some of the requests fail, a VERPError
+// says which recipients were sent the message.
+func (ht *HTTPTransport) deliverEach(ctx context.Context, msg *APIMessage) (*APIResult, error) {
+	recipients := append(append([]*mail.Address(nil), msg.Cc...), msg.Bcc...)
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("message has no recipients")
+	}
+
+	var result *APIResult
+	partial := &VERPError{Failed: map[string]error{}}
+	for _, recipient := range recipients {
+		single := *msg
+		single.Recipients = []string{recipient.Address}
+		single.To, single.Cc, single.Bcc = []*mail.Address{recipient}, nil, nil
+
+		sent, err := ht.deliverMessage(ctx, &single)
+		if err != nil {
+			partial.Failed[recipient.Address] = err
+			continue
+		}
+		result = sent
+		partial.Delivered = append(partial.Delivered, recipient.Address)
+	}
+
+	switch {
+	case len(partial.Failed) == 0:
+		return result, nil
+	case len(recipients) == 1:
+		return nil, partial.Failed[recipients[0].Address]
+	}
+	return result, partial
+}
+
+// deliverMessage posts the message in a single request.
+func (ht *HTTPTransport) deliverMessage(ctx context.Context, msg *APIMessage) (*APIResult, error) {
+	payload, err := ht.provider.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ht.post(ctx, payload)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return result, nil
+}
+
+// post makes a single request.
+func (ht *HTTPTransport) post(ctx context.Context, payload []byte) (*APIResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ht.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	ht.provider.Authorize(req.Header)
+
+	resp, err := ht.client.Do(req)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAPIResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text := strings.TrimSpace(string(body))
+		if len(text) > 512 {
+			text = text[:512] + "..."
+		}
+		return nil, &HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       text,
+			RetryAfter: retryAfter(resp.Header.Get("Retry-After"), ht.now()),
+		}
+	}
+
+	return &APIResult{
+		MessageID:  ht.provider.MessageID(resp.Header, body),
+		StatusCode: resp.StatusCode,
+	}, nil
+}
+
+// Send implements Transport.
+func (ht *HTTPTransport) Send(msg *smail.Email) error {
+	_, err := ht.Deliver(msg)
+	return err
+}
+
+// SendParcel implements Transport.
+func (ht *HTTPTransport) SendParcel(parcel *Parcel) error {
+	return ht.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (ht *HTTPTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := ht.deliverParcel(ctx, parcel)
+	return err
+}
+
+// Close implements Transport.
+func (ht *HTTPTransport) Close() error {
+	ht.client.CloseIdleConnections()
+	return nil
+}
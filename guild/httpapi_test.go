@@ -0,0 +1,380 @@
+package guild
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func CreateTestAPIMessage() *smail.Email {
+	envelope := NewEnvelope()
+	envelope.SetFromAddress("Sender <sender@email.com>")
+	envelope.AddToAddress("receiver@email.com")
+	envelope.AddCcAddress("Copy <cc@email.com>")
+	envelope.AddBccAddress("hidden@email.com")
+
+	msg := NewMessage()
+	msg.SetSubject("Courier Test ✓")
+	msg.SetHtmlBody("<p>This is the html body.</p>")
+	msg.SetTextBody("This is the text body.")
+	msg.AddFile(&smail.File{Name: "report.txt", MimeType: "text/plain", Data: []byte("quarterly numbers")})
+	msg.Seal(envelope)
+	return msg.Message()
+}
+
+// apiStandIn records the requests it receives and answers them with
+// the given responses in turn, repeating the last one.
+type apiStandIn struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	requests  []*http.Request
+	bodies    [][]byte
+	responses []func(http.ResponseWriter)
+}
+
+func newAPIStandIn(t *testing.T, responses ...func(http.ResponseWriter)) *apiStandIn {
+	api := &apiStandIn{responses: responses}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		api.mu.Lock()
+		api.requests = append(api.requests, r)
+		api.bodies = append(api.bodies, body)
+		respond := api.responses[0]
+		if len(api.responses) > 1 {
+			api.responses = api.responses[1:]
+		}
+		api.mu.Unlock()
+
+		respond(w)
+	}))
+	t.Cleanup(api.Close)
+	return api
+}
+
+func (api *apiStandIn) payload(t *testing.T, i int) map[string]any {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	var payload map[string]any
+	err := json.Unmarshal(api.bodies[i], &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func respondWith(status int, header map[string]string, body string) func(http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for name, value := range header {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, body)
+	}
+}
+
+func TestNewAPIMessage(t *testing.T) {
+	tst := assert.New(t)
+
+	parcel, err := NewParcel(CreateTestAPIMessage())
+	tst.Nil(err)
+	msg, err := NewAPIMessage(parcel)
+	tst.Nil(err)
+
+	tst.Equal("Sender", msg.From.Name)
+	tst.Equal("sender@email.com", msg.From.Address)
+	tst.Equal("receiver@email.com", msg.To[0].Address)
+	tst.Equal("Copy", msg.Cc[0].Name)
+	tst.Len(msg.Bcc, 1)
+	tst.Equal("hidden@email.com", msg.Bcc[0].Address)
+	tst.Equal("Courier Test ✓", msg.Subject)
+	tst.Equal("This is the text body.", msg.Text)
+	tst.Equal("<p>This is the html body.</p>", msg.HTML)
+	tst.Len(msg.Attachments, 1)
+	tst.Equal("report.txt", msg.Attachments[0].Filename)
+	tst.Equal([]byte("quarterly numbers"), msg.Attachments[0].Content)
+	tst.NotContains(msg.Headers, "Subject")
+}
+
+func TestNewAPIMessage_FollowsEnvelope(t *testing.T) {
+	tst := assert.New(t)
+
+	parcel, err := NewParcel(CreateTestAPIMessage())
+	tst.Nil(err)
+	parcel.Recipients = []string{"RECEIVER@email.com"}
+
+	// the headers name everyone, but this parcel is for one of them
+	msg, err := NewAPIMessage(parcel)
+	tst.Nil(err)
+	tst.Len(msg.To, 1)
+	tst.Equal("receiver@email.com", msg.To[0].Address)
+	tst.Empty(msg.Cc)
+	tst.Empty(msg.Bcc)
+}
+
+func TestHTTPTransport_VERP(t *testing.T) {
+	tst := assert.New(t)
+
+	api := newAPIStandIn(t, respondWith(http.StatusOK, nil, `{"id": "rs-1"}`))
+	transport := NewHTTPTransport(NewResendProvider("rs-key"))
+	transport.SetEndpoint(api.URL)
+
+	envelope := NewEnvelope()
+	envelope.SetFromAddress("bounces@email.com")
+	envelope.AddToAddresses([]string{"first@email.com", "second@email.com"})
+	msg := NewMessage()
+	msg.SetSubject("Courier Test")
+	msg.SetTextBody("This is the text body.")
+	msg.Seal(envelope)
+
+	tst.Nil(NewVERPTransport(transport).Send(msg.Message()))
+
+	// each recipient is posted their own message, and nobody else's
+	tst.Len(api.requests, 2)
+	var recipients []any
+	for i := range api.requests {
+		to := api.payload(t, i)["to"].([]any)
+		tst.Len(to, 1)
+		recipients = append(recipients, to[0])
+	}
+	tst.ElementsMatch([]any{"<first@email.com>", "<second@email.com>"}, recipients)
+}
+
+func TestHTTPTransport_SendGrid(t *testing.T) {
+	tst := assert.New(t)
+
+	api := newAPIStandIn(t, respondWith(http.StatusAccepted, map[string]string{"X-Message-Id": "sg-123"}, ""))
+	transport := NewHTTPTransport(NewSendGridProvider("sg-key"))
+	transport.SetEndpoint(api.URL)
+
+	result, err := transport.Deliver(CreateTestAPIMessage())
+	tst.Nil(err)
+	tst.Equal("sg-123", result.MessageID)
+
+	tst.Equal("Bearer sg-key", api.requests[0].Header.Get("Authorization"))
+	tst.Equal("application/json", api.requests[0].Header.Get("Content-Type"))
+
+	payload := api.payload(t, 0)
+	tst.Equal(map[string]any{"email": "sender@email.com", "name": "Sender"}, payload["from"])
+	personalization := payload["personalizations"].([]any)[0].(map[string]any)
+	tst.Equal([]any{map[string]any{"email": "hidden@email.com"}}, personalization["bcc"])
+	content := payload["content"].([]any)
+	tst.Equal("text/plain", content[0].(map[string]any)["type"])
+	tst.Equal("text/html", content[1].(map[string]any)["type"])
+	attachment := payload["attachments"].([]any)[0].(map[string]any)
+	tst.Equal("cXVhcnRlcmx5IG51bWJlcnM=", attachment["content"])
+}
+
+func TestHTTPTransport_WithoutTo(t *testing.T) {
+	// how each provider's payload names its To recipients
+	providers := map[string]struct {
+		provider APIProvider
+		to       func(payload map[string]any) []any
+	}{
+		"sendgrid": {NewSendGridProvider("sg-key"), func(payload map[string]any) []any {
+			personalizations := payload["personalizations"].([]any)
+			var to []any
+			for _, address := range personalizations[0].(map[string]any)["to"].([]any) {
+				to = append(to, address.(map[string]any)["email"])
+			}
+			return append(to, len(personalizations)-1, payload["cc"], payload["bcc"])
+		}},
+		"postmark": {NewPostmarkProvider("pm-token"), func(payload map[string]any) []any {
+			return []any{payload["To"], 0, payload["Cc"], payload["Bcc"]}
+		}},
+		"resend": {NewResendProvider("rs-key"), func(payload map[string]any) []any {
+			return append(payload["to"].([]any), 0, payload["cc"], payload["bcc"])
+		}},
+	}
+
+	messages := map[string]string{
+		"bcc only": "From: sender@email.com\r\nSubject: Courier Test\r\n\r\nThis is the text body.\r\n",
+		"cc only":  "From: sender@email.com\r\nCc: first@email.com, second@email.com\r\nSubject: Courier Test\r\n\r\nThis is the text body.\r\n",
+	}
+
+	for name, p := range providers {
+		for kind, data := range messages {
+			t.Run(name+" "+kind, func(t *testing.T) {
+				tst := assert.New(t)
+
+				api := newAPIStandIn(t, respondWith(http.StatusOK, nil, `{}`))
+				transport := NewHTTPTransport(p.provider)
+				transport.SetEndpoint(api.URL)
+
+				err := transport.SendParcel(&Parcel{
+					From:       "sender@email.com",
+					Recipients: []string{"first@email.com", "second@email.com"},
+					Data:       data,
+				})
+				tst.Nil(err)
+
+				// each recipient is posted the message as its only To
+				tst.Len(api.requests, 2)
+				var recipients []any
+				for i := range api.requests {
+					to := p.to(api.payload(t, i))
+					tst.Len(to, 4)
+					tst.Equal([]any{0, nil, nil}, to[1:])
+					recipients = append(recipients, to[0])
+				}
+				if name == "sendgrid" {
+					tst.Equal([]any{"first@email.com", "second@email.com"}, recipients)
+				} else {
+					tst.Equal([]any{"<first@email.com>", "<second@email.com>"}, recipients)
+				}
+			})
+		}
+	}
+}
+
+func TestHTTPTransport_WithoutToPartialFailure(t *testing.T) {
+	tst := assert.New(t)
+
+	api := newAPIStandIn(t,
+		respondWith(http.StatusOK, nil, `{"id": "rs-1"}`),
+		respondWith(http.StatusServiceUnavailable, nil, ""),
+	)
+	transport := NewHTTPTransport(NewResendProvider("rs-key"))
+	transport.SetEndpoint(api.URL)
+
+	err := transport.SendParcel(&Parcel{
+		From:       "sender@email.com",
+		Recipients: []string{"first@email.com", "second@email.com"},
+		Data:       "From: sender@email.com\r\nSubject: Courier Test\r\n\r\nThis is the text body.\r\n",
+	})
+
+	// the first recipient has it, so trying again would send it twice
+	var partial *VERPError
+	tst.True(errors.As(err, &partial))
+	tst.Equal([]string{"first@email.com"}, partial.Delivered)
+	tst.Contains(partial.Failed, "second@email.com")
+	tst.False(IsTransient(err))
+}
+
+func TestHTTPTransport_Postmark(t *testing.T) {
+	tst := assert.New(t)
+
+	api := newAPIStandIn(t, respondWith(http.StatusOK, nil, `{"ErrorCode": 0, "MessageID": "pm-456"}`))
+	transport := NewHTTPTransport(NewPostmarkProvider("pm-token"))
+	transport.SetEndpoint(api.URL)
+
+	result, err := transport.Deliver(CreateTestAPIMessage())
+	tst.Nil(err)
+	tst.Equal("pm-456", result.MessageID)
+	tst.Equal("pm-token", api.requests[0].Header.Get("X-Postmark-Server-Token"))
+
+	payload := api.payload(t, 0)
+	tst.Equal(`"Sender" <sender@email.com>`, payload["From"])
+	tst.Equal("<receiver@email.com>", payload["To"])
+	tst.Equal("<hidden@email.com>", payload["Bcc"])
+	tst.Equal("This is the text body.", payload["TextBody"])
+}
+
+func TestHTTPTransport_Resend(t *testing.T) {
+	tst := assert.New(t)
+
+	api := newAPIStandIn(t, respondWith(http.StatusOK, nil, `{"id": "rs-789"}`))
+	transport := NewHTTPTransport(NewResendProvider("rs-key"))
+	transport.SetEndpoint(api.URL)
+
+	result, err := transport.Deliver(CreateTestAPIMessage())
+	tst.Nil(err)
+	tst.Equal("rs-789", result.MessageID)
+	tst.Equal("Bearer rs-key", api.requests[0].Header.Get("Authorization"))
+	tst.Equal([]any{"<receiver@email.com>"}, api.payload(t, 0)["to"])
+}
+
+func TestHTTPTransport_Generic(t *testing.T) {
+	tst := assert.New(t)
+
+	api := newAPIStandIn(t, respondWith(http.StatusCreated, nil, `{"data": {"id": 42}}`))
+	provider, err := NewGenericProvider(api.URL, `{"sender": {{ .From.Address | json }}, "to": {{ addresses .Bcc | json }}, "subject": {{ .Subject | json }}}`)
+	tst.Nil(err)
+	provider.SetHeader("X-Api-Key", "generic-key")
+	provider.SetMessageIDField("data.id")
+
+	result, err := NewHTTPTransport(provider).Deliver(CreateTestAPIMessage())
+	tst.Nil(err)
+	tst.Equal("42", result.MessageID)
+	tst.Equal("generic-key", api.requests[0].Header.Get("X-Api-Key"))
+	tst.Equal(map[string]any{
+		"sender":  "sender@email.com",
+		"to":      []any{"hidden@email.com"},
+		"subject": "Courier Test ✓",
+	}, api.payload(t, 0))
+
+	provider, err = NewGenericProvider(api.URL, `{"subject": {{ .Subject }}}`)
+	tst.Nil(err)
+	tst.ErrorContains(NewHTTPTransport(provider).Send(CreateTestAPIMessage()), "did not render valid JSON")
+
+	_, err = NewGenericProvider(api.URL, `{{ .Subject `)
+	tst.ErrorContains(err, "unable to parse api payload template")
+}
+
+func TestHTTPTransport_Retries(t *testing.T) {
+	tst := assert.New(t)
+
+	api := newAPIStandIn(t,
+		respondWith(http.StatusTooManyRequests, map[string]string{"Retry-After": "7"}, "slow down"),
+		respondWith(http.StatusBadGateway, nil, ""),
+		respondWith(http.StatusOK, nil, `{"id": "rs-1"}`),
+	)
+	transport := NewHTTPTransport(NewResendProvider("rs-key"))
+	transport.SetEndpoint(api.URL)
+	retry := NewRetryTransport(transport, RetryPolicy{MaxAttempts: 3, InitialDelay: time.Second})
+	var delays []time.Duration
+	retry.sleep = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+
+	err := retry.Send(CreateTestAPIMessage())
+	tst.Nil(err)
+	tst.Len(api.requests, 3)
+	// the wait is as long as the server asked, or the policy's own
+	tst.Equal([]time.Duration{7 * time.Second, time.Second}, delays)
+}
+
+func TestHTTPTransport_Failures(t *testing.T) {
+	tst := assert.New(t)
+
+	// the transport makes a single request, leaving retries to a RetryTransport
+	api := newAPIStandIn(t, respondWith(http.StatusServiceUnavailable, nil, "down for maintenance"))
+	transport := NewHTTPTransport(NewResendProvider("rs-key"))
+	transport.SetEndpoint(api.URL)
+
+	err := transport.Send(CreateTestAPIMessage())
+	tst.EqualError(err, "http api returned 503 Service Unavailable: down for maintenance")
+	tst.True(IsTransient(err))
+	tst.Len(api.requests, 1)
+
+	// client errors are not retried
+	api = newAPIStandIn(t, respondWith(http.StatusUnprocessableEntity, nil, `{"message": "invalid from"}`))
+	transport.SetEndpoint(api.URL)
+
+	err = transport.Send(CreateTestAPIMessage())
+	var httpErr *HTTPError
+	tst.True(errors.As(err, &httpErr))
+	tst.Equal(http.StatusUnprocessableEntity, httpErr.StatusCode)
+	tst.False(IsTransient(err))
+	tst.Len(api.requests, 1)
+}
+
+func TestRetryAfter(t *testing.T) {
+	tst := assert.New(t)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tst.Equal(30*time.Second, retryAfter("30", now))
+	tst.Equal(time.Minute, retryAfter("Mon, 01 Jan 2024 12:01:00 GMT", now))
+	tst.Equal(time.Duration(0), retryAfter("", now))
+	tst.Equal(time.Duration(0), retryAfter("soon", now))
+}
@@ -0,0 +1,376 @@
+package guild
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// GenericProvider builds requests from a text/template, for any JSON
+// email API without an adapter of its own. The template is executed
+// with the *APIMessage and has a "json" function that encodes a value
+// and an "addresses" function that reduces a list of addresses to the
+// bare addresses, so a payload might read:
+//
+//	{"sender": {{ .From.Address | json }}, "to": {{ addresses .To | json }}, "subject": {{ .Subject | json }}}
+type GenericProvider struct {
+	endpoint       string
+	payload        *template.Template
+	header         http.Header
+	messageIDField string
+}
+
+var genericProviderFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+	"addresses": func(addresses []*mail.Address) []string {
+		list := make([]string, len(addresses))
+		for i, address := range addresses {
+			list[i] = address.Address
+		}
+		return list
+	},
+}
+
+// NewGenericProvider posts the payload template, rendered for each
+// message, to endpoint.
+func NewGenericProvider(endpoint, payload string) (*GenericProvider, error) {
+	tmpl, err := template.New("payload").Funcs(genericProviderFuncs).Parse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse api payload template: %w", err)
+	}
+	return &GenericProvider{
+		endpoint:       endpoint,
+		payload:        tmpl,
+		header:         http.Header{},
+		messageIDField: "id",
+	}, nil
+}
+
+// SetHeader adds a header to every request, typically for the
+// credentials, e.g. SetHeader("Authorization", "Bearer <key>").
+func (gp *GenericProvider) SetHeader(name, value string) {
+	gp.header.Set(name, value)
+}
+
+// SetMessageIDField names the field of the JSON response holding the
+// message id, using dots for nested fields, e.g. "data.id".
+func (gp *GenericProvider) SetMessageIDField(field string) {
+	gp.messageIDField = field
+}
+
+func (gp *GenericProvider) Endpoint() string {
+	return gp.endpoint
+}
+
+func (gp *GenericProvider) Encode(msg *APIMessage) ([]byte, error) {
+	var payload bytes.Buffer
+	err := gp.payload.Execute(&payload, msg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to render api payload: %w", err)
+	}
+	if !json.Valid(payload.Bytes()) {
+		return nil, fmt.Errorf("api payload template did not render valid JSON")
+	}
+	return payload.Bytes(), nil
+}
+
+func (gp *GenericProvider) Authorize(header http.Header) {
+	for name, values := range gp.header {
+		header[name] = values
+	}
+}
+
+func (gp *GenericProvider) MessageID(header http.Header, body []byte) string {
+	var value any
+	if json.Unmarshal(body, &value) != nil {
+		return ""
+	}
+	for _, field := range strings.Split(gp.messageIDField, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = object[field]
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// SendGridProvider sends through the SendGrid v3 mail send API.
+type SendGridProvider struct {
+	apiKey string
+}
+
+func NewSendGridProvider(apiKey string) *SendGridProvider {
+	return &SendGridProvider{apiKey: apiKey}
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to,omitempty"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     []byte `json:"content"`
+	Filename    string `json:"filename"`
+	Type        string `json:"type,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyToList      []sendGridAddress         `json:"reply_to_list,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+func sendGridAddresses(addresses []*mail.Address) []sendGridAddress {
+	var list []sendGridAddress
+	for _, address := range addresses {
+		list = append(list, sendGridAddress{Email: address.Address, Name: address.Name})
+	}
+	return list
+}
+
+func (sp *SendGridProvider) Endpoint() string {
+	return "https://api.sendgrid.com/v3/mail/send"
+}
+
+// Encode needs at least one To recipient, which SendGrid insists on;
+// the HTTPTransport sends a message without one to each recipient.
+func (sp *SendGridProvider) Encode(msg *APIMessage) ([]byte, error) {
+	if len(msg.To) == 0 {
+		return nil, fmt.Errorf("sendgrid requires at least one to recipient")
+	}
+
+	request := sendGridRequest{
+		Personalizations: []sendGridPersonalization{{
+			To:  sendGridAddresses(msg.To),
+			Cc:  sendGridAddresses(msg.Cc),
+			Bcc: sendGridAddresses(msg.Bcc),
+		}},
+		From:        sendGridAddress{Email: msg.From.Address, Name: msg.From.Name},
+		ReplyToList: sendGridAddresses(msg.ReplyTo),
+		Subject:     msg.Subject,
+		Headers:     msg.Headers,
+	}
+	// text/plain has to come first
+	if msg.Text != "" {
+		request.Content = append(request.Content, sendGridContent{Type: "text/plain", Value: msg.Text})
+	}
+	if msg.HTML != "" {
+		request.Content = append(request.Content, sendGridContent{Type: "text/html", Value: msg.HTML})
+	}
+	for _, attachment := range msg.Attachments {
+		disposition := "attachment"
+		if attachment.Inline {
+			disposition = "inline"
+		}
+		request.Attachments = append(request.Attachments, sendGridAttachment{
+			Content:     attachment.Content,
+			Filename:    attachment.Filename,
+			Type:        attachment.ContentType,
+			Disposition: disposition,
+			ContentID:   attachment.ContentID,
+		})
+	}
+	return json.Marshal(request)
+}
+
+func (sp *SendGridProvider) Authorize(header http.Header) {
+	header.Set("Authorization", "Bearer "+sp.apiKey)
+}
+
+func (sp *SendGridProvider) MessageID(header http.Header, body []byte) string {
+	return header.Get("X-Message-Id")
+}
+
+// PostmarkProvider sends through the Postmark email API.
+type PostmarkProvider struct {
+	serverToken string
+}
+
+func NewPostmarkProvider(serverToken string) *PostmarkProvider {
+	return &PostmarkProvider{serverToken: serverToken}
+}
+
+type postmarkHeader struct {
+	Name  string
+	Value string
+}
+
+type postmarkAttachment struct {
+	Name        string
+	Content     []byte
+	ContentType string
+	ContentID   string `json:",omitempty"`
+}
+
+type postmarkRequest struct {
+	From        string
+	To          string
+	Cc          string `json:",omitempty"`
+	Bcc         string `json:",omitempty"`
+	ReplyTo     string `json:",omitempty"`
+	Subject     string
+	TextBody    string               `json:",omitempty"`
+	HtmlBody    string               `json:",omitempty"`
+	Headers     []postmarkHeader     `json:",omitempty"`
+	Attachments []postmarkAttachment `json:",omitempty"`
+}
+
+// joinAddresses formats addresses as a comma separated header value.
+func joinAddresses(addresses []*mail.Address) string {
+	list := make([]string, len(addresses))
+	for i, address := range addresses {
+		list[i] = address.String()
+	}
+	return strings.Join(list, ", ")
+}
+
+func (pp *PostmarkProvider) Endpoint() string {
+	return "https://api.postmarkapp.com/email"
+}
+
+func (pp *PostmarkProvider) Encode(msg *APIMessage) ([]byte, error) {
+	request := postmarkRequest{
+		From:     msg.From.String(),
+		To:       joinAddresses(msg.To),
+		Cc:       joinAddresses(msg.Cc),
+		Bcc:      joinAddresses(msg.Bcc),
+		ReplyTo:  joinAddresses(msg.ReplyTo),
+		Subject:  msg.Subject,
+		TextBody: msg.Text,
+		HtmlBody: msg.HTML,
+	}
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		request.Headers = append(request.Headers, postmarkHeader{Name: name, Value: msg.Headers[name]})
+	}
+	for _, attachment := range msg.Attachments {
+		contentID := ""
+		if attachment.Inline {
+			contentID = "cid:" + attachment.ContentID
+		}
+		request.Attachments = append(request.Attachments, postmarkAttachment{
+			Name:        attachment.Filename,
+			Content:     attachment.Content,
+			ContentType: attachment.ContentType,
+			ContentID:   contentID,
+		})
+	}
+	return json.Marshal(request)
+}
+
+func (pp *PostmarkProvider) Authorize(header http.Header) {
+	header.Set("X-Postmark-Server-Token", pp.serverToken)
+}
+
+func (pp *PostmarkProvider) MessageID(header http.Header, body []byte) string {
+	var response struct {
+		MessageID string
+	}
+	_ = json.Unmarshal(body, &response)
+	return response.MessageID
+}
+
+// ResendProvider sends through the Resend email API.
+type ResendProvider struct {
+	apiKey string
+}
+
+func NewResendProvider(apiKey string) *ResendProvider {
+	return &ResendProvider{apiKey: apiKey}
+}
+
+type resendAttachment struct {
+	Filename string `json:"filename"`
+	Content  []byte `json:"content"`
+}
+
+type resendRequest struct {
+	From        string             `json:"from"`
+	To          []string           `json:"to"`
+	Cc          []string           `json:"cc,omitempty"`
+	Bcc         []string           `json:"bcc,omitempty"`
+	ReplyTo     []string           `json:"reply_to,omitempty"`
+	Subject     string             `json:"subject"`
+	Text        string             `json:"text,omitempty"`
+	HTML        string             `json:"html,omitempty"`
+	Headers     map[string]string  `json:"headers,omitempty"`
+	Attachments []resendAttachment `json:"attachments,omitempty"`
+}
+
+func formatAddresses(addresses []*mail.Address) []string {
+	var list []string
+	for _, address := range addresses {
+		list = append(list, address.String())
+	}
+	return list
+}
+
+func (rp *ResendProvider) Endpoint() string {
+	return "https://api.resend.com/emails"
+}
+
+func (rp *ResendProvider) Encode(msg *APIMessage) ([]byte, error) {
+	request := resendRequest{
+		From:    msg.From.String(),
+		To:      formatAddresses(msg.To),
+		Cc:      formatAddresses(msg.Cc),
+		Bcc:     formatAddresses(msg.Bcc),
+		ReplyTo: formatAddresses(msg.ReplyTo),
+		Subject: msg.Subject,
+		Text:    msg.Text,
+		HTML:    msg.HTML,
+		Headers: msg.Headers,
+	}
+	for _, attachment := range msg.Attachments {
+		request.Attachments = append(request.Attachments, resendAttachment{
+			Filename: attachment.Filename,
+			Content:  attachment.Content,
+		})
+	}
+	return json.Marshal(request)
+}
+
+func (rp *ResendProvider) Authorize(header http.Header) {
+	header.Set("Authorization", "Bearer "+rp.apiKey)
+}
+
+func (rp *ResendProvider) MessageID(header http.Header, body []byte) string {
+	var response struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(body, &response)
+	return response.ID
+}
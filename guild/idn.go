@@ -0,0 +1,142 @@
+package guild
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/idna"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrSMTPUTF8Required is returned for an address whose local part is
+// not ASCII when the server does not offer SMTPUTF8 (RFC 6531), as
+// there is no ASCII form of it to fall back to.
+var ErrSMTPUTF8Required = errors.New("address needs SMTPUTF8, which the server does not offer")
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// asciiDomain returns the domain with any internationalized labels in
+// their punycode (A-label) form, as used in DNS.
+func asciiDomain(domain string) (string, error) {
+	if isASCII(domain) {
+		return domain, nil
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("'%s' is not a valid domain: %w", domain, err)
+	}
+	return ascii, nil
+}
+
+// asciiAddress returns the address with its domain in punycode, for
+// servers that do not speak SMTPUTF8. An address whose local part is
+// not ASCII cannot be converted.
+func asciiAddress(address string) (string, error) {
+	if isASCII(address) {
+		return address, nil
+	}
+	at := strings.LastIndex(address, "@")
+	if at < 0 || !isASCII(address[:at]) {
+		return "", fmt.Errorf("'%s': %w", address, ErrSMTPUTF8Required)
+	}
+	domain, err := asciiDomain(address[at+1:])
+	if err != nil {
+		return "", err
+	}
+	return address[:at+1] + domain, nil
+}
+
+// headerAddress renders the address for a message header. Where the
+// local part is ASCII the domain is given in punycode, so that the
+// header stays ASCII and can travel through any server; the display
+// name is RFC 2047 encoded as needed.
+func headerAddress(address mail.Address) string {
+	if ascii, err := asciiAddress(address.Address); err == nil {
+		address.Address = ascii
+	}
+	return address.String()
+}
+
+// addressHeaders are the headers that hold addresses.
+var addressHeaders = map[string]bool{
+	"From":     true,
+	"Sender":   true,
+	"Reply-To": true,
+	"To":       true,
+	"Cc":       true,
+	// added by a Safeguard
+	"X-Original-To": true,
+}
+
+// utf8AddressHeaders undoes the encoded words that go-simple-mail wraps
+// around an address header holding an internationalized address, which
+// no mail client would read as an address. Those headers are written
+// in UTF-8 instead, as RFC 6532 allows, with the display names still
+// RFC 2047 encoded. Headers with ASCII addresses are left alone.
+func utf8AddressHeaders(raw string) string {
+	end := strings.Index(raw, "\r\n\r\n")
+	if end < 0 {
+		return raw
+	}
+
+	var fields []string
+	for _, line := range strings.Split(raw[:end], "\r\n") {
+		if len(fields) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		fields = append(fields, line)
+	}
+
+	changed := false
+	for i, field := range fields {
+		name, value, ok := strings.Cut(field, ":")
+		if !ok || !addressHeaders[name] || !strings.Contains(value, "=?") {
+			continue
+		}
+		rendered, ok := utf8AddressList(strings.ReplaceAll(value, "\r\n", ""))
+		if ok {
+			fields[i] = name + ": " + rendered
+			changed = true
+		}
+	}
+
+	if !changed {
+		return raw
+	}
+	return strings.Join(fields, "\r\n") + raw[end:]
+}
+
+// utf8AddressList decodes a header value that was encoded as a whole,
+// returning the addresses in it rendered one by one. ok is false when
+// the value was not such a wrapped internationalized address list.
+func utf8AddressList(value string) (string, bool) {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(strings.TrimSpace(value))
+	if err != nil {
+		return "", false
+	}
+	addresses, err := mail.ParseAddressList(decoded)
+	if err != nil {
+		return "", false
+	}
+
+	international := false
+	rendered := make([]string, len(addresses))
+	for i, address := range addresses {
+		international = international || !isASCII(address.Address)
+		rendered[i] = address.String()
+	}
+	if !international {
+		return "", false
+	}
+	return strings.Join(rendered, ",\r\n "), true
+}
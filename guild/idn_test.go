@@ -0,0 +1,109 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func CreateTestIDNMessage(recipients ...string) *smail.Email {
+	envelope := NewEnvelope(ValidationPolicy{})
+	envelope.SetFromAddress("Jöran Müller <sender@bücher.de>")
+	envelope.AddToAddresses(recipients)
+
+	msg := NewMessage()
+	msg.SetSubject("Courier Test")
+	msg.SetTextBody("This is the courier test body.")
+	msg.Seal(envelope)
+	return msg.Message()
+}
+
+func TestEnvelope_InternationalHeaders(t *testing.T) {
+	tst := assert.New(t)
+
+	parcel, err := NewParcel(CreateTestIDNMessage("δοκιμή@παράδειγμα.δοκιμή"))
+	tst.Nil(err)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(parcel.Data))
+	tst.Nil(err)
+
+	// an ASCII local part gets a punycode domain and an encoded name
+	tst.Equal("=?utf-8?q?J=C3=B6ran_M=C3=BCller?= <sender@xn--bcher-kva.de>", parsed.Header.Get("From"))
+	from, err := parsed.Header.AddressList("From")
+	tst.Nil(err)
+	tst.Equal("Jöran Müller", from[0].Name)
+
+	// an internationalized local part is written in UTF-8
+	tst.Equal("<δοκιμή@παράδειγμα.δοκιμή>", parsed.Header.Get("To"))
+	tst.Equal([]string{"δοκιμή@παράδειγμα.δοκιμή"}, parcel.Recipients)
+}
+
+func TestEnvelope_InvalidInternationalDomain(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope()
+	em.AddToAddress("someone@bücher.de")
+	tst.False(em.HasErrors())
+
+	// a zero width joiner is not allowed in a domain label
+	em.AddToAddress("someone@ab\u200dü.de")
+	tst.ErrorIs(em.GetErrors(), ErrInvalidAddress)
+	tst.ErrorContains(em.GetErrors(), "is not a valid domain")
+}
+
+func TestUTF8AddressHeaders_LeavesASCIIAlone(t *testing.T) {
+	tst := assert.New(t)
+
+	raw := "From: =?utf-8?q?J=C3=B6ran?= <sender@email.com>\r\nSubject: =?UTF-8?Q?Gr=C3=BC=C3=9Fe?=\r\n\r\nbody\r\n"
+	tst.Equal(raw, utf8AddressHeaders(raw))
+}
+
+func TestCourier_SMTPUTF8(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferSMTPUTF8 = true
+	})
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	_, err := courier.Deliver(CreateTestIDNMessage("δοκιμή@παράδειγμα.δοκιμή", "jane@bücher.de"))
+	tst.Nil(err)
+
+	msg := srv.WaitForMessages(t, 1)[0]
+	tst.True(msg.SMTPUTF8)
+	// the envelope gives punycode domains wherever it can
+	tst.Equal("sender@xn--bcher-kva.de", msg.From)
+	tst.ElementsMatch([]string{"δοκιμή@παράδειγμα.δοκιμή", "jane@xn--bcher-kva.de"}, msg.To)
+}
+
+func TestCourier_PunycodeWithoutSMTPUTF8(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	result, err := courier.deliverParcel(context.Background(), &Parcel{
+		From:       "sender@bücher.de",
+		Recipients: []string{"jane@bücher.de"},
+		Data:       "Subject: Courier Test\r\n\r\nThis is the courier test body.\r\n",
+	})
+	tst.Nil(err)
+	// the result names the recipient as it was given
+	tst.Equal("jane@bücher.de", result.Recipients[0].Recipient)
+
+	msg := srv.WaitForMessages(t, 1)[0]
+	tst.False(msg.SMTPUTF8)
+	tst.Equal("sender@xn--bcher-kva.de", msg.From)
+	tst.Equal([]string{"jane@xn--bcher-kva.de"}, msg.To)
+
+	// there is no ASCII form of an internationalized local part
+	_, err = courier.Deliver(CreateTestIDNMessage("δοκιμή@παράδειγμα.δοκιμή"))
+	tst.True(errors.Is(err, ErrSMTPUTF8Required))
+	tst.False(IsTransient(err))
+	tst.Len(srv.Messages(), 1)
+}
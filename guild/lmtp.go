@@ -0,0 +1,265 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// LMTPTransport delivers messages with LMTP (RFC 2033), the protocol
+// mail stores such as Dovecot and Cyrus take local deliveries over.
+// Unlike smtp, the server answers the message data once for every
+// accepted recipient, so a message can be stored for some recipients
+// and refused for others; the DeliveryResult records which.
+type LMTPTransport struct {
+	network         string
+	address         string
+	lhlo            string
+	connectTimeout  time.Duration
+	recipientPolicy RecipientPolicy
+	logger          *slog.Logger
+}
+
+// NewLMTPTransport talks LMTP to address on network, which is "tcp"
+// for a host:port or "unix" for the path of a Unix socket.
+func NewLMTPTransport(network, address string) *LMTPTransport {
+	return &LMTPTransport{
+		network:        network,
+		address:        address,
+		lhlo:           "localhost",
+		connectTimeout: 10 * time.Second,
+	}
+}
+
+// SetRecipientPolicy sets whether a message is still sent when some,
+// but not all, of its recipients are refused at RCPT TO, and whether
+// refusals after the message data are reported as an error.
+func (lt *LMTPTransport) SetRecipientPolicy(policy RecipientPolicy) {
+	lt.recipientPolicy = policy
+}
+
+// SetLogger has every LMTP conversation logged at debug level, and the
+// recipients that were refused logged at warn level when the message
+// was stored for the others without an error. A nil logger turns
+// logging off.
+func (lt *LMTPTransport) SetLogger(logger *slog.Logger) {
+	lt.logger = logger
+}
+
+// SetConnectTimeout sets how long connecting and the greeting may
+// take. Zero means no limit beyond that of the context.
+func (lt *LMTPTransport) SetConnectTimeout(timeout time.Duration) {
+	lt.connectTimeout = timeout
+}
+
+// connect returns a session that has been greeted with LHLO, and
+// whether the server offered SMTPUTF8.
+func (lt *LMTPTransport) connect(ctx context.Context) (*session, *textproto.Conn, bool, error) {
+	dialer := &net.Dialer{Timeout: lt.connectTimeout}
+	conn, err := dialer.DialContext(ctx, lt.network, lt.address)
+	if err != nil {
+		return nil, nil, false, contextError(ctx, fmt.Errorf("connection to %s failed: %w", lt.address, err))
+	}
+
+	s := &session{conn: conn}
+	if lt.logger != nil {
+		s.transcript = newTranscript(lt.logger, lt.address)
+		conn = s.transcript.tapConn(conn)
+	}
+
+	stop := s.watch(ctx, lt.connectTimeout)
+	defer stop()
+
+	text := textproto.NewConn(conn)
+	var lhlo string
+	_, _, err = text.ReadResponse(220)
+	if err == nil {
+		lhlo, err = lmtpReply(text, 250, "LHLO %s", lt.lhlo)
+	}
+	if err != nil {
+		_ = text.Close()
+		return nil, nil, false, contextError(ctx, replyError(err))
+	}
+
+	// the first line greets, the rest name an extension each
+	smtpUTF8 := false
+	for _, line := range strings.Split(lhlo, "\n")[1:] {
+		keyword, _, _ := strings.Cut(line, " ")
+		smtpUTF8 = smtpUTF8 || strings.EqualFold(keyword, "SMTPUTF8")
+	}
+
+	return s, text, smtpUTF8, nil
+}
+
+// lmtpCmd sends a command and reads its reply.
+func lmtpCmd(text *textproto.Conn, expect int, format string, args ...any) error {
+	_, err := lmtpReply(text, expect, format, args...)
+	return err
+}
+
+// lmtpReply sends a command and returns the text of its reply.
+func lmtpReply(text *textproto.Conn, expect int, format string, args ...any) (string, error) {
+	id, err := text.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, message, err := text.ReadResponse(expect)
+	return message, err
+}
+
+// lmtpTransact runs a single LMTP mail transaction. Refusals, at RCPT
+// TO or after the data, are recorded per recipient and returned as a
+// *RecipientError as the policy requires.
+func lmtpTransact(text *textproto.Conn, smtpUTF8 bool, policy RecipientPolicy, from string, recipients []string, body string) (*DeliveryResult, error) {
+	result := &DeliveryResult{}
+
+	from, rcptTo, err := envelopeFor(smtpUTF8, from, recipients)
+	if err != nil {
+		return result, err
+	}
+
+	// ask for SMTPUTF8 whenever it is offered, as net/smtp does
+	mailFrom := "MAIL FROM:<%s>"
+	if smtpUTF8 {
+		mailFrom += " SMTPUTF8"
+	}
+	err = lmtpCmd(text, 250, mailFrom, from)
+	if err != nil {
+		return result, replyError(err)
+	}
+
+	var accepted []int
+	for i, recipient := range recipients {
+		err = lmtpCmd(text, 25, "RCPT TO:<%s>", rcptTo[i])
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			result.add(recipient, newSMTPError(protoErr))
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		accepted = append(accepted, len(result.Recipients))
+		result.add(recipient, nil)
+	}
+
+	if len(accepted) == 0 || (len(accepted) < len(recipients) && policy == RequireAllRecipients) {
+		return result, &RecipientError{Result: result}
+	}
+
+	err = lmtpCmd(text, 354, "DATA")
+	if err != nil {
+		return result, replyError(err)
+	}
+
+	w := text.DotWriter()
+	_, err = w.Write([]byte(body))
+	if err != nil {
+		_ = w.Close()
+		return result, err
+	}
+	err = w.Close()
+	if err != nil {
+		return result, err
+	}
+
+	// one reply for each accepted recipient, in the order they were given
+	refused := 0
+	for _, i := range accepted {
+		_, _, err = text.ReadResponse(250)
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			result.Recipients[i] = newRecipientResult(result.Recipients[i].Recipient, newSMTPError(protoErr))
+			refused++
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Sent = true
+	}
+
+	if !result.Sent || (refused > 0 && policy == RequireAllRecipients) {
+		return result, &RecipientError{Result: result}
+	}
+	return result, nil
+}
+
+// Deliver delivers the email over a one-off connection. The result
+// lists the server's answer for each recipient.
+func (lt *LMTPTransport) Deliver(msg *smail.Email) (*DeliveryResult, error) {
+	return lt.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext is Deliver, abandoning the connection when
+// ctx is cancelled or its deadline passes.
+func (lt *LMTPTransport) DeliverContext(ctx context.Context, msg *smail.Email) (*DeliveryResult, error) {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return nil, err
+	}
+	return lt.deliverParcel(ctx, parcel)
+}
+
+func (lt *LMTPTransport) deliverParcel(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	s, text, smtpUTF8, err := lt.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = text.Close()
+	}()
+
+	stop := s.watch(ctx, 0)
+	defer stop()
+
+	result, err := lmtpTransact(text, smtpUTF8, lt.recipientPolicy, parcel.From, parcel.Recipients, parcel.Data)
+	result.Host = lt.address
+	if err != nil && !result.Sent {
+		return result, contextError(ctx, err)
+	}
+
+	_ = lmtpCmd(text, 221, "QUIT")
+
+	if err == nil {
+		logRefused(lt.logger, result)
+	}
+	return result, err
+}
+
+// Send implements Transport.
+func (lt *LMTPTransport) Send(msg *smail.Email) error {
+	_, err := lt.Deliver(msg)
+	return err
+}
+
+// SendParcel implements Transport.
+func (lt *LMTPTransport) SendParcel(parcel *Parcel) error {
+	return lt.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (lt *LMTPTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := lt.deliverParcel(ctx, parcel)
+	return err
+}
+
+// DeliverParcelContext implements ResultTransport.
+func (lt *LMTPTransport) DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	return lt.deliverParcel(ctx, parcel)
+}
+
+// Close implements Transport. Every delivery uses its own connection,
+// so there is nothing to release.
+func (lt *LMTPTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,171 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLMTPTransport_Deliver(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+	})
+
+	result, err := NewLMTPTransport("tcp", srv.Addr()).Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.True(result.Sent)
+	tst.Equal(srv.Addr(), result.Host)
+
+	msg := srv.WaitForMessages(t, 1)[0]
+	tst.Equal("sender@email.com", msg.From)
+	tst.Equal([]string{"receiver@email.com"}, msg.To)
+	msg.AssertSubject(t, "Courier Test")
+
+	// an smtp client is turned away
+	_, err = CreateTestCourier(srv, EncryptionNone).Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "500")
+}
+
+func TestLMTPTransport_UnixSocket(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+		s.UnixSocket = true
+	})
+
+	tst.Nil(NewLMTPTransport("unix", srv.Addr()).Send(CreateTestMessage()))
+	srv.WaitForMessages(t, 1)
+}
+
+func TestLMTPTransport_PerRecipientReplies(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMessage, Recipient: "cc@email.com", Reply: "452 4.2.2 Mailbox full"})
+	})
+
+	msg := CreateTestMessage()
+	msg.AddCc("cc@email.com")
+	msg.AddBcc("bcc@email.com")
+
+	transport := NewLMTPTransport("tcp", srv.Addr())
+	result, err := transport.Deliver(msg)
+
+	var rcptErr *RecipientError
+	tst.True(errors.As(err, &rcptErr))
+	tst.True(result.Sent)
+	tst.Len(result.Accepted(), 2)
+	tst.Len(result.Deferred(), 1)
+	tst.Equal("cc@email.com", result.Deferred()[0].Recipient)
+	tst.Equal("4.2.2", result.Deferred()[0].Reply.EnhancedCode)
+	// the others have the message already, so it must not be retried
+	tst.False(IsTransient(err))
+
+	delivered := srv.WaitForMessages(t, 1)[0]
+	tst.Equal([]string{"receiver@email.com", "bcc@email.com"}, delivered.To)
+
+	// the any policy is content with a partial delivery
+	transport.SetRecipientPolicy(RequireAnyRecipient)
+	result, err = transport.Deliver(msg)
+	tst.Nil(err)
+	tst.Len(result.Deferred(), 1)
+}
+
+func TestLMTPTransport_AllRefused(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMessage, Reply: "451 4.3.0 Temporary failure"})
+	})
+
+	transport := NewLMTPTransport("tcp", srv.Addr())
+	transport.SetRecipientPolicy(RequireAnyRecipient)
+	result, err := transport.Deliver(CreateTestMessage())
+
+	var rcptErr *RecipientError
+	tst.True(errors.As(err, &rcptErr))
+	tst.False(result.Sent)
+	tst.True(IsTransient(err))
+	tst.Empty(srv.Messages())
+}
+
+func TestLMTPTransport_RcptRefused(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Reply: "550 5.1.1 No such user"})
+	})
+
+	result, err := NewLMTPTransport("tcp", srv.Addr()).Deliver(CreateTestMessage())
+
+	var rcptErr *RecipientError
+	tst.True(errors.As(err, &rcptErr))
+	tst.Len(result.Rejected(), 1)
+	tst.False(IsTransient(err))
+}
+
+func TestLMTPTransport_SMTPUTF8(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+		s.OfferSMTPUTF8 = true
+	})
+
+	_, err := NewLMTPTransport("tcp", srv.Addr()).Deliver(CreateTestIDNMessage("δοκιμή@παράδειγμα.δοκιμή", "jane@bücher.de"))
+	tst.Nil(err)
+
+	msg := srv.WaitForMessages(t, 1)[0]
+	tst.True(msg.SMTPUTF8)
+	tst.ElementsMatch([]string{"δοκιμή@παράδειγμα.δοκιμή", "jane@xn--bcher-kva.de"}, msg.To)
+}
+
+func TestLMTPTransport_PunycodeWithoutSMTPUTF8(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+	})
+	transport := NewLMTPTransport("tcp", srv.Addr())
+
+	result, err := transport.deliverParcel(context.Background(), &Parcel{
+		From:       "sender@bücher.de",
+		Recipients: []string{"jane@bücher.de"},
+		Data:       "Subject: Courier Test\r\n\r\nThis is the courier test body.\r\n",
+	})
+	tst.Nil(err)
+	tst.Equal("jane@bücher.de", result.Recipients[0].Recipient)
+
+	msg := srv.WaitForMessages(t, 1)[0]
+	tst.False(msg.SMTPUTF8)
+	tst.Equal("sender@xn--bcher-kva.de", msg.From)
+	tst.Equal([]string{"jane@xn--bcher-kva.de"}, msg.To)
+
+	_, err = transport.Deliver(CreateTestIDNMessage("δοκιμή@παράδειγμα.δοκιμή"))
+	tst.True(errors.Is(err, ErrSMTPUTF8Required))
+	tst.Len(srv.Messages(), 1)
+}
+
+func TestLMTPTransport_Transcript(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+	})
+	logger, output := CreateTestLogger()
+	transport := NewLMTPTransport("tcp", srv.Addr())
+	transport.SetLogger(logger)
+
+	tst.Nil(transport.Send(CreateTestMessage()))
+	tst.Contains(output.String(), `direction=C line="LHLO localhost"`)
+	tst.Contains(output.String(), `direction=C line="RCPT TO:<receiver@email.com>"`)
+	tst.Contains(output.String(), `direction=S line="250 2.1.5 <receiver@email.com> delivered"`)
+}
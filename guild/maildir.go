@@ -0,0 +1,144 @@
+package guild
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maildirCounter makes names unique among deliveries by this process.
+var maildirCounter uint64
+
+// MaildirTransport delivers messages into a Maildir, the way a local
+// delivery agent would: the message is written to tmp/ and renamed into
+// new/ once complete, so readers never see a partial message. It adds a
+// Return-Path header for the envelope sender, and a Delivered-To header
+// for the mailbox owner when one is set, and stores the message with
+// bare line feeds as Maildir readers expect. The envelope recipients
+// are not written, as that would give away the Bcc recipients.
+type MaildirTransport struct {
+	dir      string
+	owner    string
+	hostname string
+	now      func() time.Time
+}
+
+// NewMaildirTransport delivers into the Maildir at dir, creating its
+// tmp, new and cur sub directories if needed.
+func NewMaildirTransport(dir string) (*MaildirTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o700)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create maildir: %w", err)
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	// '/' and ':' are not allowed in the name, see the maildir specification
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	return &MaildirTransport{dir: dir, hostname: hostname, now: time.Now}, nil
+}
+
+// SetOwner sets the address of the mailbox the Maildir belongs to,
+// which is stamped on every message as its Delivered-To header.
+func (mt *MaildirTransport) SetOwner(address string) {
+	mt.owner = address
+}
+
+// uniqueName returns a name in the modern maildir format:
+// <seconds>.M<microseconds>P<pid>Q<counter>R<random>.<hostname>
+func (mt *MaildirTransport) uniqueName() (string, error) {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	now := mt.now()
+	return fmt.Sprintf(
+		"%d.M%dP%dQ%dR%s.%s",
+		now.Unix(),
+		now.Nanosecond()/1000,
+		os.Getpid(),
+		atomic.AddUint64(&maildirCounter, 1),
+		hex.EncodeToString(random),
+		mt.hostname,
+	), nil
+}
+
+func (mt *MaildirTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return mt.SendParcel(parcel)
+}
+
+func (mt *MaildirTransport) SendParcel(parcel *Parcel) error {
+	return mt.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (mt *MaildirTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := mt.WriteParcel(ctx, parcel)
+	return err
+}
+
+// WriteParcel writes the message into new/ and returns its path.
+func (mt *MaildirTransport) WriteParcel(ctx context.Context, parcel *Parcel) (string, error) {
+	err := ctx.Err()
+	if err != nil {
+		return "", err
+	}
+
+	name, err := mt.uniqueName()
+	if err != nil {
+		return "", err
+	}
+
+	var content strings.Builder
+	content.WriteString("Return-Path: <" + parcel.From + ">\n")
+	if mt.owner != "" {
+		content.WriteString("Delivered-To: " + mt.owner + "\n")
+	}
+	content.WriteString(strings.ReplaceAll(parcel.Data, "\r\n", "\n"))
+
+	tmpPath := filepath.Join(mt.dir, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(content.String())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	newPath := filepath.Join(mt.dir, "new", name)
+	err = os.Rename(tmpPath, newPath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	return newPath, nil
+}
+
+func (mt *MaildirTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package guild
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMaildirTransport_Deliver(t *testing.T) {
+	tst := assert.New(t)
+
+	dir := filepath.Join(t.TempDir(), "Maildir")
+	transport, err := NewMaildirTransport(dir)
+	tst.Nil(err)
+	transport.hostname = `mail\072host`
+
+	msg := CreateTestMessage()
+	msg.AddBcc("hidden@email.com")
+	parcel, err := NewParcel(msg)
+	tst.Nil(err)
+
+	path, err := transport.WriteParcel(context.Background(), parcel)
+	tst.Nil(err)
+	tst.Equal(filepath.Join(dir, "new"), filepath.Dir(path))
+	tst.Regexp(regexp.MustCompile(`^\d+\.M\d+P\d+Q\d+R[0-9a-f]{16}\.mail\\072host$`), filepath.Base(path))
+
+	for _, sub := range []string{"tmp", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		tst.Nil(err)
+		tst.Len(entries, 0, sub)
+	}
+
+	content, err := os.ReadFile(path)
+	tst.Nil(err)
+	tst.NotContains(string(content), "\r\n")
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(content)))
+	tst.Nil(err)
+	tst.Equal("<sender@email.com>", parsed.Header.Get("Return-Path"))
+	tst.Empty(parsed.Header["Delivered-To"])
+	tst.Equal("Courier Test", parsed.Header.Get("Subject"))
+	// a Bcc recipient is never written down
+	tst.NotContains(string(content), "hidden@email.com")
+
+	transport.SetOwner("owner@email.com")
+	path, err = transport.WriteParcel(context.Background(), parcel)
+	tst.Nil(err)
+	content, err = os.ReadFile(path)
+	tst.Nil(err)
+	parsed, err = mail.ReadMessage(strings.NewReader(string(content)))
+	tst.Nil(err)
+	tst.Equal([]string{"owner@email.com"}, parsed.Header["Delivered-To"])
+	tst.NotContains(string(content), "hidden@email.com")
+
+	// names stay unique however quickly messages arrive
+	for i := 0; i < 20; i++ {
+		tst.Nil(transport.Send(CreateTestMessage()))
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "new"))
+	tst.Nil(err)
+	tst.Len(entries, 22)
+}
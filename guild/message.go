@@ -88,5 +88,14 @@ func (c *Message) Message() *smail.Email {
 
 // String returns the raw email text.
 func (c *Message) String() string {
-	return c.email.GetMessage()
+	return utf8AddressHeaders(c.email.GetMessage())
+}
+
+// rawMessage returns the RFC 5322 text of the email, preferring the
+// DKIM signed copy when there is one.
+func rawMessage(email *smail.Email) string {
+	if email.DkimMsg != "" {
+		return email.DkimMsg
+	}
+	return utf8AddressHeaders(email.GetMessage())
 }
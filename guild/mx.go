@@ -0,0 +1,377 @@
+package guild
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the mail exchangers of a domain. *net.Resolver
+// satisfies it; tests can stub it.
+type Resolver interface {
+	LookupMX(ctx context.Context, domain string) ([]*net.MX, error)
+}
+
+// ErrNullMX is returned for domains that publish a null MX record
+// (RFC 7505), announcing that they accept no mail at all.
+var ErrNullMX = errors.New("domain does not accept mail (null MX)")
+
+// DomainResult is the outcome of delivering to the recipients at one
+// domain. Result comes from the last host that was talked to, and is
+// nil when none got as far as a mail transaction.
+type DomainResult struct {
+	Domain     string
+	Recipients []string
+	Result     *DeliveryResult
+	Err        error
+}
+
+// MXResult lists the outcome for each recipient domain.
+type MXResult struct {
+	Domains []DomainResult
+}
+
+// Delivered returns the domains that took the message.
+func (r *MXResult) Delivered() []DomainResult {
+	var delivered []DomainResult
+	for _, domain := range r.Domains {
+		if domain.Err == nil {
+			delivered = append(delivered, domain)
+		}
+	}
+	return delivered
+}
+
+// Failed returns the domains that did not take the message.
+func (r *MXResult) Failed() []DomainResult {
+	var failed []DomainResult
+	for _, domain := range r.Domains {
+		if domain.Err != nil {
+			failed = append(failed, domain)
+		}
+	}
+	return failed
+}
+
+// MXError is returned when the message could not be delivered to
+// every recipient domain. It unwraps to the error of each domain.
+type MXError struct {
+	Result *MXResult
+}
+
+func (e *MXError) Error() string {
+	failed := e.Result.Failed()
+	details := make([]string, len(failed))
+	for i, domain := range failed {
+		details[i] = fmt.Sprintf("%s: %s", domain.Domain, domain.Err)
+	}
+	return fmt.Sprintf(
+		"%d of %d domain(s) failed:\n%s",
+		len(failed),
+		len(e.Result.Domains),
+		strings.Join(details, "\n"),
+	)
+}
+
+func (e *MXError) Unwrap() []error {
+	var errs []error
+	for _, domain := range e.Result.Failed() {
+		errs = append(errs, domain.Err)
+	}
+	return errs
+}
+
+// Temporary reports whether every domain failed transiently. Once a
+// domain has taken the message it is never temporary, as sending it
+// again would deliver it there twice.
+func (e *MXError) Temporary() bool {
+	if len(e.Result.Delivered()) > 0 {
+		return false
+	}
+	for _, domain := range e.Result.Failed() {
+		if !IsTransient(domain.Err) {
+			return false
+		}
+	}
+	return true
+}
+
+// MXTransport delivers straight to the mail exchangers of each
+// recipient domain, for systems without a relay. Recipients are
+// grouped by domain, and each domain's MX hosts are tried in order of
+// preference until one takes the message or refuses it permanently.
+// A domain without MX records is tried at its own address, as RFC 5321
+// asks. STARTTLS is used whenever a host offers it; should it fail, the
+// message goes to the same host unencrypted, or, with a tls.Config that
+// verifies certificates, to the next host.
+type MXTransport struct {
+	resolver        Resolver
+	port            int
+	helo            string
+	tlsConfig       *tls.Config
+	connectTimeout  time.Duration
+	recipientPolicy RecipientPolicy
+	dkim            *DKIMSigner
+	logger          *slog.Logger
+}
+
+func NewMXTransport() *MXTransport {
+	helo, err := os.Hostname()
+	if err != nil {
+		helo = "localhost"
+	}
+	return &MXTransport{
+		resolver: net.DefaultResolver,
+		port:     25,
+		helo:     helo,
+		// opportunistic TLS (RFC 7435): encrypt where possible, without
+		// refusing hosts whose certificates cannot be verified
+		tlsConfig:      &tls.Config{InsecureSkipVerify: true},
+		connectTimeout: 30 * time.Second,
+	}
+}
+
+// SetResolver sets where MX records are looked up.
+func (mt *MXTransport) SetResolver(resolver Resolver) {
+	mt.resolver = resolver
+}
+
+// SetPort sets the port mail exchangers are connected to, 25 by default.
+func (mt *MXTransport) SetPort(port int) {
+	mt.port = port
+}
+
+// SetHelo sets the name given in EHLO, which receiving hosts often
+// check. It defaults to the host name.
+func (mt *MXTransport) SetHelo(helo string) {
+	mt.helo = helo
+}
+
+// SetTLSConfig sets the tls.Config used for STARTTLS. The default does
+// not verify certificates; a config that does makes hosts whose
+// STARTTLS fails, such as those with invalid certificates, fail over to
+// the next mail exchanger rather than be sent to unencrypted.
+func (mt *MXTransport) SetTLSConfig(config *tls.Config) {
+	mt.tlsConfig = config
+}
+
+// SetConnectTimeout sets how long connecting to each host may take.
+func (mt *MXTransport) SetConnectTimeout(timeout time.Duration) {
+	mt.connectTimeout = timeout
+}
+
+// SetRecipientPolicy sets whether a domain still gets the message when
+// some, but not all, of its recipients are refused.
+func (mt *MXTransport) SetRecipientPolicy(policy RecipientPolicy) {
+	mt.recipientPolicy = policy
+}
+
+// SetDKIMSigner has every message DKIM signed before it is sent.
+func (mt *MXTransport) SetDKIMSigner(signer *DKIMSigner) {
+	mt.dkim = signer
+}
+
+// SetLogger has the smtp conversation with every host logged, see
+// Courier.SetLogger.
+func (mt *MXTransport) SetLogger(logger *slog.Logger) {
+	mt.logger = logger
+}
+
+// hosts returns the mail exchangers of domain in the order to try them.
+func (mt *MXTransport) hosts(ctx context.Context, domain string) ([]string, error) {
+	domain, err := asciiDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := mt.resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		// no MX records: the domain itself is the implicit mail exchanger
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("MX lookup failed: %w", err)
+	}
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+	if len(records) == 1 && strings.TrimSuffix(records[0].Host, ".") == "" {
+		return nil, ErrNullMX
+	}
+
+	// hosts of equal preference are tried in random order
+	rand.Shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+
+	hosts := make([]string, len(records))
+	for i, record := range records {
+		hosts[i] = strings.TrimSuffix(record.Host, ".")
+	}
+	return hosts, nil
+}
+
+func (mt *MXTransport) courier(host string) *Courier {
+	courier := NewCourier(host, mt.port, "", "")
+	courier.helo = mt.helo
+	courier.SetEncryption(EncryptionStartTLS)
+	courier.SetTLSConfig(mt.tlsConfig)
+	courier.SetConnectTimeout(mt.connectTimeout)
+	courier.SetRecipientPolicy(mt.recipientPolicy)
+	courier.SetLogger(mt.logger)
+	return courier
+}
+
+// deliverHost sends the parcel to a single mail exchanger. Where
+// encryption is only opportunistic, a host that cannot complete
+// STARTTLS is sent the message in the clear instead (RFC 7435).
+func (mt *MXTransport) deliverHost(ctx context.Context, host string, parcel *Parcel) (*DeliveryResult, error) {
+	courier := mt.courier(host)
+	result, err := courier.deliverParcel(ctx, parcel)
+	if !errors.Is(err, ErrStartTLSFailed) || ctx.Err() != nil || !mt.opportunistic() {
+		return result, err
+	}
+
+	if mt.logger != nil {
+		mt.logger.Warn("STARTTLS failed, sending unencrypted",
+			slog.String("host", courier.address()),
+			slog.String("error", err.Error()),
+		)
+	}
+	courier.SetEncryption(EncryptionNone)
+	return courier.deliverParcel(ctx, parcel)
+}
+
+// opportunistic reports whether encryption is only a nicety, with
+// certificates left unverified.
+func (mt *MXTransport) opportunistic() bool {
+	return mt.tlsConfig != nil && mt.tlsConfig.InsecureSkipVerify
+}
+
+// deliverDomain tries the domain's hosts until one takes the message
+// or refuses it permanently.
+func (mt *MXTransport) deliverDomain(ctx context.Context, parcel *Parcel, domain *DomainResult) {
+	hosts, err := mt.hosts(ctx, domain.Domain)
+	if err != nil {
+		domain.Err = err
+		return
+	}
+
+	var errs []error
+	for _, host := range hosts {
+		result, err := mt.deliverHost(ctx, host, &Parcel{
+			From:       parcel.From,
+			Recipients: domain.Recipients,
+			Data:       parcel.Data,
+		})
+		if result != nil {
+			domain.Result = result
+		}
+		if err == nil {
+			return
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", host, err))
+		if (!IsTransient(err) && !errors.Is(err, ErrStartTLSFailed)) || ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(errs) == 1 {
+		domain.Err = errs[0]
+	} else {
+		domain.Err = fmt.Errorf("all %d mail exchanger(s) failed: %w", len(errs), errors.Join(errs...))
+	}
+}
+
+// Deliver sends the email to the mail exchangers of every recipient
+// domain. The result is returned even when some domains failed.
+func (mt *MXTransport) Deliver(msg *smail.Email) (*MXResult, error) {
+	return mt.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext is Deliver, giving up when ctx is cancelled.
+func (mt *MXTransport) DeliverContext(ctx context.Context, msg *smail.Email) (*MXResult, error) {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return nil, err
+	}
+	return mt.deliverParcel(ctx, parcel)
+}
+
+func (mt *MXTransport) deliverParcel(ctx context.Context, parcel *Parcel) (*MXResult, error) {
+	if mt.dkim != nil {
+		var err error
+		parcel, err = mt.dkim.SignParcel(parcel)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &MXResult{}
+	index := map[string]int{}
+	for _, recipient := range parcel.Recipients {
+		at := strings.LastIndex(recipient, "@")
+		if at < 0 {
+			return nil, fmt.Errorf("'%s' has no domain to deliver to", recipient)
+		}
+		domain := strings.ToLower(recipient[at+1:])
+		i, ok := index[domain]
+		if !ok {
+			i = len(result.Domains)
+			index[domain] = i
+			result.Domains = append(result.Domains, DomainResult{Domain: domain})
+		}
+		result.Domains[i].Recipients = append(result.Domains[i].Recipients, recipient)
+	}
+
+	for i := range result.Domains {
+		if ctx.Err() != nil {
+			result.Domains[i].Err = ctx.Err()
+			continue
+		}
+		mt.deliverDomain(ctx, parcel, &result.Domains[i])
+	}
+
+	if err := ctx.Err(); err != nil && len(result.Delivered()) == 0 {
+		return result, err
+	}
+	if len(result.Failed()) > 0 {
+		return result, &MXError{Result: result}
+	}
+	return result, nil
+}
+
+// Send implements Transport.
+func (mt *MXTransport) Send(msg *smail.Email) error {
+	_, err := mt.Deliver(msg)
+	return err
+}
+
+// SendParcel implements Transport.
+func (mt *MXTransport) SendParcel(parcel *Parcel) error {
+	return mt.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (mt *MXTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := mt.deliverParcel(ctx, parcel)
+	return err
+}
+
+// Close implements Transport.
+func (mt *MXTransport) Close() error {
+	return nil
+}
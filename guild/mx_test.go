@@ -0,0 +1,191 @@
+package guild
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"net"
+	"testing"
+)
+
+// stubResolver answers MX lookups from a map; domains that are not in
+// it do not exist.
+type stubResolver map[string][]*net.MX
+
+func (sr stubResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	records, ok := sr[domain]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func CreateTestMXTransport(srv *couriertest.Server, resolver Resolver) *MXTransport {
+	transport := NewMXTransport()
+	transport.SetResolver(resolver)
+	transport.SetPort(srv.Port())
+	transport.SetHelo("courier.test")
+	return transport
+}
+
+// findDomainResult picks a domain out of the result, as the envelope
+// does not keep the recipients in order.
+func findDomainResult(result *MXResult, domain string) DomainResult {
+	for _, dr := range result.Domains {
+		if dr.Domain == domain {
+			return dr
+		}
+	}
+	return DomainResult{}
+}
+
+func CreateTestMXMessage(recipients ...string) *smail.Email {
+	envelope := NewEnvelope()
+	envelope.SetFromAddress("sender@email.com")
+	envelope.AddToAddresses(recipients)
+
+	msg := NewMessage()
+	msg.SetSubject("Courier Test")
+	msg.SetTextBody("This is the courier test body.")
+	msg.Seal(envelope)
+	return msg.Message()
+}
+
+func TestMXTransport_GroupsByDomain(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	transport := CreateTestMXTransport(srv, stubResolver{
+		"one.test": {{Host: "127.0.0.1.", Pref: 10}},
+		"two.test": {{Host: "localhost.", Pref: 10}},
+	})
+
+	result, err := transport.Deliver(CreateTestMXMessage("a@one.test", "b@two.test", "c@one.test"))
+	tst.Nil(err)
+
+	tst.Len(result.Domains, 2)
+	one := findDomainResult(result, "one.test")
+	tst.ElementsMatch([]string{"a@one.test", "c@one.test"}, one.Recipients)
+	tst.Equal(srv.Addr(), one.Result.Host)
+	two := findDomainResult(result, "two.test")
+	tst.Equal([]string{"b@two.test"}, two.Recipients)
+	tst.Contains(two.Result.Host, "localhost")
+
+	tst.Len(srv.WaitForMessages(t, 2), 2)
+}
+
+func TestMXTransport_PreferenceAndFailover(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageGreeting, Reply: "421 4.3.2 Too busy", Times: 1})
+	})
+	transport := CreateTestMXTransport(srv, stubResolver{
+		"email.test": {{Host: "localhost.", Pref: 20}, {Host: "127.0.0.1.", Pref: 10}},
+	})
+
+	result, err := transport.Deliver(CreateTestMXMessage("a@email.test"))
+	tst.Nil(err)
+	// the preferred host was busy, so the backup took it
+	tst.Equal(2, srv.Connections())
+	tst.Contains(result.Domains[0].Result.Host, "localhost")
+}
+
+func TestMXTransport_PartialFailure(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Recipient: "b@bad.test", Reply: "550 5.1.1 No such user"})
+	})
+	transport := CreateTestMXTransport(srv, stubResolver{
+		"good.test": {{Host: "127.0.0.1.", Pref: 10}},
+		"bad.test":  {{Host: "127.0.0.1.", Pref: 10}, {Host: "localhost.", Pref: 20}},
+		"null.test": {{Host: ".", Pref: 0}},
+	})
+
+	result, err := transport.Deliver(CreateTestMXMessage("a@good.test", "b@bad.test", "c@null.test"))
+
+	var mxErr *MXError
+	tst.True(errors.As(err, &mxErr))
+	tst.Len(result.Delivered(), 1)
+	tst.Len(result.Failed(), 2)
+	tst.ErrorIs(err, ErrNullMX)
+	tst.ErrorContains(err, "2 of 3 domain(s) failed")
+	tst.False(IsTransient(err))
+
+	// a permanent refusal is not tried at the backup host
+	tst.Equal(2, srv.Connections())
+	tst.Len(findDomainResult(result, "bad.test").Result.Rejected(), 1)
+}
+
+func TestMXTransport_ImplicitMX(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	transport := CreateTestMXTransport(srv, stubResolver{})
+
+	result, err := transport.Deliver(CreateTestMXMessage("a@localhost"))
+	tst.Nil(err)
+	tst.Contains(result.Domains[0].Result.Host, "localhost")
+}
+
+func TestMXTransport_OpportunisticTLS(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferStartTLS = true
+	})
+	transport := CreateTestMXTransport(srv, stubResolver{
+		"email.test": {{Host: "127.0.0.1.", Pref: 10}},
+	})
+
+	_, err := transport.Deliver(CreateTestMXMessage("a@email.test"))
+	tst.Nil(err)
+	tst.True(srv.WaitForMessages(t, 1)[0].TLS)
+}
+
+func TestMXTransport_StartTLSFailure(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferStartTLS = true
+	})
+	transport := CreateTestMXTransport(srv, stubResolver{
+		"email.test": {{Host: "127.0.0.1.", Pref: 10}, {Host: "localhost.", Pref: 20}},
+	})
+	// no TLS version in common with the server, so every handshake fails
+	transport.SetTLSConfig(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+
+	// opportunistic encryption sends it to the same host in the clear
+	result, err := transport.Deliver(CreateTestMXMessage("a@email.test"))
+	tst.Nil(err)
+	tst.Equal(srv.Addr(), result.Domains[0].Result.Host)
+	tst.False(srv.WaitForMessages(t, 1)[0].TLS)
+	tst.Equal(2, srv.Connections())
+
+	// with verified certificates it moves on to the next host instead
+	transport.SetTLSConfig(&tls.Config{RootCAs: srv.ClientTLS.RootCAs, MaxVersion: tls.VersionTLS11})
+	_, err = transport.Deliver(CreateTestMXMessage("a@email.test"))
+	tst.ErrorContains(err, "all 2 mail exchanger(s) failed")
+	tst.ErrorIs(err, ErrStartTLSFailed)
+	tst.Equal(4, srv.Connections())
+	tst.Len(srv.Messages(), 1)
+}
+
+func TestMXTransport_Transient(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "451 4.7.1 Greylisted"})
+	})
+	transport := CreateTestMXTransport(srv, stubResolver{
+		"email.test": {{Host: "127.0.0.1.", Pref: 10}, {Host: "localhost.", Pref: 20}},
+	})
+
+	_, err := transport.Deliver(CreateTestMXMessage("a@email.test"))
+	tst.ErrorContains(err, "all 2 mail exchanger(s) failed")
+	tst.True(IsTransient(err))
+}
@@ -1,11 +1,11 @@
 package guild
 
 import (
+	"context"
 	"fmt"
 	pongo "github.com/flosch/pongo2/v6"
 	"github.com/vanng822/go-premailer/premailer"
 	smail "github.com/xhit/go-simple-mail/v2"
-	"strings"
 )
 
 // PongoScribe
@@ -19,10 +19,10 @@ type PongoScribe struct {
 	errors          []error
 }
 
-func (ps *PongoScribe) createTemplate(tmplStr string) *pongo.Template {
+func (ps *PongoScribe) createTemplate(name, tmplStr string) *pongo.Template {
 	tmpl, err := pongo.FromString(tmplStr)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError(name, err))
 	}
 	return tmpl
 }
@@ -32,21 +32,21 @@ func (ps *PongoScribe) SetPriority(isHigh bool) {
 }
 
 func (ps *PongoScribe) SetSubjectTemplate(subject string) {
-	ps.subjectTemplate = ps.createTemplate(subject)
+	ps.subjectTemplate = ps.createTemplate("subject", subject)
 }
 
 func (ps *PongoScribe) SetTextBodyTemplate(text string) {
 	if emptyString(text) {
 		return
 	}
-	ps.textTemplate = ps.createTemplate(text)
+	ps.textTemplate = ps.createTemplate("text", text)
 }
 
 func (ps *PongoScribe) SetHtmlBodyTemplate(html string) {
 	if emptyString(html) {
 		return
 	}
-	ps.htmlTemplate = ps.createTemplate(html)
+	ps.htmlTemplate = ps.createTemplate("html", html)
 }
 
 func (ps *PongoScribe) SetBodyTemplate(text string, html bool) {
@@ -83,13 +83,14 @@ func (ps *PongoScribe) HasErrors() bool {
 	return len(ps.errors) > 0
 }
 
+// GetErrors sums up the errors so far in one error, or returns nil
+// when there are none. Template problems are *TemplateErrors, which
+// errors.As can pick out.
 func (ps *PongoScribe) GetErrors() error {
-	errCount := len(ps.errors)
-	var errDetails []string
-	for _, err := range ps.errors {
-		errDetails = append(errDetails, err.Error())
+	if !ps.HasErrors() {
+		return nil
 	}
-	return fmt.Errorf("Scribe encountered %d error(s): %s", errCount, strings.Join(errDetails, ", "))
+	return &errorList{format: "Scribe encountered %d error(s): %s", errs: ps.errors}
 }
 
 func (ps *PongoScribe) renderSubject(ctx pongo.Context) string {
@@ -99,7 +100,7 @@ func (ps *PongoScribe) renderSubject(ctx pongo.Context) string {
 
 	subject, err := ps.subjectTemplate.Execute(ctx)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("subject", err))
 		return ""
 	}
 	return subject
@@ -111,7 +112,7 @@ func (ps *PongoScribe) renderText(ctx pongo.Context) string {
 	}
 	text, err := ps.textTemplate.Execute(ctx)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("text", err))
 		return ""
 	}
 	return text
@@ -123,25 +124,36 @@ func (ps *PongoScribe) renderHtml(ctx pongo.Context) string {
 	}
 	html, err := ps.htmlTemplate.Execute(ctx)
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("html", err))
 		return ""
 	}
 
 	premHtml, err := premailer.NewPremailerFromString(html, premailer.NewOptions())
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("html", err))
 		return ""
 	}
 
 	renderedHtml, err := premHtml.Transform()
 	if err != nil {
-		ps.addError(err)
+		ps.addError(newTemplateError("html", err))
 		return ""
 	}
 	return flattenHtml(renderedHtml)
 }
 
 func (ps *PongoScribe) Compose(ctx ...any) Scribe {
+	return ps.ComposeContext(context.Background(), ctx...)
+}
+
+// ComposeContext is Compose, checking cctx between rendering the
+// subject and each body so that a cancelled request stops early.
+// Cancellation is reported through HasErrors/GetErrors.
+func (ps *PongoScribe) ComposeContext(cctx context.Context, ctx ...any) Scribe {
+	if ps.cancelled(cctx) {
+		return ps
+	}
+
 	if len(ctx) == 0 {
 		ps.addError(fmt.Errorf("PongoScribe.Compose must receive a single Context argument."))
 		return ps
@@ -157,8 +169,17 @@ func (ps *PongoScribe) Compose(ctx ...any) Scribe {
 	}
 
 	subject := ps.renderSubject(pctx)
+	if ps.cancelled(cctx) {
+		return ps
+	}
 	html := ps.renderHtml(pctx)
+	if ps.cancelled(cctx) {
+		return ps
+	}
 	text := ps.renderText(pctx)
+	if ps.cancelled(cctx) {
+		return ps
+	}
 
 	ps.message.SetPriority(ps.highPriority)
 	ps.message.SetSubject(subject)
@@ -172,6 +193,15 @@ func (ps *PongoScribe) Compose(ctx ...any) Scribe {
 	return ps
 }
 
+func (ps *PongoScribe) cancelled(cctx context.Context) bool {
+	err := cctx.Err()
+	if err != nil {
+		ps.addError(err)
+		return true
+	}
+	return false
+}
+
 func (ps *PongoScribe) Seal(envelope *Envelope) Scribe {
 	ps.message.Seal(envelope)
 	return ps
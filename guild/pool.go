@@ -0,0 +1,239 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrPoolClosed is returned when sending through a CourierPool that
+// has been closed.
+var ErrPoolClosed = errors.New("courier pool is closed")
+
+type pooledSession struct {
+	*session
+	lastUsed time.Time
+	reused   bool
+}
+
+// CourierPool is a Transport that keeps a bounded number of authenticated
+// smtp sessions open and reuses them between messages, which is far
+// cheaper than the one connection per message of Courier.Deliver when
+// sending in bulk. It is safe for use by multiple goroutines.
+type CourierPool struct {
+	courier     *Courier
+	idleTimeout time.Duration
+	slots       chan struct{}
+	mu          sync.Mutex
+	idle        []*pooledSession
+	closed      bool
+}
+
+// NewCourierPool creates a pool that will hold at most size sessions
+// to the server described by courier.
+func NewCourierPool(courier *Courier, size int) *CourierPool {
+	if size < 1 {
+		size = 1
+	}
+	return &CourierPool{
+		courier:     courier,
+		idleTimeout: 30 * time.Second,
+		slots:       make(chan struct{}, size),
+	}
+}
+
+// SetIdleTimeout sets how long an unused session is kept before it is
+// discarded rather than reused. Servers commonly drop idle clients after
+// a minute or so.
+func (cp *CourierPool) SetIdleTimeout(timeout time.Duration) {
+	cp.idleTimeout = timeout
+}
+
+// acquire waits for a free slot and returns a live session, reusing an
+// idle one when possible and reconnecting when not.
+func (cp *CourierPool) acquire(ctx context.Context) (*pooledSession, error) {
+	select {
+	case cp.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		cp.mu.Lock()
+		if cp.closed {
+			cp.mu.Unlock()
+			<-cp.slots
+			return nil, ErrPoolClosed
+		}
+		var session *pooledSession
+		if n := len(cp.idle); n > 0 {
+			session = cp.idle[n-1]
+			cp.idle = cp.idle[:n-1]
+		}
+		cp.mu.Unlock()
+
+		if session == nil {
+			break
+		}
+
+		// make sure the server hasn't hung up on us while we were idle
+		if time.Since(session.lastUsed) < cp.idleTimeout && cp.alive(ctx, session) {
+			session.reused = true
+			return session, nil
+		}
+		_ = session.client.Close()
+	}
+
+	s, err := cp.courier.connect(ctx)
+	if err != nil {
+		<-cp.slots
+		return nil, err
+	}
+	return &pooledSession{session: s}, nil
+}
+
+func (cp *CourierPool) alive(ctx context.Context, session *pooledSession) bool {
+	stop := session.watch(ctx, cp.courier.connectTimeout)
+	defer stop()
+	return session.client.Noop() == nil
+}
+
+// release returns a session to the pool, or closes it if it can no
+// longer be trusted.
+func (cp *CourierPool) release(session *pooledSession, reusable bool) {
+	defer func() {
+		<-cp.slots
+	}()
+
+	if reusable {
+		// a server that stops answering must not hang the sender
+		stop := session.watch(context.Background(), cp.courier.connectTimeout)
+		reusable = session.client.Reset() == nil
+		stop()
+	}
+
+	cp.mu.Lock()
+	if reusable && !cp.closed {
+		session.lastUsed = time.Now()
+		cp.idle = append(cp.idle, session)
+		cp.mu.Unlock()
+		return
+	}
+	cp.mu.Unlock()
+
+	_ = session.client.Close()
+}
+
+// Deliver sends the email over one of the pooled sessions, returning
+// the outcome for each recipient as Courier.Deliver does.
+func (cp *CourierPool) Deliver(msg *smail.Email) (*DeliveryResult, error) {
+	return cp.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext is Deliver, giving up when ctx is cancelled. A session
+// interrupted mid conversation is closed rather than returned to the pool.
+func (cp *CourierPool) DeliverContext(ctx context.Context, msg *smail.Email) (*DeliveryResult, error) {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return nil, err
+	}
+	return cp.deliverParcel(ctx, parcel)
+}
+
+// SendParcel implements Transport.
+func (cp *CourierPool) SendParcel(parcel *Parcel) error {
+	return cp.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (cp *CourierPool) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := cp.deliverParcel(ctx, parcel)
+	return err
+}
+
+// DeliverParcelContext implements ResultTransport.
+func (cp *CourierPool) DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	return cp.deliverParcel(ctx, parcel)
+}
+
+func (cp *CourierPool) deliverParcel(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	parcel, err := cp.courier.seal(parcel)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := cp.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := cp.send(ctx, session, parcel)
+	if err != nil && session.reused && !result.dataStarted && ctx.Err() == nil && droppedConnection(err) {
+		// the server hung up on a session that passed NOOP; as nothing
+		// was sent yet, try once more on a new connection
+		_ = session.client.Close()
+		s, connErr := cp.courier.connect(ctx)
+		if connErr != nil {
+			<-cp.slots
+			return nil, connErr
+		}
+		session = &pooledSession{session: s}
+		result, err = cp.send(ctx, session, parcel)
+	}
+
+	cp.release(session, err == nil || (isReplyError(err) && ctx.Err() == nil))
+
+	if err != nil {
+		return result, contextError(ctx, err)
+	}
+	logRefused(cp.courier.logger, result)
+	return result, nil
+}
+
+func (cp *CourierPool) send(ctx context.Context, session *pooledSession, parcel *Parcel) (*DeliveryResult, error) {
+	stop := session.watch(ctx, 0)
+	defer stop()
+	result, err := sendMail(session.client, cp.courier.recipientPolicy, parcel.From, parcel.Recipients, parcel.Data)
+	result.Host = cp.courier.address()
+	return result, err
+}
+
+// droppedConnection reports whether err is the server going away,
+// rather than a reply or a timeout.
+func droppedConnection(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return !netErr.Timeout()
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// Send implements Transport.
+func (cp *CourierPool) Send(msg *smail.Email) error {
+	_, err := cp.Deliver(msg)
+	return err
+}
+
+// Close ends all idle sessions. Sessions that are in use are closed
+// as soon as their message has been sent.
+func (cp *CourierPool) Close() error {
+	cp.mu.Lock()
+	idle := cp.idle
+	cp.idle = nil
+	cp.closed = true
+	cp.mu.Unlock()
+
+	for _, session := range idle {
+		_ = session.client.Quit()
+		_ = session.client.Close()
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package guild
+
+import (
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestCourierPool_ReusesSessions(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	pool := NewCourierPool(CreateTestCourier(srv, EncryptionNone), 2)
+	defer func() {
+		_ = pool.Close()
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- pool.Send(CreateTestMessage())
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		tst.Nil(err)
+	}
+	tst.Len(srv.Messages(), 20)
+	tst.LessOrEqual(srv.Connections(), 2)
+}
+
+func TestCourierPool_ReconnectsDroppedSessions(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	pool := NewCourierPool(CreateTestCourier(srv, EncryptionNone), 1)
+	defer func() {
+		_ = pool.Close()
+	}()
+
+	tst.Nil(pool.Send(CreateTestMessage()))
+	srv.DropConnections()
+	tst.Nil(pool.Send(CreateTestMessage()))
+
+	tst.Len(srv.Messages(), 2)
+	tst.Equal(2, srv.Connections())
+}
+
+func TestCourierPool_RetriesSessionsDroppedBeforeData(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	pool := NewCourierPool(CreateTestCourier(srv, EncryptionNone), 1)
+	defer func() {
+		_ = pool.Close()
+	}()
+
+	tst.Nil(pool.Send(CreateTestMessage()))
+
+	// the server answers NOOP, then hangs up at MAIL FROM
+	srv.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Drop: true, Times: 1})
+	tst.Nil(pool.Send(CreateTestMessage()))
+
+	tst.Len(srv.Messages(), 2)
+	tst.Equal(2, srv.Connections())
+}
+
+func TestCourierPool_DoesNotRetryAfterData(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	pool := NewCourierPool(CreateTestCourier(srv, EncryptionNone), 1)
+	defer func() {
+		_ = pool.Close()
+	}()
+
+	tst.Nil(pool.Send(CreateTestMessage()))
+
+	// the server may already have the message, so it is not sent again
+	srv.AddFault(couriertest.Fault{Stage: couriertest.StageMessage, Drop: true, Times: 1})
+	tst.NotNil(pool.Send(CreateTestMessage()))
+
+	tst.Len(srv.Messages(), 1)
+	tst.Equal(1, srv.Connections())
+}
+
+func TestCourierPool_Closed(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	pool := NewCourierPool(CreateTestCourier(srv, EncryptionNone), 1)
+
+	tst.Nil(pool.Close())
+	tst.ErrorIs(pool.Send(CreateTestMessage()), ErrPoolClosed)
+}
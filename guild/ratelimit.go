@@ -0,0 +1,217 @@
+package guild
+
+import (
+	"context"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit describes how fast, and how much, may be sent. Zero
+// values leave that limit off.
+type RateLimit struct {
+	// PerSecond is the sustained number of messages per second.
+	PerSecond float64
+	// Burst is how many messages may go out at once before PerSecond
+	// applies. It defaults to PerSecond, rounded up.
+	Burst int
+	// Hourly and Daily cap the messages sent per clock hour and per
+	// UTC day.
+	Hourly int
+	Daily  int
+}
+
+// QuotaError is returned by a non-blocking RateLimitTransport when a
+// message would exceed one of its limits.
+type QuotaError struct {
+	// Limit names the exceeded limit, e.g. "daily" or "per second for example.com".
+	Limit string
+	// RetryAfter is how long until the message could be sent.
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s sending limit reached, retry after %s", e.Limit, e.RetryAfter.Round(time.Millisecond))
+}
+
+// Temporary is always true: the quota frees up again with time. Nothing
+// was sent, so it says nothing about the health of the server; a
+// RetryTransport waits RetryAfter rather than its own delay, and gives
+// up when that is longer than its policy allows.
+func (e *QuotaError) Temporary() bool {
+	return true
+}
+
+// limiter enforces a RateLimit with a token bucket and two fixed windows.
+type limiter struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+	hour   time.Time
+	hourly int
+	day    time.Time
+	daily  int
+}
+
+func newLimiter(limit RateLimit, now time.Time) *limiter {
+	if limit.PerSecond > 0 && limit.Burst < 1 {
+		limit.Burst = int(math.Ceil(limit.PerSecond))
+	}
+	return &limiter{limit: limit, tokens: float64(limit.Burst), last: now}
+}
+
+// wait returns how long until a message may be sent, and the name of
+// the limit that is holding it back.
+func (l *limiter) wait(now time.Time) (time.Duration, string) {
+	if l.limit.PerSecond > 0 {
+		l.tokens = math.Min(float64(l.limit.Burst), l.tokens+now.Sub(l.last).Seconds()*l.limit.PerSecond)
+		l.last = now
+	}
+
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !l.day.Equal(day) {
+		l.day, l.daily = day, 0
+	}
+	if l.limit.Daily > 0 && l.daily >= l.limit.Daily {
+		return day.Add(24 * time.Hour).Sub(now), "daily"
+	}
+
+	hour := now.UTC().Truncate(time.Hour)
+	if !l.hour.Equal(hour) {
+		l.hour, l.hourly = hour, 0
+	}
+	if l.limit.Hourly > 0 && l.hourly >= l.limit.Hourly {
+		return hour.Add(time.Hour).Sub(now), "hourly"
+	}
+
+	if l.limit.PerSecond > 0 && l.tokens < 1 {
+		return time.Duration((1 - l.tokens) / l.limit.PerSecond * float64(time.Second)), "per second"
+	}
+
+	return 0, ""
+}
+
+func (l *limiter) take() {
+	l.tokens--
+	l.hourly++
+	l.daily++
+}
+
+// RateLimitTransport wraps a Transport, keeping deliveries within an
+// overall RateLimit and optional limits per recipient domain. A message
+// counts once against each domain it is addressed to. By default it
+// waits until a message may be sent; see SetBlocking.
+type RateLimitTransport struct {
+	transport Transport
+	blocking  bool
+	now       func() time.Time
+	sleep     func(context.Context, time.Duration) error
+
+	mu      sync.Mutex
+	global  *limiter
+	domains map[string]*limiter
+}
+
+func NewRateLimitTransport(transport Transport, limit RateLimit) *RateLimitTransport {
+	return &RateLimitTransport{
+		transport: transport,
+		blocking:  true,
+		now:       time.Now,
+		sleep:     sleepContext,
+		global:    newLimiter(limit, time.Now()),
+		domains:   map[string]*limiter{},
+	}
+}
+
+// SetDomainLimit limits the messages sent to recipients at domain.
+func (rl *RateLimitTransport) SetDomainLimit(domain string, limit RateLimit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.domains[strings.ToLower(domain)] = newLimiter(limit, rl.now())
+}
+
+// SetBlocking chooses between waiting for a limit to free up (true, the
+// default) and failing straight away with a *QuotaError (false).
+func (rl *RateLimitTransport) SetBlocking(blocking bool) {
+	rl.blocking = blocking
+}
+
+// reserve takes a slot from every limiter that applies to the parcel,
+// or, when any of them is exhausted, returns the quota error to wait
+// out without taking anything.
+func (rl *RateLimitTransport) reserve(parcel *Parcel) *QuotaError {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	limiters := map[*limiter]string{rl.global: ""}
+	for _, recipient := range parcel.Recipients {
+		_, domain, _ := strings.Cut(recipient, "@")
+		domain = strings.ToLower(domain)
+		if l, ok := rl.domains[domain]; ok {
+			limiters[l] = " for " + domain
+		}
+	}
+
+	var quotaErr *QuotaError
+	for l, suffix := range limiters {
+		wait, limit := l.wait(now)
+		if wait > 0 && (quotaErr == nil || wait > quotaErr.RetryAfter) {
+			quotaErr = &QuotaError{Limit: limit + suffix, RetryAfter: wait}
+		}
+	}
+	if quotaErr != nil {
+		return quotaErr
+	}
+
+	for l := range limiters {
+		l.take()
+	}
+	return nil
+}
+
+func (rl *RateLimitTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return rl.SendParcel(parcel)
+}
+
+func (rl *RateLimitTransport) SendParcel(parcel *Parcel) error {
+	return rl.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport. A blocking transport
+// stops waiting for its limits when ctx is done.
+func (rl *RateLimitTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := rl.DeliverParcelContext(ctx, parcel)
+	return err
+}
+
+// DeliverParcelContext implements ResultTransport, passing on the
+// result of the wrapped transport when it reports one.
+func (rl *RateLimitTransport) DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	for {
+		quotaErr := rl.reserve(parcel)
+		if quotaErr == nil {
+			break
+		}
+		if !rl.blocking {
+			return nil, quotaErr
+		}
+		err := rl.sleep(ctx, quotaErr.RetryAfter)
+		if err != nil {
+			return nil, fmt.Errorf("%w (waiting for %s)", err, quotaErr)
+		}
+	}
+
+	return DeliverParcelContext(ctx, rl.transport, parcel)
+}
+
+func (rl *RateLimitTransport) Close() error {
+	return rl.transport.Close()
+}
@@ -0,0 +1,106 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// CreateTestRateLimitTransport returns a transport on a fake clock
+// that moves forward whenever the transport sleeps.
+func CreateTestRateLimitTransport(limit RateLimit) (*RateLimitTransport, *MemoryTransport, *time.Time) {
+	memory := NewMemoryTransport()
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	transport := NewRateLimitTransport(memory, limit)
+	transport.now = func() time.Time { return now }
+	transport.sleep = func(ctx context.Context, delay time.Duration) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		now = now.Add(delay)
+		return nil
+	}
+	transport.global = newLimiter(limit, now)
+	return transport, memory, &now
+}
+
+func CreateTestParcel(recipients ...string) *Parcel {
+	return &Parcel{From: "sender@email.com", Recipients: recipients, Data: "Subject: Rate Test\r\n\r\nbody\r\n"}
+}
+
+func TestRateLimitTransport_PerSecond(t *testing.T) {
+	tst := assert.New(t)
+
+	transport, memory, now := CreateTestRateLimitTransport(RateLimit{PerSecond: 2})
+	start := *now
+
+	for i := 0; i < 6; i++ {
+		tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+	}
+
+	// the first two go at once, the rest at two per second
+	tst.Len(memory.Parcels(), 6)
+	tst.Equal(2*time.Second, now.Sub(start))
+}
+
+func TestRateLimitTransport_DailyQuotaError(t *testing.T) {
+	tst := assert.New(t)
+
+	transport, memory, now := CreateTestRateLimitTransport(RateLimit{Daily: 2})
+	transport.SetBlocking(false)
+
+	tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+	tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+
+	err := transport.SendParcel(CreateTestParcel("receiver@email.com"))
+	var quotaErr *QuotaError
+	tst.True(errors.As(err, &quotaErr))
+	tst.Equal("daily", quotaErr.Limit)
+	tst.Equal(12*time.Hour, quotaErr.RetryAfter)
+	tst.True(IsTransient(err))
+	tst.Len(memory.Parcels(), 2)
+
+	// the quota is renewed at midnight
+	*now = now.Add(12 * time.Hour)
+	tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+}
+
+func TestRateLimitTransport_DomainLimits(t *testing.T) {
+	tst := assert.New(t)
+
+	transport, memory, now := CreateTestRateLimitTransport(RateLimit{})
+	transport.SetBlocking(false)
+	transport.SetDomainLimit("Example.com", RateLimit{Hourly: 1})
+
+	tst.Nil(transport.SendParcel(CreateTestParcel("one@example.com", "two@EXAMPLE.com")))
+
+	err := transport.SendParcel(CreateTestParcel("three@other.com", "four@example.com"))
+	tst.EqualError(err, "hourly for example.com sending limit reached, retry after 1h0m0s")
+
+	tst.Nil(transport.SendParcel(CreateTestParcel("three@other.com")))
+	tst.Len(memory.Parcels(), 2)
+
+	// blocking waits out the hour instead
+	transport.SetBlocking(true)
+	start := *now
+	tst.Nil(transport.SendParcel(CreateTestParcel("four@example.com")))
+	tst.Equal(time.Hour, now.Sub(start))
+}
+
+func TestRateLimitTransport_WaitHonoursContext(t *testing.T) {
+	tst := assert.New(t)
+
+	transport, memory, _ := CreateTestRateLimitTransport(RateLimit{PerSecond: 1})
+	tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := transport.SendParcelContext(ctx, CreateTestParcel("receiver@email.com"))
+	tst.ErrorIs(err, context.Canceled)
+	tst.ErrorContains(err, "per second sending limit reached")
+	tst.Len(memory.Parcels(), 1)
+}
@@ -0,0 +1,130 @@
+package guild
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"syscall"
+)
+
+var enhancedStatusCode = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\s+`)
+
+// SMTPError is a negative reply from an smtp server. It carries the
+// basic reply code, the RFC 3463 enhanced status code when the server
+// sent one, and the server's text.
+type SMTPError struct {
+	Code         int
+	EnhancedCode string
+	Message      string
+}
+
+func (e *SMTPError) Error() string {
+	if e.EnhancedCode != "" {
+		return fmt.Sprintf("smtp %d %s %s", e.Code, e.EnhancedCode, e.Message)
+	}
+	return fmt.Sprintf("smtp %d %s", e.Code, e.Message)
+}
+
+// Temporary reports whether the server asked us to try again later (4xx).
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// Permanent reports whether the server refused the command outright (5xx).
+func (e *SMTPError) Permanent() bool {
+	return e.Code >= 500
+}
+
+// newSMTPError converts a textproto reply error into an SMTPError.
+func newSMTPError(err *textproto.Error) *SMTPError {
+	smtpErr := &SMTPError{Code: err.Code, Message: err.Msg}
+	if match := enhancedStatusCode.FindStringSubmatch(err.Msg); match != nil {
+		smtpErr.EnhancedCode = match[1]
+		smtpErr.Message = err.Msg[len(match[0]):]
+	}
+	return smtpErr
+}
+
+// replyError turns server replies into SMTPErrors and passes any
+// other error through untouched.
+func replyError(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return newSMTPError(protoErr)
+	}
+	return err
+}
+
+// isReplyError reports whether err is a reply from the server, as
+// opposed to a network failure, in which case the session is still
+// in a usable state.
+func isReplyError(err error) bool {
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr)
+}
+
+// IsTransient reports whether a delivery error is worth retrying.
+// Errors with a Temporary method, as the package's own errors have,
+// decide for themselves: 4xx replies, 429 and 5xx api responses and
+// exceeded quotas are transient. Network failures are too, but not a
+// certificate that failed to verify, a server that doesn't speak TLS or
+// a cancelled or expired context; 5xx replies and everything else are
+// not either.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if isCertificateError(err) {
+		return false
+	}
+	// an http client timeout wraps context.DeadlineExceeded as well
+	var urlErr *url.Error
+	clientTimeout := errors.As(err, &urlErr) && urlErr.Timeout()
+	if !clientTimeout && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return false
+	}
+
+	var temporary interface{ Temporary() bool }
+	if errors.As(err, &temporary) {
+		switch temporary.(type) {
+		case net.Error, syscall.Errno:
+			// the standard library counts far fewer failures as temporary
+		default:
+			return temporary.Temporary()
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// isCertificateError reports whether the TLS handshake failed in a way
+// that trying again will not change.
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var verification *tls.CertificateVerificationError
+	var recordHeader tls.RecordHeaderError
+	return errors.As(err, &unknownAuthority) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &verification) ||
+		errors.As(err, &recordHeader)
+}
@@ -0,0 +1,168 @@
+package guild
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RecipientStatus is the server's answer to a single RCPT TO.
+type RecipientStatus int
+
+const (
+	RecipientAccepted RecipientStatus = iota
+	// RecipientRejected is a permanent (5xx) refusal.
+	RecipientRejected
+	// RecipientDeferred is a temporary (4xx) refusal.
+	RecipientDeferred
+)
+
+func (s RecipientStatus) String() string {
+	switch s {
+	case RecipientRejected:
+		return "rejected"
+	case RecipientDeferred:
+		return "deferred"
+	}
+	return "accepted"
+}
+
+// RecipientPolicy decides whether a message is sent when only some
+// of its recipients were accepted.
+type RecipientPolicy int
+
+const (
+	// RequireAllRecipients abandons the message if any recipient is
+	// refused. This is the default.
+	RequireAllRecipients RecipientPolicy = iota
+	// RequireAnyRecipient sends the message to the recipients that were
+	// accepted, as long as there is at least one.
+	RequireAnyRecipient
+)
+
+func (p RecipientPolicy) String() string {
+	if p == RequireAnyRecipient {
+		return "any"
+	}
+	return "all"
+}
+
+// ParseRecipientPolicy converts "all" or "any" to a RecipientPolicy.
+// An empty string means all.
+func ParseRecipientPolicy(name string) (RecipientPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "all":
+		return RequireAllRecipients, nil
+	case "any":
+		return RequireAnyRecipient, nil
+	}
+	return RequireAllRecipients, fmt.Errorf("'%s' is not a valid recipient policy", name)
+}
+
+// RecipientResult is the outcome for one recipient. Reply is nil
+// for accepted recipients.
+type RecipientResult struct {
+	Recipient string
+	Status    RecipientStatus
+	Reply     *SMTPError
+}
+
+// DeliveryResult lists the outcome of a delivery for each recipient.
+type DeliveryResult struct {
+	// Host is the host:port of the server that was talked to.
+	Host       string
+	Recipients []RecipientResult
+	// Sent reports whether the server accepted the message data.
+	Sent bool
+
+	// dataStarted is set once DATA is sent, after which the server
+	// may have the message whatever happens to the connection.
+	dataStarted bool
+}
+
+func newRecipientResult(recipient string, reply *SMTPError) RecipientResult {
+	result := RecipientResult{Recipient: recipient, Status: RecipientAccepted, Reply: reply}
+	if reply != nil {
+		result.Status = RecipientRejected
+		if reply.Temporary() {
+			result.Status = RecipientDeferred
+		}
+	}
+	return result
+}
+
+func (r *DeliveryResult) add(recipient string, reply *SMTPError) {
+	r.Recipients = append(r.Recipients, newRecipientResult(recipient, reply))
+}
+
+func (r *DeliveryResult) filter(status RecipientStatus) []RecipientResult {
+	var results []RecipientResult
+	for _, result := range r.Recipients {
+		if result.Status == status {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// Accepted returns the recipients the server agreed to deliver to.
+func (r *DeliveryResult) Accepted() []RecipientResult {
+	return r.filter(RecipientAccepted)
+}
+
+// Rejected returns the recipients that were permanently refused.
+func (r *DeliveryResult) Rejected() []RecipientResult {
+	return r.filter(RecipientRejected)
+}
+
+// Deferred returns the recipients that were temporarily refused.
+func (r *DeliveryResult) Deferred() []RecipientResult {
+	return r.filter(RecipientDeferred)
+}
+
+// RecipientError is returned when recipients were refused. Over smtp
+// the message is then not sent at all; over LMTP, where recipients can
+// also be refused after the message data, Result.Sent reports whether
+// the others received it. It unwraps to the SMTPError of each refusal.
+type RecipientError struct {
+	Result *DeliveryResult
+}
+
+func (e *RecipientError) refused() []RecipientResult {
+	var refused []RecipientResult
+	for _, result := range e.Result.Recipients {
+		if result.Status != RecipientAccepted {
+			refused = append(refused, result)
+		}
+	}
+	return refused
+}
+
+func (e *RecipientError) Error() string {
+	refused := e.refused()
+	details := make([]string, len(refused))
+	for i, result := range refused {
+		details[i] = fmt.Sprintf("%s: %s", result.Recipient, result.Reply)
+	}
+	return fmt.Sprintf(
+		"%d of %d recipient(s) refused:\n%s",
+		len(refused),
+		len(e.Result.Recipients),
+		strings.Join(details, "\n"),
+	)
+}
+
+func (e *RecipientError) Unwrap() []error {
+	var errs []error
+	for _, result := range e.refused() {
+		errs = append(errs, result.Reply)
+	}
+	return errs
+}
+
+// Temporary reports whether every refusal was temporary, so that
+// trying again later may succeed. A message that has already reached
+// some of its recipients is never temporary, as sending it again
+// would deliver it to them twice.
+func (e *RecipientError) Temporary() bool {
+	return !e.Result.Sent && len(e.Result.Rejected()) == 0
+}
@@ -0,0 +1,140 @@
+package guild
+
+import (
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"testing"
+)
+
+func CreateMultiRecipientMessage() *smail.Email {
+	envelope := NewEnvelope()
+	envelope.SetFromAddress("sender@email.com")
+	envelope.AddToAddresses([]string{"receiver@email.com", "unknown@email.com", "busy@email.com"})
+
+	scribe := NewSimpleTextScribe()
+	scribe.SetSubjectTemplate("Courier Test")
+	scribe.SetTextBodyTemplate("This is the courier test body.")
+	_, _ = scribe.Open()
+	scribe.Compose().Seal(envelope)
+	return scribe.Message()
+}
+
+func startRefusingServer(t *testing.T) *couriertest.Server {
+	return couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Recipient: "unknown@email.com", Reply: "550 5.1.1 User unknown"})
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Recipient: "busy@email.com", Reply: "452 4.2.2 Mailbox full"})
+	})
+}
+
+func TestCourier_DeliverRequireAllRecipients(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := startRefusingServer(t)
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	result, err := courier.Deliver(CreateMultiRecipientMessage())
+
+	var rcptErr *RecipientError
+	tst.True(errors.As(err, &rcptErr))
+	tst.ErrorContains(err, "2 of 3 recipient(s) refused")
+	tst.ErrorContains(err, "unknown@email.com: smtp 550 5.1.1 User unknown")
+	tst.False(IsTransient(err))
+
+	tst.False(result.Sent)
+	tst.Len(result.Recipients, 3)
+	tst.Len(srv.Messages(), 0)
+
+	rejected := result.Rejected()
+	tst.Len(rejected, 1)
+	tst.Equal("unknown@email.com", rejected[0].Recipient)
+	tst.Equal(550, rejected[0].Reply.Code)
+	tst.Equal("5.1.1", rejected[0].Reply.EnhancedCode)
+	tst.Equal("User unknown", rejected[0].Reply.Message)
+
+	deferred := result.Deferred()
+	tst.Len(deferred, 1)
+	tst.Equal("busy@email.com", deferred[0].Recipient)
+	tst.Equal(RecipientDeferred, deferred[0].Status)
+	tst.Equal("deferred", deferred[0].Status.String())
+}
+
+func TestCourier_DeliverRequireAnyRecipient(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := startRefusingServer(t)
+	courier := CreateTestCourier(srv, EncryptionNone)
+	courier.SetRecipientPolicy(RequireAnyRecipient)
+	logger, output := CreateTestLogger()
+	courier.SetLogger(logger)
+
+	result, err := courier.Deliver(CreateMultiRecipientMessage())
+	tst.Nil(err)
+	tst.True(result.Sent)
+
+	// no error reports the refusals, so they are logged
+	tst.Contains(output.String(), `level=WARN msg="recipient refused"`)
+	tst.Contains(output.String(), "recipient=unknown@email.com status=rejected")
+	tst.Contains(output.String(), "recipient=busy@email.com status=deferred")
+
+	accepted := result.Accepted()
+	tst.Len(accepted, 1)
+	tst.Equal("receiver@email.com", accepted[0].Recipient)
+	tst.Nil(accepted[0].Reply)
+
+	messages := srv.Messages()
+	tst.Len(messages, 1)
+	tst.Equal([]string{"receiver@email.com"}, messages[0].To)
+}
+
+func TestCourier_DeliverNoRecipientAccepted(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Recipient: "receiver@email.com", Reply: "451 4.3.0 Try again later"})
+	})
+	courier := CreateTestCourier(srv, EncryptionNone)
+	courier.SetRecipientPolicy(RequireAnyRecipient)
+
+	result, err := courier.Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "1 of 1 recipient(s) refused")
+	tst.True(IsTransient(err))
+	tst.False(result.Sent)
+	tst.Len(srv.Messages(), 0)
+
+	var smtpErr *SMTPError
+	tst.True(errors.As(err, &smtpErr))
+	tst.Equal(451, smtpErr.Code)
+}
+
+func TestCourierPool_RecipientRefusalKeepsSession(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := startRefusingServer(t)
+	pool := NewCourierPool(CreateTestCourier(srv, EncryptionNone), 1)
+	defer pool.Close()
+
+	_, err := pool.Deliver(CreateMultiRecipientMessage())
+	tst.NotNil(err)
+
+	result, err := pool.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.True(result.Sent)
+	tst.Equal(1, srv.Connections())
+}
+
+func TestParseRecipientPolicy(t *testing.T) {
+	tst := assert.New(t)
+
+	policy, err := ParseRecipientPolicy("")
+	tst.Nil(err)
+	tst.Equal(RequireAllRecipients, policy)
+
+	policy, err = ParseRecipientPolicy("Any")
+	tst.Nil(err)
+	tst.Equal(RequireAnyRecipient, policy)
+
+	_, err = ParseRecipientPolicy("most")
+	tst.ErrorContains(err, "'most' is not a valid recipient policy")
+}
@@ -0,0 +1,194 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how often, and how patiently, a failed
+// delivery is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first.
+	MaxAttempts int
+	// InitialDelay is the wait before the first retry.
+	InitialDelay time.Duration
+	// MaxDelay caps the wait between any two attempts.
+	MaxDelay time.Duration
+	// Multiplier grows the delay after every attempt.
+	Multiplier float64
+	// Jitter is the fraction (0 to 1) of each delay that is randomised,
+	// so that many clients failing together don't retry together.
+	Jitter float64
+	// Deadline, when set, is the total time allowed for all attempts.
+	// No retry is started that would begin after it.
+	Deadline time.Duration
+}
+
+// DefaultRetryPolicy tries up to 5 times, starting at one second
+// and doubling up to a minute between attempts.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: time.Second,
+		MaxDelay:     time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// HTTPRetryPolicy tries up to 3 times, starting at one second and
+// doubling up to 30 seconds, for HTTP email APIs. A Retry-After of more
+// than 30 seconds is not waited for.
+func HTTPRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Second,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// Delay returns the wait before the given retry, where retry 1 is
+// the wait after the first failed attempt.
+func (rp RetryPolicy) Delay(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+
+	multiplier := rp.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(rp.InitialDelay) * math.Pow(multiplier, float64(retry-1))
+	if rp.MaxDelay > 0 && delay > float64(rp.MaxDelay) {
+		delay = float64(rp.MaxDelay)
+	}
+
+	if rp.Jitter > 0 {
+		jitter := math.Min(rp.Jitter, 1)
+		delay -= delay * jitter * rand.Float64()
+	}
+
+	return time.Duration(delay)
+}
+
+// RetryTransport wraps a Transport, retrying deliveries that fail
+// with a transient error (see IsTransient) according to its policy.
+// Permanent failures are returned straight away. When the server, or
+// a RateLimitTransport's QuotaError, said how long to wait, the wait is
+// at least that long; a wait longer than the policy's MaxDelay, or one
+// that would end past its Deadline or that of the context, is not
+// waited for at all.
+type RetryTransport struct {
+	transport Transport
+	policy    RetryPolicy
+	sleep     func(context.Context, time.Duration) error
+}
+
+func NewRetryTransport(transport Transport, policy RetryPolicy) *RetryTransport {
+	return &RetryTransport{
+		transport: transport,
+		policy:    policy,
+		sleep:     sleepContext,
+	}
+}
+
+// sleepContext waits for the delay, or until ctx is done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rt *RetryTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return rt.SendParcel(parcel)
+}
+
+func (rt *RetryTransport) SendParcel(parcel *Parcel) error {
+	return rt.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport. Cancelling ctx stops
+// both the attempt in progress and any wait for the next one.
+func (rt *RetryTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := rt.DeliverParcelContext(ctx, parcel)
+	return err
+}
+
+// DeliverParcelContext implements ResultTransport, returning the result
+// of the last attempt when the wrapped transport reports one.
+func (rt *RetryTransport) DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	start := time.Now()
+	attempts := rt.policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var result *DeliveryResult
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		result, err = DeliverParcelContext(ctx, rt.transport, parcel)
+		if err == nil || !IsTransient(err) || ctx.Err() != nil {
+			return result, err
+		}
+		if attempt >= attempts {
+			break
+		}
+
+		delay := rt.policy.Delay(attempt)
+		if requested := requestedDelay(err); requested > delay {
+			if rt.policy.MaxDelay > 0 && requested > rt.policy.MaxDelay {
+				break
+			}
+			delay = requested
+		}
+		if rt.policy.Deadline > 0 && time.Since(start)+delay > rt.policy.Deadline {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			break
+		}
+		sleepErr := rt.sleep(ctx, delay)
+		if sleepErr != nil {
+			return result, fmt.Errorf("%w (last error: %s)", sleepErr, err)
+		}
+	}
+
+	return result, fmt.Errorf("giving up after %d attempt(s): %w", attempt, err)
+}
+
+// requestedDelay returns how long the server asked to be left alone
+// before the next attempt, or how long until a quota frees up, and 0
+// when there is no telling.
+func requestedDelay(err error) time.Duration {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.RetryAfter
+	}
+	var quotaErr *QuotaError
+	if errors.As(err, &quotaErr) {
+		return quotaErr.RetryAfter
+	}
+	return 0
+}
+
+func (rt *RetryTransport) Close() error {
+	return rt.transport.Close()
+}
@@ -0,0 +1,251 @@
+package guild
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCourier_RejectedRecipientIsSMTPError(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Recipient: "receiver@email.com", Reply: "550 5.1.1 User unknown"})
+	})
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	_, err := courier.Deliver(CreateTestMessage())
+
+	var smtpErr *SMTPError
+	tst.True(errors.As(err, &smtpErr))
+	tst.Equal(550, smtpErr.Code)
+	tst.Equal("5.1.1", smtpErr.EnhancedCode)
+	tst.Equal("User unknown", smtpErr.Message)
+	tst.True(smtpErr.Permanent())
+	tst.False(IsTransient(err))
+}
+
+// temporaryError is a third party error that knows whether it is
+// worth retrying.
+type temporaryError bool
+
+func (e temporaryError) Error() string {
+	return "temporary error"
+}
+
+func (e temporaryError) Temporary() bool {
+	return bool(e)
+}
+
+func TestIsTransient(t *testing.T) {
+	tst := assert.New(t)
+
+	tst.True(IsTransient(&SMTPError{Code: 421, Message: "try again later"}))
+	tst.False(IsTransient(&SMTPError{Code: 554, Message: "go away"}))
+
+	// any error with a Temporary method decides for itself, wrapped or not
+	tst.True(IsTransient(fmt.Errorf("relay: %w", temporaryError(true))))
+	tst.False(IsTransient(fmt.Errorf("relay: %w", temporaryError(false))))
+	tst.True(IsTransient(fmt.Errorf("dial: %w", syscall.ECONNREFUSED)))
+
+	// nothing is listening on a closed listener's port
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionNone)
+	srv.Close()
+	tst.True(IsTransient(courier.Send(CreateTestMessage())))
+}
+
+func TestIsTransient_CertificateErrors(t *testing.T) {
+	tst := assert.New(t)
+
+	tst.False(IsTransient(&url.Error{Op: "Post", URL: "https://api.email.com", Err: x509.UnknownAuthorityError{}}))
+	tst.False(IsTransient(&url.Error{Op: "Post", URL: "https://api.email.com", Err: &tls.CertificateVerificationError{Err: x509.CertificateInvalidError{Reason: x509.Expired}}}))
+	tst.False(IsTransient(&net.OpError{Op: "dial", Net: "tcp", Err: x509.HostnameError{Host: "email.com"}}))
+	tst.False(IsTransient(fmt.Errorf("starttls: %w", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"})))
+
+	// a server that won't verify is not retried
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferStartTLS = true
+	})
+	courier := NewCourier(srv.Host(), srv.Port(), "", "")
+	courier.SetEncryption(EncryptionStartTLSRequired)
+	err := courier.Send(CreateTestMessage())
+	tst.ErrorContains(err, "certificate")
+	tst.False(IsTransient(err))
+}
+
+func TestIsTransient_ContextErrors(t *testing.T) {
+	tst := assert.New(t)
+
+	tst.False(IsTransient(context.Canceled))
+	tst.False(IsTransient(fmt.Errorf("send: %w", context.DeadlineExceeded)))
+
+	// an http client's own timeout is worth another try
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	client := &http.Client{Timeout: 20 * time.Millisecond}
+	_, err := client.Get(srv.URL)
+	tst.ErrorIs(err, context.DeadlineExceeded)
+	tst.True(IsTransient(err))
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	tst := assert.New(t)
+
+	policy := RetryPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2,
+	}
+
+	tst.Equal(time.Second, policy.Delay(1))
+	tst.Equal(2*time.Second, policy.Delay(2))
+	tst.Equal(4*time.Second, policy.Delay(3))
+	tst.Equal(5*time.Second, policy.Delay(4))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		delay := policy.Delay(2)
+		tst.GreaterOrEqual(delay, time.Second)
+		tst.LessOrEqual(delay, 2*time.Second)
+	}
+}
+
+func CreateTestRetryTransport(srv *couriertest.Server, policy RetryPolicy) (*RetryTransport, *[]time.Duration) {
+	var delays []time.Duration
+	transport := NewRetryTransport(CreateTestCourier(srv, EncryptionNone), policy)
+	transport.sleep = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+	return transport, &delays
+}
+
+func TestRetryTransport_RetriesTransientReplies(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "451 4.3.0 Try again later", Times: 1})
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "421 4.7.0 Too busy", Times: 1})
+	})
+	transport, delays := CreateTestRetryTransport(srv, RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Second,
+		Multiplier:   2,
+	})
+
+	err := transport.Send(CreateTestMessage())
+	tst.Nil(err)
+	tst.Len(srv.Messages(), 1)
+	tst.Equal([]time.Duration{time.Second, 2 * time.Second}, *delays)
+}
+
+func TestRetryTransport_GivesUpAfterMaxAttempts(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "451 first", Times: 1})
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "451 second", Times: 1})
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "451 third", Times: 1})
+	})
+	transport, delays := CreateTestRetryTransport(srv, RetryPolicy{MaxAttempts: 2})
+
+	err := transport.Send(CreateTestMessage())
+
+	var smtpErr *SMTPError
+	tst.True(errors.As(err, &smtpErr))
+	tst.Equal("second", smtpErr.Message)
+	tst.ErrorContains(err, "giving up after 2 attempt(s)")
+	tst.Len(*delays, 1)
+}
+
+func TestRetryTransport_DoesNotRetryPermanentReplies(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "554 5.7.1 Sender rejected", Times: 1})
+	})
+	transport, delays := CreateTestRetryTransport(srv, DefaultRetryPolicy())
+
+	err := transport.Send(CreateTestMessage())
+
+	var smtpErr *SMTPError
+	tst.True(errors.As(err, &smtpErr))
+	tst.Equal(554, smtpErr.Code)
+	tst.Len(*delays, 0)
+	tst.Len(srv.Messages(), 0)
+}
+
+func TestRetryTransport_RespectsDeadline(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "451 busy", Times: 1})
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "451 busy", Times: 1})
+	})
+	transport, delays := CreateTestRetryTransport(srv, RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: time.Minute,
+		Deadline:     time.Second,
+	})
+
+	err := transport.Send(CreateTestMessage())
+	tst.ErrorContains(err, "giving up after 1 attempt(s)")
+	tst.Len(*delays, 0)
+}
+
+func TestRetryTransport_WaitsForQuota(t *testing.T) {
+	tst := assert.New(t)
+
+	limited, memory, now := CreateTestRateLimitTransport(RateLimit{PerSecond: 1})
+	limited.SetBlocking(false)
+	transport := NewRetryTransport(limited, RetryPolicy{MaxAttempts: 3, InitialDelay: 10 * time.Millisecond, MaxDelay: time.Minute})
+	var delays []time.Duration
+	transport.sleep = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		*now = now.Add(delay)
+		return nil
+	}
+
+	tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+	tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+	tst.Len(memory.Parcels(), 2)
+	// the second waits until the quota allows it, not the policy's 10ms
+	tst.Equal([]time.Duration{time.Second}, delays)
+}
+
+func TestRetryTransport_GivesUpOnLongQuota(t *testing.T) {
+	tst := assert.New(t)
+
+	limited, memory, _ := CreateTestRateLimitTransport(RateLimit{Daily: 1})
+	limited.SetBlocking(false)
+	transport := NewRetryTransport(limited, DefaultRetryPolicy())
+	var delays []time.Duration
+	transport.sleep = func(ctx context.Context, delay time.Duration) error {
+		delays = append(delays, delay)
+		return nil
+	}
+
+	tst.Nil(transport.SendParcel(CreateTestParcel("receiver@email.com")))
+	err := transport.SendParcel(CreateTestParcel("receiver@email.com"))
+
+	// the quota outlasts the policy's longest wait, so it isn't waited for
+	var quotaErr *QuotaError
+	tst.True(errors.As(err, &quotaErr))
+	tst.ErrorContains(err, "giving up after 1 attempt(s)")
+	tst.Len(delays, 0)
+	tst.Len(memory.Parcels(), 1)
+}
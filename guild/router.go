@@ -0,0 +1,212 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Route is an smtp endpoint a Router can deliver through.
+type Route struct {
+	Courier *Courier
+	// Priority orders the routes: lower values are tried first.
+	Priority int
+	// Weight shares the traffic between routes of the same priority.
+	// Zero counts as one.
+	Weight int
+}
+
+// Router delivers through the first healthy route that accepts the
+// message, much like mail exchangers are chosen from MX records.
+// Routes that fail transiently while connecting, at the greeting or at
+// MAIL FROM are marked unhealthy and tried last until their cool-down
+// has passed. Anything else, such as a permanent rejection or refused
+// recipients, is returned without trying other routes, as they would
+// only refuse the message too, or deliver it a second time.
+type Router struct {
+	routes   []Route
+	cooldown time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	random    *rand.Rand
+	unhealthy map[*Courier]time.Time
+}
+
+func NewRouter(routes ...Route) *Router {
+	return &Router{
+		routes:    routes,
+		cooldown:  30 * time.Second,
+		now:       time.Now,
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		unhealthy: map[*Courier]time.Time{},
+	}
+}
+
+// SetCooldown sets how long a failed route is avoided.
+func (rt *Router) SetCooldown(cooldown time.Duration) {
+	rt.cooldown = cooldown
+}
+
+// Healthy reports whether the route through courier is currently in use.
+func (rt *Router) Healthy(courier *Courier) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.healthy(courier)
+}
+
+func (rt *Router) healthy(courier *Courier) bool {
+	until, ok := rt.unhealthy[courier]
+	return !ok || !rt.now().Before(until)
+}
+
+// plan returns the couriers in the order they should be tried.
+func (rt *Router) plan() []*Courier {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	routes := append([]Route(nil), rt.routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority < routes[j].Priority
+	})
+
+	var ordered []*Courier
+	for start := 0; start < len(routes); {
+		end := start
+		for end < len(routes) && routes[end].Priority == routes[start].Priority {
+			end++
+		}
+		ordered = append(ordered, rt.shuffle(routes[start:end])...)
+		start = end
+	}
+
+	// unhealthy routes are a last resort
+	var healthy, resting []*Courier
+	for _, courier := range ordered {
+		if rt.healthy(courier) {
+			healthy = append(healthy, courier)
+		} else {
+			resting = append(resting, courier)
+		}
+	}
+	return append(healthy, resting...)
+}
+
+// shuffle orders routes of equal priority by weighted random draws.
+func (rt *Router) shuffle(routes []Route) []*Courier {
+	remaining := append([]Route(nil), routes...)
+	var ordered []*Courier
+	for len(remaining) > 0 {
+		total := 0
+		for _, route := range remaining {
+			total += routeWeight(route)
+		}
+		pick := rt.random.Intn(total)
+		for i, route := range remaining {
+			pick -= routeWeight(route)
+			if pick < 0 {
+				ordered = append(ordered, route.Courier)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+func routeWeight(route Route) int {
+	if route.Weight < 1 {
+		return 1
+	}
+	return route.Weight
+}
+
+func (rt *Router) mark(courier *Courier, healthy bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if healthy {
+		delete(rt.unhealthy, courier)
+	} else {
+		rt.unhealthy[courier] = rt.now().Add(rt.cooldown)
+	}
+}
+
+// Deliver sends the email through the first route that takes it. The
+// result's Host names the route that delivered it.
+func (rt *Router) Deliver(msg *smail.Email) (*DeliveryResult, error) {
+	return rt.DeliverContext(context.Background(), msg)
+}
+
+// DeliverContext is Deliver, giving up when ctx is cancelled.
+func (rt *Router) DeliverContext(ctx context.Context, msg *smail.Email) (*DeliveryResult, error) {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return nil, err
+	}
+	return rt.deliverParcel(ctx, parcel)
+}
+
+// SendParcel implements Transport.
+func (rt *Router) SendParcel(parcel *Parcel) error {
+	return rt.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport.
+func (rt *Router) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	_, err := rt.deliverParcel(ctx, parcel)
+	return err
+}
+
+// DeliverParcelContext implements ResultTransport.
+func (rt *Router) DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	return rt.deliverParcel(ctx, parcel)
+}
+
+func (rt *Router) deliverParcel(ctx context.Context, parcel *Parcel) (*DeliveryResult, error) {
+	couriers := rt.plan()
+	if len(couriers) == 0 {
+		return nil, fmt.Errorf("router has no routes")
+	}
+
+	var errs []error
+	for _, courier := range couriers {
+		result, err := courier.deliverParcel(ctx, parcel)
+		if err == nil {
+			rt.mark(courier, true)
+			return result, nil
+		}
+		if ctx.Err() != nil {
+			return result, err
+		}
+		if !IsTransient(err) || !failedBeforeRecipients(result) {
+			return result, err
+		}
+		rt.mark(courier, false)
+		errs = append(errs, fmt.Errorf("%s: %w", courier.address(), err))
+	}
+
+	return nil, fmt.Errorf("all %d route(s) failed: %w", len(couriers), errors.Join(errs...))
+}
+
+// failedBeforeRecipients reports whether a failed delivery ended before
+// any RCPT TO, which puts the blame on the route rather than on the
+// message or its recipients.
+func failedBeforeRecipients(result *DeliveryResult) bool {
+	return result == nil || len(result.Recipients) == 0
+}
+
+// Send implements Transport.
+func (rt *Router) Send(msg *smail.Email) error {
+	_, err := rt.Deliver(msg)
+	return err
+}
+
+// Close implements Transport.
+func (rt *Router) Close() error {
+	return nil
+}
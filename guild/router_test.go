@@ -0,0 +1,135 @@
+package guild
+
+import (
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRouter_FailsOverAndCoolsDown(t *testing.T) {
+	tst := assert.New(t)
+
+	primary := couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageGreeting, Reply: "421 4.3.2 Too busy", Times: 1})
+	})
+	backup := couriertest.NewServer(t, nil)
+
+	primaryCourier := CreateTestCourier(primary, EncryptionNone)
+	router := NewRouter(
+		Route{Courier: primaryCourier},
+		Route{Courier: CreateTestCourier(backup, EncryptionNone), Priority: 1},
+	)
+	now := time.Now()
+	router.now = func() time.Time { return now }
+
+	result, err := router.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.Equal(backup.Addr(), result.Host)
+	tst.False(router.Healthy(primaryCourier))
+
+	// the primary is left alone while it cools down
+	result, err = router.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.Equal(backup.Addr(), result.Host)
+	tst.Equal(1, primary.Connections())
+
+	now = now.Add(31 * time.Second)
+	result, err = router.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.Equal(primary.Addr(), result.Host)
+	tst.True(router.Healthy(primaryCourier))
+
+	tst.Len(primary.Messages(), 1)
+	tst.Len(backup.Messages(), 2)
+}
+
+func TestRouter_PermanentErrorsDoNotFailOver(t *testing.T) {
+	tst := assert.New(t)
+
+	primary := couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageMail, Reply: "554 5.7.1 Sender rejected"})
+	})
+	backup := couriertest.NewServer(t, nil)
+
+	router := NewRouter(
+		Route{Courier: CreateTestCourier(primary, EncryptionNone)},
+		Route{Courier: CreateTestCourier(backup, EncryptionNone), Priority: 1},
+	)
+
+	_, err := router.Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "554 5.7.1 Sender rejected")
+	tst.Equal(0, backup.Connections())
+}
+
+func TestRouter_RefusedRecipientsDoNotFailOver(t *testing.T) {
+	tst := assert.New(t)
+
+	primary := couriertest.NewServer(t, func(srv *couriertest.Server) {
+		srv.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Reply: "452 4.2.2 Mailbox full"})
+	})
+	backup := couriertest.NewServer(t, nil)
+
+	primaryCourier := CreateTestCourier(primary, EncryptionNone)
+	router := NewRouter(
+		Route{Courier: primaryCourier},
+		Route{Courier: CreateTestCourier(backup, EncryptionNone), Priority: 1},
+	)
+
+	_, err := router.Deliver(CreateTestMessage())
+	var rcptErr *RecipientError
+	tst.True(errors.As(err, &rcptErr))
+	tst.True(IsTransient(err))
+	// the route is fine, it is the recipient that has to wait
+	tst.True(router.Healthy(primaryCourier))
+	tst.Equal(0, backup.Connections())
+}
+
+func TestRouter_AllRoutesFail(t *testing.T) {
+	tst := assert.New(t)
+
+	first := couriertest.NewServer(t, nil)
+	second := couriertest.NewServer(t, nil)
+	router := NewRouter(
+		Route{Courier: CreateTestCourier(first, EncryptionNone)},
+		Route{Courier: CreateTestCourier(second, EncryptionNone)},
+	)
+	first.Close()
+	second.Close()
+
+	_, err := router.Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "all 2 route(s) failed")
+	tst.ErrorContains(err, first.Addr())
+	tst.ErrorContains(err, second.Addr())
+	tst.True(IsTransient(err))
+
+	_, err = NewRouter().Deliver(CreateTestMessage())
+	tst.ErrorContains(err, "router has no routes")
+}
+
+func TestRouter_Weights(t *testing.T) {
+	tst := assert.New(t)
+
+	heavy := NewCourier("heavy.example.com", 25, "", "")
+	light := NewCourier("light.example.com", 25, "", "")
+	backup := NewCourier("backup.example.com", 25, "", "")
+
+	router := NewRouter(
+		Route{Courier: heavy, Weight: 3},
+		Route{Courier: light, Weight: 1},
+		Route{Courier: backup, Priority: 1, Weight: 100},
+	)
+	router.random = rand.New(rand.NewSource(1))
+
+	firsts := map[*Courier]int{}
+	for i := 0; i < 1000; i++ {
+		plan := router.plan()
+		tst.Len(plan, 3)
+		tst.Equal(backup, plan[2])
+		firsts[plan[0]]++
+	}
+	tst.InDelta(750, firsts[heavy], 60)
+	tst.InDelta(250, firsts[light], 60)
+}
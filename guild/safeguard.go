@@ -0,0 +1,94 @@
+package guild
+
+import (
+	"fmt"
+	"net/mail"
+	"path"
+	"strings"
+)
+
+// Safeguard keeps mail sent from a staging or test system away from
+// real people. Recipients that match the allow-list are left alone;
+// the rest are redirected to the catch-all address when one is set,
+// and dropped when not.
+type Safeguard struct {
+	redirectTo mail.Address
+	allowed    []string
+}
+
+func NewSafeguard() *Safeguard {
+	return &Safeguard{}
+}
+
+// SetRedirect sends every recipient that is not allowed to the
+// catch-all address instead.
+func (sg *Safeguard) SetRedirect(address string) error {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a valid redirect address: %w", address, err)
+	}
+	sg.redirectTo = *parsed
+	return nil
+}
+
+// Allow adds patterns for the recipients that may be sent to. A
+// pattern with an '@' is matched against the whole address, otherwise
+// against the domain, which then also covers its subdomains. Patterns
+// may use path.Match wildcards, such as "qa+*@example.com" or
+// "*.example.com".
+func (sg *Safeguard) Allow(patterns ...string) error {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("'%s' is not a valid recipient pattern", pattern)
+		}
+		sg.allowed = append(sg.allowed, pattern)
+	}
+	return nil
+}
+
+// Allowed reports whether the address matches the allow-list.
+func (sg *Safeguard) Allowed(address string) bool {
+	address = strings.ToLower(address)
+	_, domain, _ := strings.Cut(address, "@")
+	for _, pattern := range sg.allowed {
+		if strings.Contains(pattern, "@") {
+			if ok, _ := path.Match(pattern, address); ok {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, domain); ok || strings.HasSuffix(domain, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// SafeguardReport lists the recipients a Safeguard kept from the
+// message.
+type SafeguardReport struct {
+	// RedirectedTo is the catch-all address, when there is one.
+	RedirectedTo string
+	Redirected   []string
+	Dropped      []string
+}
+
+// Changed reports whether any recipient was redirected or dropped.
+func (r *SafeguardReport) Changed() bool {
+	return len(r.Redirected) > 0 || len(r.Dropped) > 0
+}
+
+func (r *SafeguardReport) String() string {
+	var parts []string
+	if len(r.Redirected) > 0 {
+		parts = append(parts, fmt.Sprintf("redirected %s to %s", strings.Join(r.Redirected, ", "), r.RedirectedTo))
+	}
+	if len(r.Dropped) > 0 {
+		parts = append(parts, fmt.Sprintf("dropped %s", strings.Join(r.Dropped, ", ")))
+	}
+	if len(parts) == 0 {
+		return "no recipients changed"
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,95 @@
+package guild
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func CreateTestSafeguardEnvelope() *Envelope {
+	em := NewEnvelope(ValidationPolicy{})
+	em.SetFromAddress("sender@email.com")
+	em.AddToAddresses([]string{"customer@client.com", "dev@staging.example.com"})
+	em.AddCcAddress("qa+orders@email.com")
+	em.AddBccAddress("audit@client.com")
+	return em
+}
+
+func TestSafeguard_Allowed(t *testing.T) {
+	tst := assert.New(t)
+
+	sg := NewSafeguard()
+	tst.Nil(sg.Allow("example.com", "qa+*@email.com", "*.test"))
+
+	tst.True(sg.Allowed("someone@example.com"))
+	tst.True(sg.Allowed("Someone@Staging.Example.com"))
+	tst.True(sg.Allowed("qa+orders@email.com"))
+	tst.True(sg.Allowed("anyone@mail.test"))
+	tst.False(sg.Allowed("someone@notexample.com"))
+	tst.False(sg.Allowed("qa@email.com"))
+
+	tst.ErrorContains(sg.Allow("[email.com"), "'[email.com' is not a valid recipient pattern")
+	tst.ErrorContains(sg.SetRedirect("not an address"), "is not a valid redirect address")
+}
+
+func TestEnvelope_SafeguardRedirect(t *testing.T) {
+	tst := assert.New(t)
+
+	sg := NewSafeguard()
+	tst.Nil(sg.SetRedirect("Catch All <catchall@email.com>"))
+	tst.Nil(sg.Allow("example.com"))
+
+	em := CreateTestSafeguardEnvelope()
+	report := em.ApplySafeguard(sg)
+	tst.True(report.Changed())
+	tst.Equal("catchall@email.com", report.RedirectedTo)
+	tst.Equal([]string{"audit@client.com", "customer@client.com", "qa+orders@email.com"}, report.Redirected)
+	tst.Empty(report.Dropped)
+	tst.Contains(report.String(), "redirected audit@client.com, customer@client.com, qa+orders@email.com to catchall@email.com")
+
+	msg := NewMessage()
+	msg.SetSubject("Safeguard Test")
+	msg.SetTextBody("This is the safeguard test body.")
+	msg.Seal(em)
+
+	parcel, err := NewParcel(msg.Message())
+	tst.Nil(err)
+	tst.ElementsMatch([]string{"catchall@email.com", "dev@staging.example.com"}, parcel.Recipients)
+
+	parsed, err := mail.ReadMessage(strings.NewReader(parcel.Data))
+	tst.Nil(err)
+	originals, err := parsed.Header.AddressList("X-Original-To")
+	tst.Nil(err)
+	tst.Len(originals, 2)
+	// a redirected bcc recipient is reported but never shown
+	tst.NotContains(parcel.Data, "audit@client.com")
+	tst.Empty(parsed.Header.Get("Cc"))
+	tst.Contains(parsed.Header.Get("To"), "<catchall@email.com>")
+}
+
+func TestEnvelope_SafeguardAllowList(t *testing.T) {
+	tst := assert.New(t)
+
+	sg := NewSafeguard()
+	tst.Nil(sg.Allow("example.com", "qa+*@email.com"))
+
+	em := CreateTestSafeguardEnvelope()
+	report := em.ApplySafeguard(sg)
+	tst.Equal([]string{"audit@client.com", "customer@client.com"}, report.Dropped)
+	tst.Equal("dropped audit@client.com, customer@client.com", report.String())
+
+	msg := NewMessage()
+	msg.SetSubject("Safeguard Test")
+	msg.SetTextBody("This is the safeguard test body.")
+	msg.Seal(em)
+
+	parcel, err := NewParcel(msg.Message())
+	tst.Nil(err)
+	tst.ElementsMatch([]string{"dev@staging.example.com", "qa+orders@email.com"}, parcel.Recipients)
+	tst.NotContains(parcel.Data, "X-Original-To")
+	tst.NotContains(parcel.Data, "client.com")
+
+	// nothing changes when every recipient is allowed
+	tst.False(em.ApplySafeguard(sg).Changed())
+}
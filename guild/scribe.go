@@ -1,6 +1,7 @@
 package guild
 
 import (
+	"context"
 	"fmt"
 	smail "github.com/xhit/go-simple-mail/v2"
 	"regexp"
@@ -24,6 +25,7 @@ type Scribe interface {
 	Close()
 	Seal(*Envelope) Scribe
 	Compose(...any) Scribe
+	ComposeContext(context.Context, ...any) Scribe
 	Message() *smail.Email
 	HasErrors() bool
 	GetErrors() error
@@ -37,6 +39,7 @@ type SimpleTextScribe struct {
 	text         string
 	html         string
 	attachments  []*smail.File
+	errors       []error
 }
 
 func (sts *SimpleTextScribe) SetPriority(isHigh bool) {
@@ -78,18 +81,36 @@ func (sts *SimpleTextScribe) Open() (*Message, error) {
 
 func (sts *SimpleTextScribe) Close() {
 	sts.message = nil
+	sts.errors = nil
+}
+
+func (sts *SimpleTextScribe) addError(err error) {
+	sts.errors = append(sts.errors, err)
 }
 
 func (sts *SimpleTextScribe) HasErrors() bool {
-	// TODO: reallY?
-	return false
+	return len(sts.errors) > 0
 }
 
 func (sts *SimpleTextScribe) GetErrors() error {
-	return nil
+	if !sts.HasErrors() {
+		return nil
+	}
+	return &errorList{format: "Scribe encountered %d error(s): %s", errs: sts.errors}
 }
 
 func (sts *SimpleTextScribe) Compose(ctx ...any) Scribe {
+	return sts.ComposeContext(context.Background(), ctx...)
+}
+
+// ComposeContext is Compose, declining to write the message if
+// cctx has already been cancelled.
+func (sts *SimpleTextScribe) ComposeContext(cctx context.Context, ctx ...any) Scribe {
+	if err := cctx.Err(); err != nil {
+		sts.addError(err)
+		return sts
+	}
+
 	sts.message.SetPriority(sts.highPriority)
 	sts.message.SetSubject(sts.subject)
 	sts.message.SetTextBody(sts.text)
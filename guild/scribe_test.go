@@ -1,6 +1,7 @@
 package guild
 
 import (
+	"context"
 	"fmt"
 	"github.com/flosch/pongo2/v6"
 	"github.com/stretchr/testify/assert"
@@ -175,3 +176,26 @@ func TestPongoScribe_RenderHtmlWithStyles(t *testing.T) {
 	tst.Contains(msg, `<p style=3D"color:red">STATIC HTML BODY</p>`, "Missing html body.")
 
 }
+
+func TestPongoScribe_ComposeContextCancelled(t *testing.T) {
+	tst := assert.New(t)
+
+	scribe := CreateTestPongoScribe()
+
+	_, err := scribe.Open()
+	tst.Nil(err)
+
+	defer func() {
+		scribe.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	scribe.ComposeContext(ctx, pongo2.Context{
+		"subject": "TEST",
+	})
+
+	tst.True(scribe.HasErrors())
+	tst.ErrorContains(scribe.GetErrors(), context.Canceled.Error())
+}
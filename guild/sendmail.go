@@ -0,0 +1,110 @@
+package guild
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"os/exec"
+	"strings"
+)
+
+// DefaultSendmailPath is where sendmail lives on most systems.
+const DefaultSendmailPath = "/usr/sbin/sendmail"
+
+// exTempFail is the sysexits.h status for a temporary failure.
+const exTempFail = 75
+
+// SendmailError is returned when the sendmail binary fails.
+type SendmailError struct {
+	Path string
+	// ExitCode is -1 when the binary could not be run at all.
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *SendmailError) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("%s failed: %s: %s", e.Path, e.Err, e.Stderr)
+	}
+	return fmt.Sprintf("%s failed: %s", e.Path, e.Err)
+}
+
+func (e *SendmailError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether sendmail exited with EX_TEMPFAIL.
+func (e *SendmailError) Temporary() bool {
+	return e.ExitCode == exTempFail
+}
+
+// SendmailTransport hands messages to the local MTA through a
+// sendmail compatible binary. The envelope is given on the command
+// line, "-i -f <from> -- <recipients...>", rather than read from the
+// headers with -t, so that Bcc recipients are delivered.
+type SendmailTransport struct {
+	path string
+	args []string
+}
+
+// NewSendmailTransport runs the binary at path, or DefaultSendmailPath
+// when path is empty. The args are passed before the envelope options.
+func NewSendmailTransport(path string, args ...string) *SendmailTransport {
+	if path == "" {
+		path = DefaultSendmailPath
+	}
+	return &SendmailTransport{path: path, args: args}
+}
+
+func (st *SendmailTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return st.SendParcel(parcel)
+}
+
+func (st *SendmailTransport) SendParcel(parcel *Parcel) error {
+	return st.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport. Cancelling ctx kills
+// the sendmail process.
+func (st *SendmailTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	args := append([]string(nil), st.args...)
+	args = append(args, "-i", "-f", parcel.From, "--")
+	args = append(args, parcel.Recipients...)
+
+	cmd := exec.CommandContext(ctx, st.path, args...)
+	// sendmail expects local line endings
+	cmd.Stdin = strings.NewReader(strings.ReplaceAll(parcel.Data, "\r\n", "\n"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	sendmailErr := &SendmailError{
+		Path:     st.path,
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		sendmailErr.ExitCode = exitErr.ExitCode()
+	}
+	return sendmailErr
+}
+
+func (st *SendmailTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// createStubSendmail writes a script that records its arguments and
+// input, then exits with the given status after writing stderr.
+func createStubSendmail(t *testing.T, status int, stderr string) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the sendmail stub is a shell script")
+	}
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sendmail")
+	content := "#!/bin/sh\n" +
+		"printf '%s\\n' \"$@\" > \"" + filepath.Join(dir, "args") + "\"\n" +
+		"cat > \"" + filepath.Join(dir, "input") + "\"\n" +
+		"printf '" + stderr + "' >&2\n" +
+		"exit " + strconv.Itoa(status) + "\n"
+	err := os.WriteFile(script, []byte(content), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script, dir
+}
+
+func TestSendmailTransport_PipesMessage(t *testing.T) {
+	tst := assert.New(t)
+
+	script, dir := createStubSendmail(t, 0, "")
+	transport := NewSendmailTransport(script, "-oi")
+
+	msg := CreateTestMessage()
+	msg.AddBcc("hidden@email.com")
+	tst.Nil(transport.Send(msg))
+
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	tst.Nil(err)
+	tst.Equal("-oi\n-i\n-f\nsender@email.com\n--\nreceiver@email.com\nhidden@email.com\n", string(args))
+
+	input, err := os.ReadFile(filepath.Join(dir, "input"))
+	tst.Nil(err)
+	tst.Contains(string(input), "Subject: Courier Test\n")
+	tst.NotContains(string(input), "\r\n")
+}
+
+func TestSendmailTransport_Failure(t *testing.T) {
+	tst := assert.New(t)
+
+	script, _ := createStubSendmail(t, 75, "queue directory is full")
+	err := NewSendmailTransport(script).Send(CreateTestMessage())
+
+	var sendmailErr *SendmailError
+	tst.True(errors.As(err, &sendmailErr))
+	tst.Equal(75, sendmailErr.ExitCode)
+	tst.Equal("queue directory is full", sendmailErr.Stderr)
+	tst.ErrorContains(err, "exit status 75: queue directory is full")
+	tst.True(IsTransient(err))
+
+	script, _ = createStubSendmail(t, 67, "user unknown")
+	err = NewSendmailTransport(script).Send(CreateTestMessage())
+	tst.False(IsTransient(err))
+
+	err = NewSendmailTransport(filepath.Join(t.TempDir(), "missing")).Send(CreateTestMessage())
+	tst.True(errors.As(err, &sendmailErr))
+	tst.Equal(-1, sendmailErr.ExitCode)
+}
+
+func TestSendmailTransport_Context(t *testing.T) {
+	tst := assert.New(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the sendmail stub is a shell script")
+	}
+	script := filepath.Join(t.TempDir(), "sendmail")
+	tst.Nil(os.WriteFile(script, []byte("#!/bin/sh\nexec sleep 5\n"), 0o755))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	parcel, err := NewParcel(CreateTestMessage())
+	tst.Nil(err)
+	err = NewSendmailTransport(script).SendParcelContext(ctx, parcel)
+	tst.ErrorIs(err, context.DeadlineExceeded)
+
+	tst.Equal(DefaultSendmailPath, NewSendmailTransport("").path)
+}
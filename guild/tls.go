@@ -0,0 +1,106 @@
+package guild
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Encryption defines how the Courier secures its connection to
+// the smtp server.
+type Encryption int
+
+const (
+	// EncryptionNone talks to the server in plain text.
+	EncryptionNone Encryption = iota
+	// EncryptionTLS connects using implicit TLS (typically port 465).
+	EncryptionTLS
+	// EncryptionStartTLS upgrades the connection with STARTTLS when the
+	// server advertises it, and carries on in plain text when it does not.
+	EncryptionStartTLS
+	// EncryptionStartTLSRequired upgrades the connection with STARTTLS
+	// (typically port 587) and refuses to continue if the server does not
+	// support it.
+	EncryptionStartTLSRequired
+)
+
+var encryptionNames = map[Encryption]string{
+	EncryptionNone:             "none",
+	EncryptionTLS:              "tls",
+	EncryptionStartTLS:         "starttls",
+	EncryptionStartTLSRequired: "starttls-required",
+}
+
+func (e Encryption) String() string {
+	if name, ok := encryptionNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Encryption(%d)", int(e))
+}
+
+// ParseEncryption converts one of "none", "tls", "starttls" or
+// "starttls-required" into an Encryption value. An empty string
+// is treated as "none".
+func ParseEncryption(name string) (Encryption, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return EncryptionNone, nil
+	}
+	for enc, encName := range encryptionNames {
+		if encName == name {
+			return enc, nil
+		}
+	}
+	return EncryptionNone, fmt.Errorf("'%s' is not a valid encryption mode", name)
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version string such as "1.2" into its
+// crypto/tls constant. An empty string returns 0, which leaves the
+// choice to crypto/tls.
+func ParseTLSVersion(version string) (uint16, error) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "TLS")
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[strings.TrimSpace(version)]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("'%s' is not a valid TLS version", version)
+}
+
+// NewTLSConfig builds a tls.Config from the commonly needed options.
+// caFile is an optional PEM bundle of trusted root certificates,
+// serverName overrides the name used to verify the server certificate,
+// and minVersion is an optional minimum TLS version (e.g. "1.2").
+func NewTLSConfig(caFile, serverName, minVersion string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+
+	version, err := ParseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	config.MinVersion = version
+
+	if !emptyString(caFile) {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle '%s'", caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
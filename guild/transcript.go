@@ -0,0 +1,214 @@
+package guild
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// transcriptDataLines is how many lines of message data are logged.
+const transcriptDataLines = 10
+
+const (
+	clientSide = iota
+	serverSide
+)
+
+// transcript logs an smtp conversation line by line as it happens,
+// with AUTH credentials redacted and the message data cut short.
+//
+// The conversation is tapped at the connection until STARTTLS, where
+// tapping stops so that the encrypted bytes are not logged, and is
+// tapped again at the smtp client's text connection once TLS is up.
+// Each tap carries the generation it belongs to, so that a stale tap
+// is ignored.
+type transcript struct {
+	logger *slog.Logger
+	host   string
+
+	mu            sync.Mutex
+	generation    int
+	partial       [2][]byte
+	auth          bool
+	startTLS      bool
+	dataRequested bool
+	data          bool
+	dataLines     int
+}
+
+func newTranscript(logger *slog.Logger, host string) *transcript {
+	return &transcript{logger: logger, host: host}
+}
+
+// tapConn returns conn with everything read and written logged.
+func (t *transcript) tapConn(conn net.Conn) net.Conn {
+	t.mu.Lock()
+	generation := t.generation
+	t.mu.Unlock()
+	return &transcriptConn{Conn: conn, transcript: t, generation: generation}
+}
+
+// tapText taps a text connection set up after STARTTLS, resuming
+// the transcript.
+func (t *transcript) tapText(text *textproto.Conn) {
+	t.mu.Lock()
+	t.generation++
+	generation := t.generation
+	t.partial = [2][]byte{}
+	t.mu.Unlock()
+
+	text.Reader.R = bufio.NewReader(io.TeeReader(text.Reader.R, &transcriptWriter{transcript: t, side: serverSide, generation: generation}))
+	text.Writer.W = bufio.NewWriter(io.MultiWriter(
+		&flushWriter{w: text.Writer.W},
+		&transcriptWriter{transcript: t, side: clientSide, generation: generation},
+	))
+	t.log("--", "TLS established")
+}
+
+func (t *transcript) log(direction, line string) {
+	t.logger.LogAttrs(context.Background(), slog.LevelDebug, "smtp",
+		slog.String("host", t.host),
+		slog.String("direction", direction),
+		slog.String("line", line),
+	)
+}
+
+// record splits the bytes into lines and logs each complete one.
+func (t *transcript) record(generation, side int, p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.generation != generation {
+		return
+	}
+	t.partial[side] = append(t.partial[side], p...)
+	for t.generation == generation {
+		end := bytes.IndexByte(t.partial[side], '\n')
+		if end < 0 {
+			return
+		}
+		line := strings.TrimSuffix(string(t.partial[side][:end]), "\r")
+		t.partial[side] = t.partial[side][end+1:]
+		if side == clientSide {
+			t.clientLine(line)
+		} else {
+			t.serverLine(line)
+		}
+	}
+}
+
+func (t *transcript) clientLine(line string) {
+	switch {
+	case t.data:
+		if line == "." {
+			if t.dataLines > transcriptDataLines {
+				t.log("C", fmt.Sprintf("[%d more line(s) of message data]", t.dataLines-transcriptDataLines))
+			}
+			t.data, t.dataLines = false, 0
+			t.log("C", line)
+			return
+		}
+		t.dataLines++
+		if t.dataLines <= transcriptDataLines {
+			t.log("C", line)
+		}
+		return
+	case t.auth:
+		t.log("C", "[redacted]")
+		return
+	}
+
+	verb, arg, _ := strings.Cut(line, " ")
+	switch strings.ToUpper(verb) {
+	case "AUTH":
+		t.auth = true
+		if mechanism, _, initial := strings.Cut(arg, " "); initial {
+			line = verb + " " + mechanism + " [redacted]"
+		}
+	case "DATA":
+		t.dataRequested = true
+	case "STARTTLS":
+		t.startTLS = true
+	}
+	t.log("C", line)
+}
+
+func (t *transcript) serverLine(line string) {
+	t.log("S", line)
+
+	// only the last line of a multi-line reply, "250 OK" rather than
+	// "250-SIZE", settles the command
+	if len(line) > 3 && line[3] == '-' {
+		return
+	}
+	if t.auth && !strings.HasPrefix(line, "334") {
+		t.auth = false
+	}
+	if t.dataRequested {
+		t.dataRequested = false
+		t.data = strings.HasPrefix(line, "354")
+	}
+	if t.startTLS {
+		t.startTLS = false
+		if strings.HasPrefix(line, "220") {
+			// what follows is encrypted, until tapText resumes
+			t.generation++
+			t.log("--", "starting TLS")
+		}
+	}
+}
+
+// transcriptConn is a connection whose traffic is recorded.
+type transcriptConn struct {
+	net.Conn
+	transcript *transcript
+	generation int
+}
+
+func (c *transcriptConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.transcript.record(c.generation, serverSide, p[:n])
+	}
+	return n, err
+}
+
+func (c *transcriptConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.transcript.record(c.generation, clientSide, p[:n])
+	}
+	return n, err
+}
+
+// transcriptWriter records what is written to it.
+type transcriptWriter struct {
+	transcript *transcript
+	side       int
+	generation int
+}
+
+func (w *transcriptWriter) Write(p []byte) (int, error) {
+	w.transcript.record(w.generation, w.side, p)
+	return len(p), nil
+}
+
+// flushWriter writes straight through a buffered writer.
+type flushWriter struct {
+	w *bufio.Writer
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.w.Flush()
+}
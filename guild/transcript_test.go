@@ -0,0 +1,115 @@
+package guild
+
+import (
+	"bytes"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func CreateTestLogger() (*slog.Logger, *bytes.Buffer) {
+	var output bytes.Buffer
+	handler := slog.NewTextHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return slog.New(handler), &output
+}
+
+func CreateLongTestMessage() *Message {
+	msg := NewMessage()
+	msg.SetSubject("Courier Test")
+	msg.SetTextBody(strings.Repeat("This is a line of the courier test body.\r\n", 50))
+	msg.Seal(CreateEnvelope())
+	return msg
+}
+
+func TestCourier_Transcript(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferAuth = true
+		s.AuthMechanisms = []string{"LOGIN"}
+		s.Users = map[string]string{"courier": "seekrit"}
+	})
+	courier := NewCourier(srv.Host(), srv.Port(), "courier", "seekrit")
+	courier.SetAuthMechanism(AuthLogin)
+	logger, output := CreateTestLogger()
+	courier.SetLogger(logger)
+
+	_, err := courier.Deliver(CreateLongTestMessage().Message())
+	tst.Nil(err)
+
+	transcript := output.String()
+	tst.Contains(transcript, `direction=S line="220 localhost ESMTP courier test"`)
+	tst.Contains(transcript, `direction=C line="EHLO localhost"`)
+	tst.Contains(transcript, `direction=C line="AUTH LOGIN"`)
+	tst.Contains(transcript, `direction=C line=[redacted]`)
+	tst.Contains(transcript, `line="235 2.7.0 Authentication successful"`)
+	tst.Contains(transcript, `direction=C line="MAIL FROM:<sender@email.com>`)
+	tst.Contains(transcript, `direction=S line="354 Go ahead"`)
+	tst.Contains(transcript, "more line(s) of message data]")
+	tst.Contains(transcript, `direction=C line=.`)
+	tst.Contains(transcript, `direction=C line=QUIT`)
+	tst.Contains(transcript, "host="+srv.Addr())
+
+	tst.NotContains(transcript, "seekrit")
+	// base64 of the user name and password
+	tst.NotContains(transcript, "Y291cmllcg==")
+	tst.NotContains(transcript, "c2Vla3JpdA==")
+	tst.Less(strings.Count(transcript, "This is a line of the courier test body."), 10)
+}
+
+func TestCourier_TranscriptInitialResponse(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferAuth = true
+		s.AuthMechanisms = []string{"PLAIN"}
+	})
+	courier := NewCourier(srv.Host(), srv.Port(), "courier", "seekrit")
+	logger, output := CreateTestLogger()
+	courier.SetLogger(logger)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.Contains(output.String(), `direction=C line="AUTH PLAIN [redacted]"`)
+	tst.Contains(output.String(), `direction=C line="RCPT TO:<receiver@email.com>"`)
+}
+
+func TestCourier_TranscriptStartTLS(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.OfferStartTLS = true
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Reply: "550 5.1.1 No such user"})
+	})
+	courier := CreateTestCourier(srv, EncryptionStartTLSRequired)
+	logger, output := CreateTestLogger()
+	courier.SetLogger(logger)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.NotNil(err)
+
+	transcript := output.String()
+	tst.Contains(transcript, `direction=C line=STARTTLS`)
+	tst.Contains(transcript, `direction=S line="220 Ready to start TLS"`)
+	tst.Contains(transcript, `line="TLS established"`)
+	// the failure is visible after the switch to TLS
+	tst.Contains(transcript, `direction=C line="MAIL FROM:<sender@email.com>`)
+	tst.Contains(transcript, `direction=S line="550 5.1.1 No such user"`)
+
+	for _, line := range strings.Split(strings.TrimSpace(transcript), "\n") {
+		tst.True(strings.HasPrefix(line, "time="), "unexpected output %q", line)
+	}
+}
+
+func TestCourier_NoTranscript(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+	courier := CreateTestCourier(srv, EncryptionNone)
+
+	_, err := courier.Deliver(CreateTestMessage())
+	tst.Nil(err)
+	tst.Nil(courier.logger)
+}
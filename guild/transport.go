@@ -0,0 +1,163 @@
+package guild
+
+import (
+	"context"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"sync"
+)
+
+// Transport is anything that can take a sealed message and see it
+// delivered. The smtp Courier is the standard Transport, but messages
+// can just as well be dropped into files, piped to a local binary or
+// captured in memory.
+//
+// Send accepts the email as produced by a Scribe, while SendParcel
+// accepts a message that has already been rendered, such as one
+// read back from a spool.
+type Transport interface {
+	Send(msg *smail.Email) error
+	SendParcel(parcel *Parcel) error
+	Close() error
+}
+
+// ContextTransport is implemented by transports that can abandon a
+// delivery when its context is cancelled or its deadline passes.
+type ContextTransport interface {
+	Transport
+	SendParcelContext(ctx context.Context, parcel *Parcel) error
+}
+
+// ResultTransport is implemented by the smtp and lmtp transports, which
+// can tell which server took the message and what it said to each
+// recipient.
+type ResultTransport interface {
+	ContextTransport
+	DeliverParcelContext(ctx context.Context, parcel *Parcel) (*DeliveryResult, error)
+}
+
+// SendContext renders the sealed message and sends it with the
+// transport, honouring ctx as far as the transport allows.
+func SendContext(ctx context.Context, transport Transport, msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return SendParcelContext(ctx, transport, parcel)
+}
+
+// SendParcelContext sends the parcel with the transport. Transports
+// that implement ContextTransport are handed the context; any other
+// transport is only checked for cancellation before it is called.
+func SendParcelContext(ctx context.Context, transport Transport, parcel *Parcel) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	if ct, ok := transport.(ContextTransport); ok {
+		return ct.SendParcelContext(ctx, parcel)
+	}
+	return transport.SendParcel(parcel)
+}
+
+// DeliverContext is SendContext, also returning the DeliveryResult of
+// a ResultTransport. The result is nil for any other transport.
+func DeliverContext(ctx context.Context, transport Transport, msg *smail.Email) (*DeliveryResult, error) {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return nil, err
+	}
+	return DeliverParcelContext(ctx, transport, parcel)
+}
+
+// DeliverParcelContext is SendParcelContext, also returning the
+// DeliveryResult of a ResultTransport.
+func DeliverParcelContext(ctx context.Context, transport Transport, parcel *Parcel) (*DeliveryResult, error) {
+	if rt, ok := transport.(ResultTransport); ok {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		return rt.DeliverParcelContext(ctx, parcel)
+	}
+	return nil, SendParcelContext(ctx, transport, parcel)
+}
+
+// Parcel is a sealed message reduced to what a Transport needs to
+// deliver it: the smtp envelope and the raw message text.
+type Parcel struct {
+	From       string   `json:"from"`
+	Recipients []string `json:"recipients"`
+	Data       string   `json:"data"`
+}
+
+// NewParcel validates the sealed message and packs it into a Parcel.
+func NewParcel(msg *smail.Email) (*Parcel, error) {
+	if msg.Error != nil {
+		return nil, msg.Error
+	}
+
+	recipients := msg.GetRecipients()
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("message has no recipients")
+	}
+
+	return &Parcel{
+		From:       msg.GetFrom(),
+		Recipients: append([]string(nil), recipients...),
+		Data:       rawMessage(msg),
+	}, nil
+}
+
+// MemoryTransport keeps every message it is sent, which makes it
+// useful for tests and dry runs.
+type MemoryTransport struct {
+	mu      sync.Mutex
+	parcels []*Parcel
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (mt *MemoryTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return mt.SendParcel(parcel)
+}
+
+func (mt *MemoryTransport) SendParcel(parcel *Parcel) error {
+	return mt.SendParcelContext(context.Background(), parcel)
+}
+
+func (mt *MemoryTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.parcels = append(mt.parcels, parcel)
+	return nil
+}
+
+func (mt *MemoryTransport) Close() error {
+	return nil
+}
+
+// Parcels returns the messages received so far.
+func (mt *MemoryTransport) Parcels() []*Parcel {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	return append([]*Parcel(nil), mt.parcels...)
+}
+
+// Reset discards the messages received so far.
+func (mt *MemoryTransport) Reset() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.parcels = nil
+}
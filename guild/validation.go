@@ -0,0 +1,113 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// ValidationPolicy describes how an Envelope checks the addresses it
+// is given. Every address has its syntax checked; the other checks
+// only apply to recipients (to, cc and bcc), as the sender addresses
+// are the caller's own.
+type ValidationPolicy struct {
+	// Normalize rewrites addresses into their canonical form, such as
+	// gmail addresses without dots or plus tags. Leave it off where
+	// plus addressing means something.
+	Normalize bool
+	// RejectDisposable refuses throwaway mailbox domains.
+	RejectDisposable bool
+	// RejectRoleAccounts refuses mailboxes such as info@ or admin@ that
+	// belong to a role rather than a person.
+	RejectRoleAccounts bool
+	// CheckMX refuses domains that have no mail exchanger, looking
+	// them up with Resolver, or net.DefaultResolver when it is nil.
+	CheckMX  bool
+	Resolver Resolver
+	// CheckSMTP asks the domain's mail server whether the mailbox
+	// exists, without sending anything. The verifier does its own DNS
+	// lookups for this check, and many servers will not say.
+	CheckSMTP bool
+}
+
+// DefaultValidationPolicy checks the syntax and normalizes addresses.
+func DefaultValidationPolicy() ValidationPolicy {
+	return ValidationPolicy{Normalize: true}
+}
+
+// isRecipient reports whether addresses of the type receive the message.
+func isRecipient(addressType AddressType) bool {
+	return addressType == ToAddress || addressType == CcAddress || addressType == BccAddress
+}
+
+// validate checks the address against the envelope's policy.
+func (em *Envelope) validate(address *mail.Address, addressType AddressType) *AddressError {
+	syntax := em.verifier.ParseAddress(address.Address)
+	if !syntax.Valid {
+		return newAddressError(address.Address, addressType, ErrInvalidAddress, "'%s' is an invalid email address", address.Address)
+	}
+
+	// an internationalized domain must have a punycode form to be found
+	domain, err := asciiDomain(syntax.Domain)
+	if err != nil {
+		return newAddressError(address.Address, addressType, fmt.Errorf("%w: %w", ErrInvalidAddress, err), "'%s' is an invalid email address: %s", address.Address, err)
+	}
+
+	if !isRecipient(addressType) {
+		return nil
+	}
+
+	if em.policy.RejectDisposable && em.verifier.IsDisposable(syntax.Domain) {
+		return newAddressError(address.Address, addressType, ErrDisposableAddress, "'%s' is a disposable email address", address.Address)
+	}
+
+	if em.policy.RejectRoleAccounts && em.verifier.IsRoleAccount(syntax.Username) {
+		return newAddressError(address.Address, addressType, ErrRoleAccount, "'%s' is a role account", address.Address)
+	}
+
+	if em.policy.CheckMX {
+		err := em.checkMX(domain)
+		if err != nil {
+			return newAddressError(address.Address, addressType, fmt.Errorf("%w: %w", ErrUndeliverable, err), "'%s' cannot receive mail: %s", address.Address, err)
+		}
+	}
+
+	if em.policy.CheckSMTP {
+		smtp, err := em.verifier.CheckSMTP(syntax.Domain, syntax.Username)
+		if err != nil {
+			return newAddressError(address.Address, addressType, fmt.Errorf("%w: %w", ErrUndeliverable, err), "'%s' could not be verified: %s", address.Address, err)
+		}
+		if !smtp.Deliverable && !smtp.CatchAll {
+			return newAddressError(address.Address, addressType, ErrUndeliverable, "'%s' is not a deliverable email address", address.Address)
+		}
+	}
+
+	return nil
+}
+
+// checkMX makes sure the domain has somewhere to deliver mail to.
+func (em *Envelope) checkMX(domain string) error {
+	resolver := em.policy.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	records, err := resolver.LookupMX(context.Background(), domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return fmt.Errorf("domain '%s' has no mail exchanger", domain)
+	}
+	if err != nil {
+		return fmt.Errorf("MX lookup failed: %w", err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("domain '%s' has no mail exchanger", domain)
+	}
+	if len(records) == 1 && strings.TrimSuffix(records[0].Host, ".") == "" {
+		return ErrNullMX
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package guild
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// failingResolver cannot reach its DNS server.
+type failingResolver struct{}
+
+func (failingResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: domain, IsTimeout: true}
+}
+
+func TestEnvelope_DefaultPolicyNormalizes(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope()
+	em.AddToAddress("first.last+news@gmail.com")
+	tst.False(em.HasErrors())
+	tst.Equal("firstlast@gmail.com", em.GetToAddresses()[0].Address)
+}
+
+func TestEnvelope_PolicyWithoutNormalizing(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope(ValidationPolicy{})
+	em.AddToAddress("first.last+news@gmail.com")
+	tst.False(em.HasErrors())
+	tst.Equal("first.last+news@gmail.com", em.GetToAddresses()[0].Address)
+
+	em.AddToAddress("not an address")
+	tst.True(em.HasErrors())
+}
+
+func TestEnvelope_PolicyRejections(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope(ValidationPolicy{RejectDisposable: true, RejectRoleAccounts: true})
+	// the sender's own addresses are not held to the recipient checks
+	em.SetFromAddress("info@email.com")
+	tst.False(em.HasErrors())
+
+	em.AddToAddress("someone@mailinator.com")
+	em.AddCcAddress("info@email.com")
+	em.AddBccAddress("person@email.com")
+
+	err := em.GetErrors()
+	tst.ErrorContains(err, "'someone@mailinator.com' is a disposable email address")
+	tst.ErrorContains(err, "'info@email.com' is a role account")
+	tst.NotContains(err.Error(), "person@email.com")
+}
+
+func TestEnvelope_PolicyCheckMX(t *testing.T) {
+	tst := assert.New(t)
+
+	em := NewEnvelope(ValidationPolicy{
+		CheckMX: true,
+		Resolver: stubResolver{
+			"mail.test": {{Host: "mx.mail.test.", Pref: 10}},
+			"null.test": {{Host: ".", Pref: 0}},
+		},
+	})
+	em.AddToAddress("a@mail.test")
+	tst.False(em.HasErrors())
+
+	em.AddToAddress("b@null.test")
+	em.AddToAddress("c@missing.test")
+
+	err := em.GetErrors()
+	tst.ErrorContains(err, "'b@null.test' cannot receive mail: "+ErrNullMX.Error())
+	tst.ErrorContains(err, "'c@missing.test' cannot receive mail: domain 'missing.test' has no mail exchanger")
+
+	em = NewEnvelope(ValidationPolicy{CheckMX: true, Resolver: failingResolver{}})
+	em.AddToAddress("a@mail.test")
+	tst.ErrorContains(em.GetErrors(), "MX lookup failed")
+}
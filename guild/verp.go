@@ -0,0 +1,149 @@
+package guild
+
+import (
+	"context"
+	"fmt"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"sort"
+	"strings"
+)
+
+// VERPAddress encodes the recipient into the bounce address, giving a
+// variable envelope return path: bounces@example.com sending to
+// jane@example.org becomes bounces+jane=example.org@example.com. A
+// bounce then says which recipient it is for without being parsed.
+func VERPAddress(bounce, recipient string) (string, error) {
+	at := strings.LastIndex(bounce, "@")
+	if at < 0 {
+		return "", fmt.Errorf("'%s' is not a valid bounce address", bounce)
+	}
+	rcptAt := strings.LastIndex(recipient, "@")
+	if rcptAt < 0 {
+		return "", fmt.Errorf("'%s' has no domain to encode", recipient)
+	}
+	return fmt.Sprintf(
+		"%s+%s=%s%s",
+		bounce[:at],
+		recipient[:rcptAt],
+		recipient[rcptAt+1:],
+		bounce[at:],
+	), nil
+}
+
+// VERPError is returned when the message could not be delivered to
+// every recipient, by a VERPTransport or by an HTTPTransport that had
+// to send it to each recipient on its own. It unwraps to the error of
+// each recipient.
+type VERPError struct {
+	// Delivered lists the recipients that were sent the message.
+	Delivered []string
+	// Failed holds the error for each recipient that was not.
+	Failed map[string]error
+}
+
+func (e *VERPError) recipients() []string {
+	recipients := make([]string, 0, len(e.Failed))
+	for recipient := range e.Failed {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+func (e *VERPError) Error() string {
+	recipients := e.recipients()
+	details := make([]string, len(recipients))
+	for i, recipient := range recipients {
+		details[i] = fmt.Sprintf("%s: %s", recipient, e.Failed[recipient])
+	}
+	return fmt.Sprintf(
+		"%d of %d recipient(s) failed:\n%s",
+		len(e.Failed),
+		len(e.Failed)+len(e.Delivered),
+		strings.Join(details, "\n"),
+	)
+}
+
+func (e *VERPError) Unwrap() []error {
+	var errs []error
+	for _, recipient := range e.recipients() {
+		errs = append(errs, e.Failed[recipient])
+	}
+	return errs
+}
+
+// Temporary reports whether every recipient failed transiently. Once a
+// recipient has been sent the message it is never temporary, as
+// sending it again would deliver it to them twice.
+func (e *VERPError) Temporary() bool {
+	if len(e.Delivered) > 0 {
+		return false
+	}
+	for _, err := range e.Failed {
+		if !IsTransient(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// VERPTransport wraps a Transport, sending each recipient a message of
+// their own whose envelope sender has the recipient encoded into it
+// (see VERPAddress).
+type VERPTransport struct {
+	transport Transport
+}
+
+func NewVERPTransport(transport Transport) *VERPTransport {
+	return &VERPTransport{transport: transport}
+}
+
+func (vt *VERPTransport) Send(msg *smail.Email) error {
+	parcel, err := NewParcel(msg)
+	if err != nil {
+		return err
+	}
+	return vt.SendParcel(parcel)
+}
+
+func (vt *VERPTransport) SendParcel(parcel *Parcel) error {
+	return vt.SendParcelContext(context.Background(), parcel)
+}
+
+// SendParcelContext implements ContextTransport. The recipients are
+// sent to one after the other; once ctx is done the rest are skipped.
+func (vt *VERPTransport) SendParcelContext(ctx context.Context, parcel *Parcel) error {
+	verpErr := &VERPError{Failed: map[string]error{}}
+	for _, recipient := range parcel.Recipients {
+		if ctx.Err() != nil {
+			verpErr.Failed[recipient] = ctx.Err()
+			continue
+		}
+
+		from, err := VERPAddress(parcel.From, recipient)
+		if err == nil {
+			err = SendParcelContext(ctx, vt.transport, &Parcel{
+				From:       from,
+				Recipients: []string{recipient},
+				Data:       parcel.Data,
+			})
+		}
+		if err != nil {
+			verpErr.Failed[recipient] = err
+			continue
+		}
+		verpErr.Delivered = append(verpErr.Delivered, recipient)
+	}
+
+	if err := ctx.Err(); err != nil && len(verpErr.Delivered) == 0 {
+		return err
+	}
+	if len(verpErr.Failed) > 0 {
+		return verpErr
+	}
+	return nil
+}
+
+func (vt *VERPTransport) Close() error {
+	return vt.transport.Close()
+}
@@ -0,0 +1,73 @@
+package guild
+
+import (
+	"context"
+	"errors"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVERPAddress(t *testing.T) {
+	tst := assert.New(t)
+
+	address, err := VERPAddress("bounces@email.com", "jane@example.org")
+	tst.Nil(err)
+	tst.Equal("bounces+jane=example.org@email.com", address)
+
+	_, err = VERPAddress("bounces", "jane@example.org")
+	tst.ErrorContains(err, "'bounces' is not a valid bounce address")
+	_, err = VERPAddress("bounces@email.com", "jane")
+	tst.ErrorContains(err, "'jane' has no domain to encode")
+}
+
+func TestVERPTransport_OneMessagePerRecipient(t *testing.T) {
+	tst := assert.New(t)
+
+	memory := NewMemoryTransport()
+	transport := NewVERPTransport(memory)
+
+	err := transport.SendParcel(&Parcel{
+		From:       "bounces@email.com",
+		Recipients: []string{"a@one.test", "b@two.test"},
+		Data:       "Subject: VERP Test\r\n\r\nThis is the verp test body.\r\n",
+	})
+	tst.Nil(err)
+
+	parcels := memory.Parcels()
+	tst.Len(parcels, 2)
+	tst.Equal("bounces+a=one.test@email.com", parcels[0].From)
+	tst.Equal([]string{"a@one.test"}, parcels[0].Recipients)
+	tst.Equal("bounces+b=two.test@email.com", parcels[1].From)
+	tst.Equal([]string{"b@two.test"}, parcels[1].Recipients)
+	tst.Equal(parcels[0].Data, parcels[1].Data)
+}
+
+func TestVERPTransport_PartialFailure(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.AddFault(couriertest.Fault{Stage: couriertest.StageRcpt, Recipient: "b@email.com", Reply: "450 4.2.1 Mailbox busy"})
+	})
+	transport := NewVERPTransport(CreateTestCourier(srv, EncryptionNone))
+
+	err := transport.SendParcelContext(context.Background(), &Parcel{
+		From:       "bounces@email.com",
+		Recipients: []string{"a@email.com", "b@email.com"},
+		Data:       "Subject: VERP Test\r\n\r\nThis is the verp test body.\r\n",
+	})
+
+	var verpErr *VERPError
+	tst.True(errors.As(err, &verpErr))
+	tst.Equal([]string{"a@email.com"}, verpErr.Delivered)
+	tst.Contains(verpErr.Failed, "b@email.com")
+	tst.ErrorContains(err, "1 of 2 recipient(s) failed")
+
+	var smtpErr *SMTPError
+	tst.True(errors.As(err, &smtpErr))
+	// a was sent the message, so b's busy mailbox is not worth a retry
+	tst.False(IsTransient(err))
+
+	msg := srv.WaitForMessages(t, 1)[0]
+	msg.AssertFrom(t, "bounces+a=email.com@email.com")
+}
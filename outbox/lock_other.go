@@ -0,0 +1,11 @@
+//go:build !unix
+
+package outbox
+
+import "os"
+
+// lockFile is a no op where flock is not available; one process per
+// spool is then up to the caller.
+func lockFile(f *os.File) error {
+	return nil
+}
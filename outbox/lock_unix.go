@@ -0,0 +1,21 @@
+//go:build unix
+
+package outbox
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the open file, failing with
+// ErrSpoolInUse rather than waiting when another process holds it.
+// The lock goes away with the file descriptor, so a crashed process
+// never leaves a stale one behind.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrSpoolInUse
+	}
+	return err
+}
@@ -0,0 +1,537 @@
+// Package outbox provides a persistent, on-disk queue of sealed messages
+// that are drained in the background by a pool of workers.
+//
+// The spool directory holds four sub directories:
+//
+//	tmp/     items being written
+//	new/     items waiting to be sent
+//	active/  items claimed by a worker
+//	failed/  items that ran out of attempts
+//
+// Every move between them is an atomic rename, so an item is only ever
+// in one place and only one worker can claim it. Items left in active/
+// by a crash are returned to new/ when the Outbox is next opened.
+// An open Outbox holds an exclusive lock on the spool's lock file, so
+// that no other process can take its active/ items for abandoned ones.
+//
+// No message is lost: an item leaves the spool only once the transport
+// has accepted it, and its removal is synced to disk straight away. No
+// message is duplicated either, with one exception no client can rule
+// out: when the process dies, or the connection drops, after the server
+// took the message but before it said so, the item is sent again. The
+// attempt is recorded before the message is sent, so such an item is
+// sent at most as often as its attempts allow, and every item is given
+// a Message-ID when it is queued, so each copy carries the same one for
+// the receiver to recognize it by.
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/markgemmill/courier/guild"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tmpDir    = "tmp"
+	newDir    = "new"
+	activeDir = "active"
+	failedDir = "failed"
+	lockName  = "lock"
+)
+
+// ErrSpoolInUse is returned by NewOutbox when another Outbox already
+// has the spool open.
+var ErrSpoolInUse = errors.New("outbox spool is in use by another process")
+
+// Item is a queued message along with its delivery history.
+type Item struct {
+	ID string `json:"id"`
+	guild.Parcel
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// Outbox spools messages to disk and delivers them with a Transport.
+type Outbox struct {
+	dir          string
+	transport    guild.Transport
+	maxAttempts  int
+	retryDelay   time.Duration
+	pollInterval time.Duration
+	logger       *slog.Logger
+	lock         *os.File
+
+	mu      sync.Mutex
+	running bool
+	wake    chan struct{}
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewOutbox opens (creating if needed) the spool at dir. Any items that
+// were being sent when the process last stopped are put back in the queue.
+// The spool stays locked until Close is called.
+func NewOutbox(dir string, transport guild.Transport) (*Outbox, error) {
+	ob := &Outbox{
+		dir:          dir,
+		transport:    transport,
+		maxAttempts:  5,
+		retryDelay:   time.Minute,
+		pollInterval: 5 * time.Second,
+		wake:         make(chan struct{}, 1),
+	}
+
+	for _, sub := range []string{tmpDir, newDir, activeDir, failedDir} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(lock)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	ob.lock = lock
+
+	err = ob.recover()
+	if err != nil {
+		_ = ob.lock.Close()
+		return nil, err
+	}
+
+	return ob, nil
+}
+
+// SetMaxAttempts sets how many times an item is tried before it
+// is moved to failed/. Items rejected with a permanent error are
+// moved there after the first attempt.
+func (ob *Outbox) SetMaxAttempts(attempts int) {
+	ob.maxAttempts = attempts
+}
+
+// SetRetryDelay sets how long a failed item waits before it is tried again.
+func (ob *Outbox) SetRetryDelay(delay time.Duration) {
+	ob.retryDelay = delay
+}
+
+// SetPollInterval sets how often idle workers look for items that
+// have become due.
+func (ob *Outbox) SetPollInterval(interval time.Duration) {
+	ob.pollInterval = interval
+}
+
+// SetLogger has the workers log, at error level, the spool problems
+// they cannot return to anyone, such as an item that could not be
+// filed after it was sent. A nil logger turns logging off.
+func (ob *Outbox) SetLogger(logger *slog.Logger) {
+	ob.logger = logger
+}
+
+func (ob *Outbox) path(sub, id string) string {
+	return filepath.Join(ob.dir, sub, id+".json")
+}
+
+// recover returns items abandoned in active/ to new/.
+func (ob *Outbox) recover() error {
+	ids, err := ob.list(activeDir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = os.Rename(ob.path(activeDir, id), ob.path(newDir, id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns the ids of the items in a spool sub directory, oldest first.
+func (ob *Outbox) list(sub string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(ob.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (ob *Outbox) read(sub, id string) (*Item, error) {
+	content, err := os.ReadFile(ob.path(sub, id))
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{}
+	err = json.Unmarshal(content, item)
+	if err != nil {
+		return nil, fmt.Errorf("outbox item %s is corrupt: %w", id, err)
+	}
+	return item, nil
+}
+
+// write durably stores the item in the given sub directory by
+// writing it to tmp/ first and renaming it into place. The file's
+// modification time is set to the item's next attempt, so that claim
+// can tell which items are due without reading them.
+func (ob *Outbox) write(sub string, item *Item) error {
+	content, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := ob.path(tmpDir, item.ID)
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmpPath, item.NextAttempt, item.NextAttempt)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, ob.path(sub, item.ID))
+	if err != nil {
+		return err
+	}
+	return ob.sync(sub)
+}
+
+// sync flushes a sub directory, so that the files renamed into or
+// removed from it stay that way after a crash.
+func (ob *Outbox) sync(sub string) error {
+	dir, err := os.Open(filepath.Join(ob.dir, sub))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// withMessageID adds a Message-ID header made from the item id to a
+// message that has none, so that every copy of it can be told apart
+// from other messages.
+func withMessageID(data, id, from string) string {
+	end := strings.Index(data, "\r\n\r\n")
+	if end < 0 {
+		end = len(data)
+	}
+	for _, line := range strings.Split(data[:end], "\r\n") {
+		name, _, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Message-ID") {
+			return data
+		}
+	}
+
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 && at < len(from)-1 {
+		domain = from[at+1:]
+	}
+	return fmt.Sprintf("Message-ID: <%s@%s>\r\n%s", id, domain, data)
+}
+
+func newID() (string, error) {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	// a sortable timestamp prefix keeps the queue roughly first in, first out
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(random)), nil
+}
+
+// Enqueue stores a sealed message in the spool and returns its id. Once
+// Enqueue returns, the message survives a restart of the process.
+func (ob *Outbox) Enqueue(msg *smail.Email) (string, error) {
+	parcel, err := guild.NewParcel(msg)
+	if err != nil {
+		return "", err
+	}
+	return ob.EnqueueParcel(parcel)
+}
+
+// EnqueueParcel stores an already rendered message in the spool. A
+// message without a Message-ID is given one.
+func (ob *Outbox) EnqueueParcel(parcel *guild.Parcel) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	item := &Item{
+		ID:          id,
+		Parcel:      *parcel,
+		Created:     now,
+		NextAttempt: now,
+	}
+	item.Data = withMessageID(item.Data, id, item.From)
+
+	err = ob.write(newDir, item)
+	if err != nil {
+		return "", err
+	}
+
+	// nudge an idle worker, if there is one
+	select {
+	case ob.wake <- struct{}{}:
+	default:
+	}
+
+	return id, nil
+}
+
+// Pending returns the items waiting to be sent.
+func (ob *Outbox) Pending() ([]*Item, error) {
+	return ob.items(newDir)
+}
+
+// Failed returns the items that ran out of attempts.
+func (ob *Outbox) Failed() ([]*Item, error) {
+	return ob.items(failedDir)
+}
+
+func (ob *Outbox) items(sub string) ([]*Item, error) {
+	ids, err := ob.list(sub)
+	if err != nil {
+		return nil, err
+	}
+	var items []*Item
+	for _, id := range ids {
+		item, err := ob.read(sub, id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// claimed by a worker in the meantime
+				continue
+			}
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// claim moves the oldest due item from new/ to active/. It returns
+// nil when there is nothing to do. Items are only read once claimed;
+// one that cannot be read is moved to failed/.
+func (ob *Outbox) claim() (*Item, error) {
+	ids, err := ob.list(newDir)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		info, err := os.Stat(ob.path(newDir, id))
+		if err != nil || info.ModTime().After(now) {
+			continue
+		}
+		// the rename is the lock; if it fails another worker got there first
+		err = os.Rename(ob.path(newDir, id), ob.path(activeDir, id))
+		if err != nil {
+			continue
+		}
+		item, err := ob.read(activeDir, id)
+		if err != nil {
+			ob.fileCorrupt(id, err)
+			continue
+		}
+		return item, nil
+	}
+
+	return nil, nil
+}
+
+// fileCorrupt moves a claimed item that could not be read to failed/,
+// keeping its content next to it as <id>.corrupt.
+func (ob *Outbox) fileCorrupt(id string, readErr error) {
+	err := os.Rename(ob.path(activeDir, id), filepath.Join(ob.dir, failedDir, id+".corrupt"))
+	if err == nil {
+		now := time.Now()
+		err = ob.write(failedDir, &Item{ID: id, Created: now, NextAttempt: now, LastError: readErr.Error()})
+	}
+	if err != nil {
+		ob.logError("outbox item could not be filed", err, slog.String("id", id))
+	}
+}
+
+// deliver sends a claimed item and files it according to the outcome.
+// The attempt is written to active/ before the message is sent, so that
+// an item whose sending was cut short by a crash still has it counted.
+// An item whose send was interrupted by Stop goes back to new/ without
+// using up an attempt.
+func (ob *Outbox) deliver(ctx context.Context, item *Item) error {
+	// attempts cut short by a crash may have reached the server
+	if item.Attempts >= ob.maxAttempts {
+		if item.LastError == "" {
+			item.LastError = "interrupted while being sent"
+		}
+		return ob.file(failedDir, item)
+	}
+
+	item.Attempts++
+	err := ob.write(activeDir, item)
+	if err != nil {
+		return err
+	}
+
+	parcel := item.Parcel
+	sendErr := guild.SendParcelContext(ctx, ob.transport, &parcel)
+	if sendErr == nil {
+		err = os.Remove(ob.path(activeDir, item.ID))
+		if err != nil {
+			return err
+		}
+		return ob.sync(activeDir)
+	}
+
+	var quotaErr *guild.QuotaError
+	switch {
+	case ctx.Err() != nil:
+		item.Attempts--
+		return ob.file(newDir, item)
+	case errors.As(sendErr, &quotaErr):
+		// a sending limit kept it from being tried, so it costs no attempt
+		item.Attempts--
+		item.NextAttempt = time.Now().Add(quotaErr.RetryAfter)
+	default:
+		item.NextAttempt = time.Now().Add(ob.retryDelay)
+	}
+	item.LastError = sendErr.Error()
+
+	// permanent rejections won't get any better by trying again
+	sub := newDir
+	if item.Attempts >= ob.maxAttempts || !guild.IsTransient(sendErr) {
+		sub = failedDir
+	}
+
+	return ob.file(sub, item)
+}
+
+// file moves a claimed item out of active/ into sub.
+func (ob *Outbox) file(sub string, item *Item) error {
+	err := ob.write(sub, item)
+	if err != nil {
+		return err
+	}
+	return os.Remove(ob.path(activeDir, item.ID))
+}
+
+// Start launches the given number of workers to drain the queue.
+func (ob *Outbox) Start(workers int) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.running {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ob.running = true
+	ob.cancel = cancel
+	for i := 0; i < workers; i++ {
+		ob.wg.Add(1)
+		go ob.work(ctx)
+	}
+}
+
+// Stop signals the workers to finish, interrupting any message being
+// sent over a transport that takes a context, and waits for them.
+// Unsent and interrupted items stay in the spool.
+func (ob *Outbox) Stop() {
+	ob.mu.Lock()
+	if !ob.running {
+		ob.mu.Unlock()
+		return
+	}
+	ob.running = false
+	ob.cancel()
+	ob.mu.Unlock()
+
+	ob.wg.Wait()
+}
+
+// Close stops the workers and releases the spool for another Outbox.
+func (ob *Outbox) Close() error {
+	ob.Stop()
+	return ob.lock.Close()
+}
+
+func (ob *Outbox) work(ctx context.Context) {
+	defer ob.wg.Done()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		item, err := ob.claim()
+		if err != nil {
+			ob.logError("outbox items could not be claimed", err)
+		}
+		if err == nil && item != nil {
+			err = ob.deliver(ctx, item)
+			if err != nil {
+				ob.logError("outbox item could not be filed", err, slog.String("id", item.ID))
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ob.wake:
+		case <-time.After(ob.pollInterval):
+		}
+	}
+}
+
+func (ob *Outbox) logError(msg string, err error, attrs ...slog.Attr) {
+	if ob.logger == nil {
+		return
+	}
+	attrs = append(attrs, slog.String("error", err.Error()))
+	ob.logger.LogAttrs(context.Background(), slog.LevelError, msg, attrs...)
+}
@@ -0,0 +1,428 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"github.com/markgemmill/courier/guild"
+	"github.com/stretchr/testify/assert"
+	smail "github.com/xhit/go-simple-mail/v2"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingTransport rejects every message with the given error.
+type failingTransport struct {
+	guild.MemoryTransport
+	err error
+}
+
+func (ft *failingTransport) SendParcel(parcel *guild.Parcel) error {
+	return ft.err
+}
+
+func (ft *failingTransport) SendParcelContext(ctx context.Context, parcel *guild.Parcel) error {
+	return ft.err
+}
+
+// stallingTransport never finishes a send until its context is done.
+type stallingTransport struct {
+	guild.MemoryTransport
+	sending chan struct{}
+}
+
+func (st *stallingTransport) SendParcelContext(ctx context.Context, parcel *guild.Parcel) error {
+	close(st.sending)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// syncBuffer is a bytes.Buffer the workers can log to while the test
+// reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func CreateTestMessage() *smail.Email {
+	envelope := guild.NewEnvelope()
+	envelope.SetFromAddress("sender@email.com")
+	envelope.AddToAddress("receiver@email.com")
+
+	scribe := guild.NewSimpleTextScribe()
+	scribe.SetSubjectTemplate("Outbox Test")
+	scribe.SetTextBodyTemplate("This is the outbox test body.")
+	_, _ = scribe.Open()
+	scribe.Compose().Seal(envelope)
+	return scribe.Message()
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the outbox")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutbox_EnqueueAndDrain(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := guild.NewMemoryTransport()
+	ob, err := NewOutbox(t.TempDir(), transport)
+	tst.Nil(err)
+
+	for i := 0; i < 10; i++ {
+		_, err = ob.Enqueue(CreateTestMessage())
+		tst.Nil(err)
+	}
+
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	tst.Len(pending, 10)
+
+	ob.Start(3)
+	waitFor(t, func() bool { return len(transport.Parcels()) == 10 })
+	ob.Stop()
+
+	pending, err = ob.Pending()
+	tst.Nil(err)
+	tst.Len(pending, 0)
+
+	parcel := transport.Parcels()[0]
+	tst.Equal("sender@email.com", parcel.From)
+	tst.Equal([]string{"receiver@email.com"}, parcel.Recipients)
+	tst.Contains(parcel.Data, "Subject: Outbox Test")
+}
+
+func TestOutbox_SurvivesRestart(t *testing.T) {
+	tst := assert.New(t)
+
+	dir := t.TempDir()
+	transport := guild.NewMemoryTransport()
+
+	ob, err := NewOutbox(dir, transport)
+	tst.Nil(err)
+	id, err := ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	// simulate a crash while the item was being sent
+	err = os.Rename(ob.path(newDir, id), ob.path(activeDir, id))
+	tst.Nil(err)
+	tst.Nil(ob.Close())
+
+	ob, err = NewOutbox(dir, transport)
+	tst.Nil(err)
+
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	tst.Len(pending, 1)
+	tst.Equal(id, pending[0].ID)
+
+	ob.Start(2)
+	waitFor(t, func() bool { return len(transport.Parcels()) == 1 })
+	ob.Stop()
+
+	entries, err := os.ReadDir(filepath.Join(dir, activeDir))
+	tst.Nil(err)
+	tst.Len(entries, 0)
+	tst.Len(transport.Parcels(), 1)
+}
+
+func TestOutbox_FailedItems(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := &failingTransport{err: &guild.SMTPError{Code: 421, Message: "service not available"}}
+	ob, err := NewOutbox(t.TempDir(), transport)
+	tst.Nil(err)
+	ob.SetMaxAttempts(2)
+	ob.SetRetryDelay(0)
+	ob.SetPollInterval(10 * time.Millisecond)
+
+	_, err = ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	ob.Start(1)
+	waitFor(t, func() bool {
+		failed, _ := ob.Failed()
+		return len(failed) == 1
+	})
+	ob.Stop()
+
+	failed, err := ob.Failed()
+	tst.Nil(err)
+	tst.Equal(2, failed[0].Attempts)
+	tst.Equal("smtp 421 service not available", failed[0].LastError)
+
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	tst.Len(pending, 0)
+}
+
+func TestOutbox_PermanentFailuresAreNotRetried(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := &failingTransport{err: &guild.SMTPError{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown"}}
+	ob, err := NewOutbox(t.TempDir(), transport)
+	tst.Nil(err)
+	ob.SetRetryDelay(0)
+
+	_, err = ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	ob.Start(1)
+	waitFor(t, func() bool {
+		failed, _ := ob.Failed()
+		return len(failed) == 1
+	})
+	ob.Stop()
+
+	failed, err := ob.Failed()
+	tst.Nil(err)
+	tst.Equal(1, failed[0].Attempts)
+}
+
+func TestOutbox_StopInterruptsSend(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := &stallingTransport{sending: make(chan struct{})}
+	ob, err := NewOutbox(t.TempDir(), transport)
+	tst.Nil(err)
+
+	_, err = ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	ob.Start(1)
+	<-transport.sending
+
+	stopped := make(chan struct{})
+	go func() {
+		ob.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the stalled send")
+	}
+
+	// the interrupted item is back in the queue, its attempts untouched
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	tst.Len(pending, 1)
+	tst.Equal(0, pending[0].Attempts)
+
+	failed, err := ob.Failed()
+	tst.Nil(err)
+	tst.Len(failed, 0)
+}
+
+func TestOutbox_LogsSpoolErrors(t *testing.T) {
+	tst := assert.New(t)
+
+	dir := t.TempDir()
+	ob, err := NewOutbox(dir, guild.NewMemoryTransport())
+	tst.Nil(err)
+	ob.SetPollInterval(10 * time.Millisecond)
+
+	var output syncBuffer
+	ob.SetLogger(slog.New(slog.NewTextHandler(&output, nil)))
+
+	// with new/ gone there is nothing the workers can claim
+	tst.Nil(os.RemoveAll(filepath.Join(dir, newDir)))
+
+	ob.Start(1)
+	waitFor(t, func() bool { return output.String() != "" })
+	ob.Stop()
+
+	tst.Contains(output.String(), `level=ERROR msg="outbox items could not be claimed"`)
+	tst.Contains(output.String(), "no such file or directory")
+}
+
+func TestOutbox_QuotaErrorsCostNoAttempt(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := &failingTransport{err: &guild.QuotaError{Limit: "daily", RetryAfter: time.Hour}}
+	ob, err := NewOutbox(t.TempDir(), transport)
+	tst.Nil(err)
+	ob.SetMaxAttempts(1)
+
+	_, err = ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	ob.Start(1)
+	waitFor(t, func() bool {
+		pending, _ := ob.Pending()
+		return len(pending) == 1 && pending[0].LastError != ""
+	})
+	ob.Stop()
+
+	// the item waits for the quota instead of being failed
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	tst.Equal(0, pending[0].Attempts)
+	tst.WithinDuration(time.Now().Add(time.Hour), pending[0].NextAttempt, time.Minute)
+
+	failed, err := ob.Failed()
+	tst.Nil(err)
+	tst.Len(failed, 0)
+}
+
+func TestOutbox_GivesEveryItemAMessageID(t *testing.T) {
+	tst := assert.New(t)
+
+	ob, err := NewOutbox(t.TempDir(), guild.NewMemoryTransport())
+	tst.Nil(err)
+
+	id, err := ob.EnqueueParcel(&guild.Parcel{
+		From:       "sender@email.com",
+		Recipients: []string{"receiver@email.com"},
+		Data:       "Subject: Outbox Test\r\n\r\nThis is the outbox test body.\r\n",
+	})
+	tst.Nil(err)
+	_, err = ob.EnqueueParcel(&guild.Parcel{
+		From:       "sender@email.com",
+		Recipients: []string{"receiver@email.com"},
+		Data:       "Message-Id: <own@email.com>\r\nSubject: Outbox Test\r\n\r\nThis is the outbox test body.\r\n",
+	})
+	tst.Nil(err)
+
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	tst.True(strings.HasPrefix(pending[0].Data, "Message-ID: <"+id+"@email.com>\r\nSubject: Outbox Test\r\n"))
+	tst.True(strings.HasPrefix(pending[1].Data, "Message-Id: <own@email.com>\r\n"))
+}
+
+func TestOutbox_CountsAttemptsCutShortByACrash(t *testing.T) {
+	tst := assert.New(t)
+
+	dir := t.TempDir()
+	ob, err := NewOutbox(dir, guild.NewMemoryTransport())
+	tst.Nil(err)
+	ob.SetMaxAttempts(1)
+	_, err = ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	// the process dies while the only attempt is being sent
+	item, err := ob.claim()
+	tst.Nil(err)
+	item.Attempts++
+	tst.Nil(ob.write(activeDir, item))
+	tst.Nil(ob.Close())
+
+	transport := guild.NewMemoryTransport()
+	ob, err = NewOutbox(dir, transport)
+	tst.Nil(err)
+	ob.SetMaxAttempts(1)
+	ob.Start(1)
+	waitFor(t, func() bool {
+		failed, _ := ob.Failed()
+		return len(failed) == 1
+	})
+	ob.Stop()
+
+	// it may have been delivered already, so it is not sent again
+	tst.Len(transport.Parcels(), 0)
+	failed, err := ob.Failed()
+	tst.Nil(err)
+	tst.Equal("interrupted while being sent", failed[0].LastError)
+}
+
+func TestOutbox_LocksTheSpool(t *testing.T) {
+	tst := assert.New(t)
+
+	dir := t.TempDir()
+	transport := guild.NewMemoryTransport()
+	ob, err := NewOutbox(dir, transport)
+	tst.Nil(err)
+	id, err := ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+	tst.Nil(os.Rename(ob.path(newDir, id), ob.path(activeDir, id)))
+
+	// a second outbox must not mistake the active item for an abandoned one
+	_, err = NewOutbox(dir, transport)
+	tst.ErrorIs(err, ErrSpoolInUse)
+	_, err = os.Stat(ob.path(activeDir, id))
+	tst.Nil(err)
+
+	tst.Nil(ob.Close())
+	ob, err = NewOutbox(dir, transport)
+	tst.Nil(err)
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	tst.Len(pending, 1)
+	tst.Nil(ob.Close())
+}
+
+func TestOutbox_ClaimsOnlyDueItems(t *testing.T) {
+	tst := assert.New(t)
+
+	ob, err := NewOutbox(t.TempDir(), guild.NewMemoryTransport())
+	tst.Nil(err)
+	later, err := ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+	due, err := ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	pending, err := ob.Pending()
+	tst.Nil(err)
+	pending[0].NextAttempt = time.Now().Add(time.Hour)
+	tst.Nil(ob.write(newDir, pending[0]))
+
+	item, err := ob.claim()
+	tst.Nil(err)
+	tst.Equal(due, item.ID)
+	item, err = ob.claim()
+	tst.Nil(err)
+	tst.Nil(item)
+
+	info, err := os.Stat(ob.path(newDir, later))
+	tst.Nil(err)
+	tst.True(info.ModTime().After(time.Now()))
+}
+
+func TestOutbox_FilesCorruptItems(t *testing.T) {
+	tst := assert.New(t)
+
+	// named to sort ahead of the queued item
+	corrupt := "00000000000000000000-corrupt"
+
+	dir := t.TempDir()
+	transport := guild.NewMemoryTransport()
+	ob, err := NewOutbox(dir, transport)
+	tst.Nil(err)
+	tst.Nil(os.WriteFile(ob.path(newDir, corrupt), []byte("{not json"), 0o600))
+	id, err := ob.Enqueue(CreateTestMessage())
+	tst.Nil(err)
+
+	item, err := ob.claim()
+	tst.Nil(err)
+	tst.Equal(id, item.ID)
+
+	failed, err := ob.Failed()
+	tst.Nil(err)
+	tst.Len(failed, 1)
+	tst.Equal(corrupt, failed[0].ID)
+	tst.Contains(failed[0].LastError, "outbox item "+corrupt+" is corrupt")
+	content, err := os.ReadFile(filepath.Join(dir, failedDir, corrupt+".corrupt"))
+	tst.Nil(err)
+	tst.Equal("{not json", string(content))
+}
@@ -1,18 +1,125 @@
 package params
 
+import (
+	"log/slog"
+)
+
 type CourierParams struct {
+	// Transport names the registered transport used for delivery,
+	// defaulting to "smtp".
+	Transport string
+	// FileDir is where the "file" transport writes messages.
+	FileDir string
+	// Maildir is the Maildir the "maildir" transport delivers into.
+	// MaildirOwner, when set, is the mailbox address written into each
+	// message's Delivered-To header.
+	Maildir      string
+	MaildirOwner string
+	// SendmailPath is the binary the "sendmail" transport runs, by
+	// default /usr/sbin/sendmail. SendmailArgs go before the envelope.
+	SendmailPath string
+	SendmailArgs []string
+	// LMTPAddress is where the "lmtp" transport delivers: a host:port,
+	// or the path of a Unix socket prefixed with "unix:", such as
+	// "unix:/var/run/dovecot/lmtp".
+	LMTPAddress string
+	// APIProvider selects the request shape of the "http" transport:
+	// "sendgrid", "postmark", "resend" or "generic". APIKey holds the
+	// provider's credentials and APIEndpoint overrides its URL. The
+	// generic provider posts APIPayloadFile, a text/template, with the
+	// APIHeaders ("Name: value") and reads the message id from the
+	// APIMessageIDField of the response.
+	APIProvider       string
+	APIEndpoint       string
+	APIKey            string
+	APIPayloadFile    string
+	APIHeaders        []string
+	APIMessageIDField string
+	// MXHelo is the name the "mx" transport gives in EHLO, by default
+	// the host name. MXPort overrides port 25.
+	MXHelo   string
+	MXPort   int
 	Host     string
 	Port     int
 	User     string
 	Password string
+	// AuthMechanism is one of "auto", "plain", "login", "cram-md5" or
+	// "xoauth2". XOAUTH2 sends AuthToken as the bearer token for User.
+	AuthMechanism string
+	AuthToken     string
+	// Encryption is one of "none", "tls", "starttls" or "starttls-required".
+	Encryption    string
+	TLSCAFile     string
+	TLSServerName string
+	TLSMinVersion string
+	// DKIM signing is enabled when DKIMKeyFile is set, for every transport
+	// but http, where the api provider signs. DKIMCanonicalization is
+	// "header/body", e.g. "relaxed/simple"; it defaults to "relaxed/relaxed".
+	DKIMDomain           string
+	DKIMSelector         string
+	DKIMKeyFile          string
+	DKIMHeaders          []string
+	DKIMCanonicalization string
+	// Relays are further smtp endpoints to fail over to, given as
+	// "host[:port][?priority=N&weight=N]". Host/Port has priority 0 and
+	// each relay defaults to the priority after the one before it, so a
+	// plain list is tried in order. Relays share all other settings.
+	Relays []string
+	// PoolSize, when above 0, has the "smtp" transport keep up to that
+	// many sessions open and reuse them between messages rather than
+	// connecting for each one. It cannot be combined with Relays.
+	PoolSize int
+	// RetryAttempts is the total number of tries for a delivery that
+	// fails with a transient error. 1 means no retries; 0 leaves it to
+	// the transport, which means no retries except over "http", where
+	// 429 and 5xx responses are tried 3 times.
+	RetryAttempts int
+	// RatePerSecond, RateBurst, HourlyQuota and DailyQuota limit how
+	// fast and how much is sent; zero leaves a limit off. DomainLimits
+	// apply per recipient domain, given as
+	// "domain?per-second=N&burst=N&hourly=N&daily=N". When a limit is
+	// reached delivery waits, unless RateLimitNoWait asks for an error.
+	RatePerSecond   float64
+	RateBurst       int
+	HourlyQuota     int
+	DailyQuota      int
+	DomainLimits    []string
+	RateLimitNoWait bool
+	// RecipientPolicy is "all" (the default) to abandon a message when any
+	// recipient is refused, or "any" to send it to those that were accepted.
+	RecipientPolicy string
+	// Logger, when set, receives every smtp conversation at debug level,
+	// with credentials redacted, and at warn level the recipients that
+	// were refused while the message went to the others.
+	Logger *slog.Logger
 }
 
 type EnvelopParams struct {
 	SendFrom string
 	ReplyTo  string
-	SendTo   []string
-	SendCc   []string
-	SendBcc  []string
+	// Sender sets the Sender header and ReturnPath the envelope sender
+	// that bounces go to. With VERP each recipient is sent a message of
+	// their own, with their address encoded into the return path.
+	Sender     string
+	ReturnPath string
+	VERP       bool
+	// Recipient addresses are normalized (gmail dots and plus tags
+	// removed and the like) unless NoNormalize is set. The Reject and
+	// Check options refuse recipients that fail the check.
+	NoNormalize        bool
+	RejectDisposable   bool
+	RejectRoleAccounts bool
+	CheckMX            bool
+	CheckSMTP          bool
+	// RedirectTo and AllowRecipients keep a staging system from
+	// mailing real people: recipients that match none of the
+	// AllowRecipients patterns are sent to RedirectTo instead, or
+	// dropped when it is empty. See guild.Safeguard.
+	RedirectTo      string
+	AllowRecipients []string
+	SendTo          []string
+	SendCc          []string
+	SendBcc         []string
 }
 
 type MessageParams struct {
@@ -1,12 +1,18 @@
 package courier
 
 import (
+	"context"
+	"fmt"
 	"github.com/markgemmill/courier/guild"
 	"github.com/markgemmill/courier/params"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
-// Deliver is the only function that is needed to send an email.
-func Deliver(p params.Parameters) error {
+func newCourier(p params.CourierParams) (*guild.Courier, error) {
 	courier := guild.NewCourier(
 		p.Host,
 		p.Port,
@@ -14,6 +20,155 @@ func Deliver(p params.Parameters) error {
 		p.Password,
 	)
 
+	mechanism, err := guild.ParseAuthMechanism(p.AuthMechanism)
+	if err != nil {
+		return nil, err
+	}
+	courier.SetAuthMechanism(mechanism)
+	if p.AuthToken != "" {
+		courier.SetTokenSource(guild.StaticTokenSource(p.AuthToken))
+	}
+
+	encryption, err := guild.ParseEncryption(p.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	courier.SetEncryption(encryption)
+
+	tlsConfig, err := guild.NewTLSConfig(p.TLSCAFile, p.TLSServerName, p.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	courier.SetTLSConfig(tlsConfig)
+
+	policy, err := guild.ParseRecipientPolicy(p.RecipientPolicy)
+	if err != nil {
+		return nil, err
+	}
+	courier.SetRecipientPolicy(policy)
+	courier.SetLogger(p.Logger)
+
+	return courier, nil
+}
+
+// newRouter builds a Router over Host/Port and the relays.
+func newRouter(p params.CourierParams) (*guild.Router, error) {
+	var routes []guild.Route
+
+	if p.Host != "" {
+		courier, err := newCourier(p)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, guild.Route{Courier: courier})
+	}
+
+	priority := 0
+	for _, spec := range p.Relays {
+		relay := p
+		route, err := parseRelay(spec, &relay, priority+1)
+		if err != nil {
+			return nil, err
+		}
+		route.Courier, err = newCourier(relay)
+		if err != nil {
+			return nil, err
+		}
+		priority = route.Priority
+		routes = append(routes, route)
+	}
+
+	return guild.NewRouter(routes...), nil
+}
+
+// parseRelay reads a "host[:port][?priority=N&weight=N]" relay into the
+// Host and Port of p and the returned route.
+func parseRelay(spec string, p *params.CourierParams, priority int) (guild.Route, error) {
+	route := guild.Route{Priority: priority}
+
+	address, query, _ := strings.Cut(strings.TrimSpace(spec), "?")
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	if host == "" {
+		return route, fmt.Errorf("relay '%s' has no host", spec)
+	}
+	p.Host = host
+	if port != "" {
+		p.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return route, fmt.Errorf("relay '%s' has an invalid port", spec)
+		}
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return route, fmt.Errorf("relay '%s': %w", spec, err)
+	}
+	for name, target := range map[string]*int{"priority": &route.Priority, "weight": &route.Weight} {
+		if value := values.Get(name); value != "" {
+			*target, err = strconv.Atoi(value)
+			if err != nil {
+				return route, fmt.Errorf("relay '%s' has an invalid %s", spec, name)
+			}
+		}
+	}
+
+	return route, nil
+}
+
+func newDKIMSigner(p params.CourierParams) (*guild.DKIMSigner, error) {
+	key, err := guild.LoadDKIMKeyFile(p.DKIMKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(p.DKIMCanonicalization, "/")
+
+	return guild.NewDKIMSigner(guild.DKIMOptions{
+		Domain:                 p.DKIMDomain,
+		Selector:               p.DKIMSelector,
+		Key:                    key,
+		Headers:                p.DKIMHeaders,
+		HeaderCanonicalization: headerCanon,
+		BodyCanonicalization:   bodyCanon,
+	})
+}
+
+// Deliver is the only function that is needed to send an email.
+// The message is sent with the Transport named in p.Transport.
+func Deliver(p params.Parameters) error {
+	_, err := DeliverContext(context.Background(), p)
+	return err
+}
+
+// DeliverContext is Deliver, giving up as soon as ctx is cancelled
+// or its deadline passes, whether that is while rendering templates,
+// connecting or talking to the server. It returns the server's answer
+// for smtp and lmtp transports, and a nil result for the others.
+func DeliverContext(ctx context.Context, p params.Parameters) (*guild.DeliveryResult, error) {
+	transport, err := NewTransport(p)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = transport.Close()
+	}()
+
+	return DeliverWithContext(ctx, transport, p)
+}
+
+// DeliverWith composes the message described by p and sends it
+// with the given Transport.
+func DeliverWith(transport guild.Transport, p params.Parameters) error {
+	_, err := DeliverWithContext(context.Background(), transport, p)
+	return err
+}
+
+// DeliverWithContext is DeliverWith, honouring ctx and returning the
+// transport's DeliveryResult, if it reports one.
+func DeliverWithContext(ctx context.Context, transport guild.Transport, p params.Parameters) (*guild.DeliveryResult, error) {
 	var scribe guild.Scribe
 
 	if p.TemplateType == "pongo" {
@@ -38,42 +193,86 @@ func Deliver(p params.Parameters) error {
 	// start a new correspondence session
 	_, err := scribe.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		scribe.Close()
 	}()
 
-	envelope := guild.NewEnvelope()
+	envelope := guild.NewEnvelope(guild.ValidationPolicy{
+		Normalize:          !p.NoNormalize,
+		RejectDisposable:   p.RejectDisposable,
+		RejectRoleAccounts: p.RejectRoleAccounts,
+		CheckMX:            p.CheckMX,
+		CheckSMTP:          p.CheckSMTP,
+	})
 	envelope.SetFromAddress(p.SendFrom)
 	envelope.SetReplyToAddress(p.ReplyTo)
+	envelope.SetSenderAddress(p.Sender)
+	envelope.SetReturnPathAddress(p.ReturnPath)
 	envelope.AddToAddresses(p.SendTo)
 	envelope.AddCcAddresses(p.SendCc)
-	envelope.AddCcAddresses(p.SendBcc)
+	envelope.AddBccAddresses(p.SendBcc)
 
 	if envelope.HasErrors() {
-		return envelope.GetErrors()
+		return nil, envelope.GetErrors()
+	}
+
+	if p.RedirectTo != "" || len(p.AllowRecipients) > 0 {
+		err = applySafeguard(envelope, p)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if p.TemplateType == "pongo" {
-		scribe.Compose(guild.MakePongoContext(p.TemplateData))
+		scribe.ComposeContext(ctx, guild.MakePongoContext(p.TemplateData))
 	} else if p.TemplateType == "go" {
-		scribe.Compose(p.TemplateData)
+		scribe.ComposeContext(ctx, p.TemplateData)
 	} else {
-		scribe.Compose()
+		scribe.ComposeContext(ctx)
+	}
+
+	// report a cancellation as itself rather than as a scribe error
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
 	scribe.Seal(envelope)
 
 	if scribe.HasErrors() {
-		return scribe.GetErrors()
+		return nil, scribe.GetErrors()
 	}
 
-	err = courier.Deliver(scribe.Message())
+	return guild.DeliverContext(ctx, transport, scribe.Message())
+}
+
+// applySafeguard redirects or drops the recipients p does not allow,
+// logging what was changed.
+func applySafeguard(envelope *guild.Envelope, p params.Parameters) error {
+	safeguard := guild.NewSafeguard()
+	if p.RedirectTo != "" {
+		err := safeguard.SetRedirect(p.RedirectTo)
+		if err != nil {
+			return err
+		}
+	}
+	err := safeguard.Allow(p.AllowRecipients...)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	report := envelope.ApplySafeguard(safeguard)
+	if report.Changed() && p.Logger != nil {
+		p.Logger.Warn("safeguard changed the recipients",
+			slog.String("redirected_to", report.RedirectedTo),
+			slog.Any("redirected", report.Redirected),
+			slog.Any("dropped", report.Dropped),
+		)
+	}
 
+	if len(envelope.GetToAddresses())+len(envelope.GetCcAddresses())+len(envelope.GetBccAddresses()) == 0 {
+		return fmt.Errorf("the safeguard left no recipients: %s", report)
+	}
+	return nil
 }
@@ -0,0 +1,505 @@
+package courier
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/markgemmill/courier/couriertest"
+	"github.com/markgemmill/courier/guild"
+	"github.com/markgemmill/courier/params"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func CreateTestParameters() params.Parameters {
+	message := params.Parameters{
+		EnvelopParams: params.EnvelopParams{
+			SendFrom: "sender@email.com",
+			SendTo:   []string{"receiver@email.com"},
+		},
+		MessageParams: params.MessageParams{
+			TemplateType: "pongo",
+			Subject:      "Hello {{ name }}",
+		},
+	}
+	params.SetMessage(&message, "This is the {{ name }} body.", false)
+	params.SetTemplateData(&message, map[string]string{"name": "Courier"})
+	return message
+}
+
+func TestDeliverWith_MemoryTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := guild.NewMemoryTransport()
+	err := DeliverWith(transport, CreateTestParameters())
+	tst.Nil(err)
+
+	parcels := transport.Parcels()
+	tst.Len(parcels, 1)
+	tst.Equal("sender@email.com", parcels[0].From)
+	tst.Equal([]string{"receiver@email.com"}, parcels[0].Recipients)
+	tst.Contains(parcels[0].Data, "Subject: Hello Courier")
+	tst.Contains(parcels[0].Data, "This is the Courier body.")
+}
+
+func TestDeliverWith_BccIsNotACopy(t *testing.T) {
+	tst := assert.New(t)
+
+	p := CreateTestParameters()
+	p.SendCc = []string{"copied@email.com"}
+	p.SendBcc = []string{"hidden@email.com"}
+
+	transport := guild.NewMemoryTransport()
+	err := DeliverWith(transport, p)
+	tst.Nil(err)
+
+	parcels := transport.Parcels()
+	tst.Len(parcels, 1)
+	tst.ElementsMatch([]string{"receiver@email.com", "copied@email.com", "hidden@email.com"}, parcels[0].Recipients)
+	tst.Contains(parcels[0].Data, "Cc: <copied@email.com>")
+	tst.NotContains(parcels[0].Data, "hidden@email.com")
+}
+
+func TestDeliverWith_NoNormalize(t *testing.T) {
+	tst := assert.New(t)
+
+	p := CreateTestParameters()
+	p.SendTo = []string{"first.last+news@gmail.com"}
+	p.NoNormalize = true
+
+	transport := guild.NewMemoryTransport()
+	tst.Nil(DeliverWith(transport, p))
+	tst.Equal([]string{"first.last+news@gmail.com"}, transport.Parcels()[0].Recipients)
+
+	p.RejectRoleAccounts = true
+	p.SendTo = []string{"postmaster@email.com"}
+	tst.ErrorContains(DeliverWith(transport, p), "'postmaster@email.com' is a role account")
+}
+
+func TestDeliver_SMTPTransport(t *testing.T) {
+	srv := couriertest.NewServer(t, nil)
+
+	p := CreateTestParameters()
+	p.Host = srv.Host()
+	p.Port = srv.Port()
+	p.SendBcc = []string{"hidden@email.com"}
+
+	err := Deliver(p)
+	assert.Nil(t, err)
+
+	msg := srv.WaitForMessages(t, 1)[0]
+	msg.AssertFrom(t, "sender@email.com")
+	msg.AssertRecipients(t, "receiver@email.com", "hidden@email.com")
+	msg.AssertSubject(t, "Hello Courier")
+	msg.AssertTextContains(t, "This is the Courier body.")
+	msg.AssertNoHeader(t, "Bcc")
+}
+
+func TestDeliver_SMTPPool(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+
+	p := CreateTestParameters()
+	p.Host = srv.Host()
+	p.Port = srv.Port()
+	p.PoolSize = 2
+
+	transport, err := NewTransport(p)
+	tst.Nil(err)
+	tst.IsType(&guild.CourierPool{}, transport)
+	for i := 0; i < 3; i++ {
+		tst.Nil(DeliverWith(transport, p))
+	}
+	tst.Nil(transport.Close())
+
+	srv.WaitForMessages(t, 3)
+	tst.Equal(1, srv.Connections())
+
+	p.Relays = []string{srv.Addr()}
+	tst.ErrorContains(Deliver(p), "a session pool cannot be used with relays")
+}
+
+func TestDeliver_SMTPRelays(t *testing.T) {
+	primary := couriertest.NewServer(t, nil)
+	backup := couriertest.NewServer(t, nil)
+	primary.Close()
+
+	p := CreateTestParameters()
+	p.Host = primary.Host()
+	p.Port = primary.Port()
+	p.Relays = []string{backup.Addr()}
+
+	err := Deliver(p)
+	assert.Nil(t, err)
+
+	msg := backup.WaitForMessages(t, 1)[0]
+	msg.AssertSubject(t, "Hello Courier")
+}
+
+func TestParseRelay(t *testing.T) {
+	tst := assert.New(t)
+
+	p := params.CourierParams{Host: "primary.example.com", Port: 587}
+	route, err := parseRelay("backup.example.com", &p, 1)
+	tst.Nil(err)
+	tst.Equal("backup.example.com", p.Host)
+	tst.Equal(587, p.Port)
+	tst.Equal(1, route.Priority)
+	tst.Equal(0, route.Weight)
+
+	route, err = parseRelay("relay.example.com:2525?priority=5&weight=3", &p, 2)
+	tst.Nil(err)
+	tst.Equal("relay.example.com", p.Host)
+	tst.Equal(2525, p.Port)
+	tst.Equal(5, route.Priority)
+	tst.Equal(3, route.Weight)
+
+	_, err = parseRelay("relay.example.com:smtp", &p, 1)
+	tst.ErrorContains(err, "invalid port")
+
+	_, err = parseRelay("relay.example.com?weight=heavy", &p, 1)
+	tst.ErrorContains(err, "invalid weight")
+}
+
+func TestDeliver_RegisteredTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := guild.NewMemoryTransport()
+	RegisterTransport("test-memory", func(p params.Parameters) (guild.Transport, error) {
+		return transport, nil
+	})
+
+	p := CreateTestParameters()
+	p.Transport = "test-memory"
+
+	err := Deliver(p)
+	tst.Nil(err)
+	tst.Len(transport.Parcels(), 1)
+	tst.Contains(Transports(), "smtp")
+}
+
+func TestDeliver_Quota(t *testing.T) {
+	tst := assert.New(t)
+
+	transport := guild.NewMemoryTransport()
+	RegisterTransport("test-quota", func(p params.Parameters) (guild.Transport, error) {
+		return transport, nil
+	})
+
+	p := CreateTestParameters()
+	p.Transport = "test-quota"
+	p.DomainLimits = []string{"email.com?daily=1"}
+	p.RateLimitNoWait = true
+
+	limited, err := NewTransport(p)
+	tst.Nil(err)
+
+	tst.Nil(DeliverWith(limited, p))
+
+	err = DeliverWith(limited, p)
+	var quotaErr *guild.QuotaError
+	tst.ErrorAs(err, &quotaErr)
+	tst.Equal("daily for email.com", quotaErr.Limit)
+	tst.Len(transport.Parcels(), 1)
+
+	p.DomainLimits = []string{"email.com?hourly=lots"}
+	_, err = NewTransport(p)
+	tst.ErrorContains(err, "domain limit 'email.com?hourly=lots' has an invalid hourly")
+}
+
+func TestDeliver_FileTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	p := CreateTestParameters()
+	p.Transport = "file"
+	p.FileDir = t.TempDir()
+
+	tst.Nil(Deliver(p))
+
+	emls, err := filepath.Glob(filepath.Join(p.FileDir, "*.eml"))
+	tst.Nil(err)
+	tst.Len(emls, 1)
+	content, err := os.ReadFile(emls[0])
+	tst.Nil(err)
+	tst.Contains(string(content), "Subject: Hello Courier")
+
+	p.FileDir = ""
+	tst.ErrorContains(Deliver(p), "the file transport requires a directory")
+}
+
+func TestDeliver_MaildirTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	p := CreateTestParameters()
+	p.Transport = "maildir"
+	p.Maildir = filepath.Join(t.TempDir(), "Maildir")
+
+	tst.Nil(Deliver(p))
+
+	entries, err := os.ReadDir(filepath.Join(p.Maildir, "new"))
+	tst.Nil(err)
+	tst.Len(entries, 1)
+}
+
+func TestDeliver_DKIMSignsEveryTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	tst.Nil(err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	tst.Nil(err)
+	keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+	tst.Nil(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	p := CreateTestParameters()
+	p.Transport = "maildir"
+	p.Maildir = filepath.Join(t.TempDir(), "Maildir")
+	p.DKIMDomain = "email.com"
+	p.DKIMSelector = "courier"
+	p.DKIMKeyFile = keyFile
+
+	tst.Nil(Deliver(p))
+	emls, err := filepath.Glob(filepath.Join(p.Maildir, "new", "*"))
+	tst.Nil(err)
+	tst.Len(emls, 1)
+	content, err := os.ReadFile(emls[0])
+	tst.Nil(err)
+	tst.Contains(string(content), "\nDKIM-Signature: v=1; a=ed25519-sha256;")
+
+	p.Transport = "http"
+	p.APIProvider = "sendgrid"
+	tst.ErrorContains(Deliver(p), "the http transport cannot dkim sign messages")
+}
+
+func TestDeliver_SendmailTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the sendmail stub is a shell script")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "sendmail")
+	tst.Nil(os.WriteFile(script, []byte("#!/bin/sh\ncat > \""+filepath.Join(dir, "input")+"\"\n"), 0o755))
+
+	p := CreateTestParameters()
+	p.Transport = "sendmail"
+	p.SendmailPath = script
+
+	tst.Nil(Deliver(p))
+
+	input, err := os.ReadFile(filepath.Join(dir, "input"))
+	tst.Nil(err)
+	tst.Contains(string(input), "Subject: ")
+}
+
+func TestDeliver_LMTPTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, func(s *couriertest.Server) {
+		s.LMTP = true
+		s.UnixSocket = true
+	})
+
+	p := CreateTestParameters()
+	p.Transport = "lmtp"
+	p.LMTPAddress = "unix:" + srv.Addr()
+
+	tst.Nil(Deliver(p))
+	srv.WaitForMessages(t, 1)
+
+	// a socket path needs its prefix
+	p.LMTPAddress = srv.Addr()
+	tst.ErrorContains(Deliver(p), "is not a valid lmtp address, use host:port or unix:/path/to/socket")
+
+	p.LMTPAddress = ""
+	tst.ErrorContains(Deliver(p), "the lmtp transport requires an address")
+}
+
+func TestDeliver_HTTPTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	var received map[string]any
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tst.Equal("secret", r.Header.Get("X-Api-Key"))
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		_, _ = w.Write([]byte(`{"id": "1"}`))
+	}))
+	defer api.Close()
+
+	payload := filepath.Join(t.TempDir(), "payload.json")
+	tst.Nil(os.WriteFile(payload, []byte(`{"from": {{ .From.Address | json }}, "subject": {{ .Subject | json }}}`), 0o600))
+
+	p := CreateTestParameters()
+	p.Transport = "http"
+	p.APIProvider = "generic"
+	p.APIEndpoint = api.URL
+	p.APIPayloadFile = payload
+	p.APIHeaders = []string{"X-Api-Key: secret"}
+
+	tst.Nil(Deliver(p))
+	tst.Equal(p.SendFrom, received["from"])
+
+	// 429 and 5xx are retried unless asked otherwise
+	transport, err := NewTransport(p)
+	tst.Nil(err)
+	tst.IsType(&guild.RetryTransport{}, transport)
+	p.RetryAttempts = 1
+	transport, err = NewTransport(p)
+	tst.Nil(err)
+	tst.IsType(&guild.HTTPTransport{}, transport)
+
+	p.APIHeaders = []string{"no-colon"}
+	tst.ErrorContains(Deliver(p), "'no-colon' is not a valid api header")
+
+	p.APIProvider = "carrier-pigeon"
+	tst.ErrorContains(Deliver(p), "'carrier-pigeon' is not a valid api provider")
+}
+
+// localResolver sends every domain to the local host.
+type localResolver struct{}
+
+func (localResolver) LookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	return []*net.MX{{Host: "127.0.0.1.", Pref: 10}}, nil
+}
+
+func TestDeliver_MXTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+
+	p := CreateTestParameters()
+	p.MXPort = srv.Port()
+	p.MXHelo = "courier.test"
+
+	transport, err := newMXTransport(p.CourierParams)
+	tst.Nil(err)
+	transport.SetResolver(localResolver{})
+
+	tst.Nil(DeliverWith(transport, p))
+	srv.WaitForMessages(t, 1)[0].AssertRecipients(t, "receiver@email.com")
+}
+
+func TestDeliver_UnknownTransport(t *testing.T) {
+	tst := assert.New(t)
+
+	p := CreateTestParameters()
+	p.Transport = "carrier-pigeon"
+
+	err := Deliver(p)
+	tst.ErrorContains(err, "unknown transport 'carrier-pigeon'")
+}
+
+func TestDeliverWithContext_Cancelled(t *testing.T) {
+	tst := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	transport := guild.NewMemoryTransport()
+	_, err := DeliverWithContext(ctx, transport, CreateTestParameters())
+	tst.ErrorIs(err, context.Canceled)
+	tst.Len(transport.Parcels(), 0)
+}
+
+func TestDeliverContext_ReturnsResult(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+
+	p := CreateTestParameters()
+	p.Host = srv.Host()
+	p.Port = srv.Port()
+	p.RetryAttempts = 2
+
+	result, err := DeliverContext(context.Background(), p)
+	tst.Nil(err)
+	tst.Equal(srv.Addr(), result.Host)
+	tst.True(result.Sent)
+	tst.Len(result.Accepted(), 1)
+
+	result, err = DeliverWithContext(context.Background(), guild.NewMemoryTransport(), CreateTestParameters())
+	tst.Nil(err)
+	tst.Nil(result)
+}
+
+func TestDeliver_Logger(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+
+	var output bytes.Buffer
+	p := CreateTestParameters()
+	p.Host = srv.Host()
+	p.Port = srv.Port()
+	p.Logger = slog.New(slog.NewTextHandler(&output, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	tst.Nil(Deliver(p))
+	tst.Contains(output.String(), `direction=C line="RCPT TO:<receiver@email.com>"`)
+}
+
+func TestDeliver_ReturnPathVERP(t *testing.T) {
+	tst := assert.New(t)
+
+	srv := couriertest.NewServer(t, nil)
+
+	p := CreateTestParameters()
+	p.Host = srv.Host()
+	p.Port = srv.Port()
+	p.SendBcc = []string{"hidden@email.com"}
+	p.Sender = "assistant@email.com"
+	p.ReturnPath = "bounces@email.com"
+
+	tst.Nil(Deliver(p))
+	msg := srv.WaitForMessages(t, 1)[0]
+	msg.AssertFrom(t, "bounces@email.com")
+	msg.AssertHeader(t, "Sender", "<assistant@email.com>")
+	msg.AssertRecipients(t, "receiver@email.com", "hidden@email.com")
+
+	p.VERP = true
+	tst.Nil(Deliver(p))
+	verped := srv.WaitForMessages(t, 3)[1:]
+	var froms []string
+	for _, msg := range verped {
+		tst.Len(msg.To, 1)
+		froms = append(froms, msg.From)
+	}
+	tst.ElementsMatch([]string{"bounces+receiver=email.com@email.com", "bounces+hidden=email.com@email.com"}, froms)
+}
+
+func TestDeliverWith_Safeguard(t *testing.T) {
+	tst := assert.New(t)
+
+	var output bytes.Buffer
+
+	p := CreateTestParameters()
+	p.SendTo = []string{"customer@client.com", "dev@example.com"}
+	p.RedirectTo = "catchall@email.com"
+	p.AllowRecipients = []string{"example.com"}
+	p.Logger = slog.New(slog.NewTextHandler(&output, nil))
+
+	transport := guild.NewMemoryTransport()
+	tst.Nil(DeliverWith(transport, p))
+	parcel := transport.Parcels()[0]
+	tst.ElementsMatch([]string{"catchall@email.com", "dev@example.com"}, parcel.Recipients)
+	tst.Contains(parcel.Data, "X-Original-To: <customer@client.com>")
+	tst.Contains(output.String(), "safeguard changed the recipients")
+	tst.Contains(output.String(), "redirected=[customer@client.com]")
+
+	// with no catch-all, recipients that are not allowed are dropped
+	p.RedirectTo = ""
+	p.SendTo = []string{"customer@client.com"}
+	tst.ErrorContains(DeliverWith(transport, p), "the safeguard left no recipients: dropped customer@client.com")
+	tst.Len(transport.Parcels(), 1)
+}
@@ -0,0 +1,275 @@
+package courier
+
+import (
+	"fmt"
+	"github.com/markgemmill/courier/guild"
+	"github.com/markgemmill/courier/params"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultTransport is used when params.CourierParams.Transport is empty.
+const DefaultTransport = "smtp"
+
+// TransportFactory builds a Transport from the delivery parameters.
+type TransportFactory func(p params.Parameters) (guild.Transport, error)
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]TransportFactory{
+		"smtp": func(p params.Parameters) (guild.Transport, error) {
+			if len(p.Relays) > 0 {
+				if p.PoolSize > 0 {
+					return nil, fmt.Errorf("a session pool cannot be used with relays")
+				}
+				return newRouter(p.CourierParams)
+			}
+			courier, err := newCourier(p.CourierParams)
+			if err != nil {
+				return nil, err
+			}
+			if p.PoolSize > 0 {
+				return guild.NewCourierPool(courier, p.PoolSize), nil
+			}
+			return courier, nil
+		},
+		"file": func(p params.Parameters) (guild.Transport, error) {
+			if p.FileDir == "" {
+				return nil, fmt.Errorf("the file transport requires a directory")
+			}
+			return guild.NewFileTransport(p.FileDir)
+		},
+		"maildir": func(p params.Parameters) (guild.Transport, error) {
+			if p.Maildir == "" {
+				return nil, fmt.Errorf("the maildir transport requires a maildir")
+			}
+			transport, err := guild.NewMaildirTransport(p.Maildir)
+			if err != nil {
+				return nil, err
+			}
+			transport.SetOwner(p.MaildirOwner)
+			return transport, nil
+		},
+		"sendmail": func(p params.Parameters) (guild.Transport, error) {
+			return guild.NewSendmailTransport(p.SendmailPath, p.SendmailArgs...), nil
+		},
+		"lmtp": func(p params.Parameters) (guild.Transport, error) {
+			return newLMTPTransport(p.CourierParams)
+		},
+		"http": func(p params.Parameters) (guild.Transport, error) {
+			return newHTTPTransport(p.CourierParams)
+		},
+		"mx": func(p params.Parameters) (guild.Transport, error) {
+			return newMXTransport(p.CourierParams)
+		},
+	}
+)
+
+// RegisterTransport makes a Transport available by name, so that it can
+// be selected with params.CourierParams.Transport. Registering an existing
+// name replaces it.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[strings.ToLower(name)] = factory
+}
+
+// Transports returns the names of the registered transports.
+func Transports() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTransport builds the Transport named by p.Transport, wrapping it
+// in a guild.DKIMTransport when p.DKIMKeyFile is set, in a
+// guild.RateLimitTransport when limits are set, in a
+// guild.RetryTransport when p.RetryAttempts asks for retries, or by
+// default for "http", and in a guild.VERPTransport when p.VERP is set.
+func NewTransport(p params.Parameters) (guild.Transport, error) {
+	name := strings.ToLower(strings.TrimSpace(p.Transport))
+	if name == "" {
+		name = DefaultTransport
+	}
+
+	transportsMu.RLock()
+	factory, ok := transports[name]
+	transportsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown transport '%s' (available: %s)", name, strings.Join(Transports(), ", "))
+	}
+	if p.DKIMKeyFile != "" && name == "http" {
+		return nil, fmt.Errorf("the http transport cannot dkim sign messages, the api provider signs them")
+	}
+
+	transport, err := factory(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// signed innermost, so that every message VERP makes is signed
+	if p.DKIMKeyFile != "" {
+		signer, err := newDKIMSigner(p.CourierParams)
+		if err != nil {
+			_ = transport.Close()
+			return nil, err
+		}
+		transport = guild.NewDKIMTransport(transport, signer)
+	}
+
+	if p.RatePerSecond > 0 || p.HourlyQuota > 0 || p.DailyQuota > 0 || len(p.DomainLimits) > 0 {
+		transport, err = newRateLimitTransport(transport, p.CourierParams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.RetryAttempts > 1 {
+		policy := guild.DefaultRetryPolicy()
+		policy.MaxAttempts = p.RetryAttempts
+		transport = guild.NewRetryTransport(transport, policy)
+	} else if p.RetryAttempts == 0 && name == "http" {
+		// APIs answer 429 and 503 often enough to always try again
+		transport = guild.NewRetryTransport(transport, guild.HTTPRetryPolicy())
+	}
+
+	// each recipient's message is limited and retried on its own
+	if p.VERP {
+		transport = guild.NewVERPTransport(transport)
+	}
+
+	return transport, nil
+}
+
+func newLMTPTransport(p params.CourierParams) (*guild.LMTPTransport, error) {
+	if p.LMTPAddress == "" {
+		return nil, fmt.Errorf("the lmtp transport requires an address")
+	}
+
+	network, address := "tcp", p.LMTPAddress
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("'%s' is not a valid lmtp address, use host:port or unix:/path/to/socket", p.LMTPAddress)
+	}
+	transport := guild.NewLMTPTransport(network, address)
+
+	policy, err := guild.ParseRecipientPolicy(p.RecipientPolicy)
+	if err != nil {
+		return nil, err
+	}
+	transport.SetRecipientPolicy(policy)
+	transport.SetLogger(p.Logger)
+
+	return transport, nil
+}
+
+func newHTTPTransport(p params.CourierParams) (*guild.HTTPTransport, error) {
+	var provider guild.APIProvider
+	switch strings.ToLower(p.APIProvider) {
+	case "sendgrid":
+		provider = guild.NewSendGridProvider(p.APIKey)
+	case "postmark":
+		provider = guild.NewPostmarkProvider(p.APIKey)
+	case "resend":
+		provider = guild.NewResendProvider(p.APIKey)
+	case "generic":
+		if p.APIEndpoint == "" || p.APIPayloadFile == "" {
+			return nil, fmt.Errorf("the generic api provider requires an endpoint and a payload template")
+		}
+		payload, err := os.ReadFile(p.APIPayloadFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read api payload template: %w", err)
+		}
+		generic, err := guild.NewGenericProvider(p.APIEndpoint, string(payload))
+		if err != nil {
+			return nil, err
+		}
+		for _, header := range p.APIHeaders {
+			name, value, ok := strings.Cut(header, ":")
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("'%s' is not a valid api header", header)
+			}
+			generic.SetHeader(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+		if p.APIMessageIDField != "" {
+			generic.SetMessageIDField(p.APIMessageIDField)
+		}
+		provider = generic
+	default:
+		return nil, fmt.Errorf("'%s' is not a valid api provider", p.APIProvider)
+	}
+
+	transport := guild.NewHTTPTransport(provider)
+	if p.APIEndpoint != "" {
+		transport.SetEndpoint(p.APIEndpoint)
+	}
+	return transport, nil
+}
+
+func newMXTransport(p params.CourierParams) (*guild.MXTransport, error) {
+	transport := guild.NewMXTransport()
+	if p.MXHelo != "" {
+		transport.SetHelo(p.MXHelo)
+	}
+	if p.MXPort > 0 {
+		transport.SetPort(p.MXPort)
+	}
+
+	policy, err := guild.ParseRecipientPolicy(p.RecipientPolicy)
+	if err != nil {
+		return nil, err
+	}
+	transport.SetRecipientPolicy(policy)
+	transport.SetLogger(p.Logger)
+
+	return transport, nil
+}
+
+func newRateLimitTransport(transport guild.Transport, p params.CourierParams) (*guild.RateLimitTransport, error) {
+	limited := guild.NewRateLimitTransport(transport, guild.RateLimit{
+		PerSecond: p.RatePerSecond,
+		Burst:     p.RateBurst,
+		Hourly:    p.HourlyQuota,
+		Daily:     p.DailyQuota,
+	})
+	limited.SetBlocking(!p.RateLimitNoWait)
+
+	for _, spec := range p.DomainLimits {
+		domain, query, _ := strings.Cut(strings.TrimSpace(spec), "?")
+		values, err := url.ParseQuery(query)
+		if domain == "" || err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid domain limit", spec)
+		}
+
+		limit := guild.RateLimit{}
+		for name, target := range map[string]*int{"burst": &limit.Burst, "hourly": &limit.Hourly, "daily": &limit.Daily} {
+			if value := values.Get(name); value != "" {
+				*target, err = strconv.Atoi(value)
+				if err != nil {
+					return nil, fmt.Errorf("domain limit '%s' has an invalid %s", spec, name)
+				}
+			}
+		}
+		if value := values.Get("per-second"); value != "" {
+			limit.PerSecond, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("domain limit '%s' has an invalid per-second", spec)
+			}
+		}
+		limited.SetDomainLimit(domain, limit)
+	}
+
+	return limited, nil
+}